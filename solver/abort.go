@@ -0,0 +1,26 @@
+package solver
+
+import "github.com/pkg/errors"
+
+// ErrEdgeAborted is returned for edges failed by AbortEdge
+var ErrEdgeAborted = errors.Errorf("edge aborted")
+
+// AbortEdge fails an edge that hasn't completed yet with ErrEdgeAborted. The
+// running requests of the edge, like its operation or cache key computation,
+// are canceled and the builds waiting for the edge fail as soon as the
+// canceled requests return. If the edge was merged, the edge it was merged to
+// is aborted. Returns false if the edge is not loaded or already complete.
+func (s *scheduler) AbortEdge(edge Edge) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil || e.isComplete() {
+		return false
+	}
+	// canceled requests don't replace the error when they return
+	e.err = errors.Wrapf(ErrEdgeAborted, "failed to solve %s", e.edge.Vertex.Name())
+	s.edgeLogger(e).Warnf("aborting edge %s", e.edge.Vertex.Name())
+	s.signal(e)
+	return true
+}
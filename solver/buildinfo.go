@@ -0,0 +1,48 @@
+package solver
+
+import "context"
+
+// BuildInfo describes how the result of a build was produced. It is filled in
+// when a build started with a context from WithBuildInfo returns.
+type BuildInfo struct {
+	// Merged is true if the requested edge was merged to another edge with a
+	// matching cache key, so the result was produced by the work of another
+	// build in the same session instead of independently. This is separate
+	// from loading the result from the cache.
+	Merged bool
+}
+
+type buildInfoKey struct{}
+
+// WithBuildInfo returns a context that makes the builds started with it fill
+// in info before they return
+func WithBuildInfo(ctx context.Context, info *BuildInfo) context.Context {
+	return context.WithValue(ctx, buildInfoKey{}, info)
+}
+
+func buildInfo(ctx context.Context) *BuildInfo {
+	info, _ := ctx.Value(buildInfoKey{}).(*BuildInfo)
+	return info
+}
+
+// markMergedBuilds records that the builds requesting src get their result
+// from target. Called with mu held.
+func (s *scheduler) markMergedBuilds(src *edge) {
+	for b := range s.builds {
+		if b.edge == src && !b.merged {
+			b.merged = true
+			s.stats.mergedBuilds++
+		}
+	}
+}
+
+// fillBuildInfo sets the BuildInfo of the context b was started with
+func (s *scheduler) fillBuildInfo(b *activeBuild) {
+	info := buildInfo(b.ctx)
+	if info == nil {
+		return
+	}
+	s.mu.Lock()
+	info.Merged = b.merged
+	s.mu.Unlock()
+}
@@ -0,0 +1,143 @@
+package solver
+
+import (
+	"context"
+	"time"
+)
+
+// minBuildStatusInterval is the shortest interval BuildStatus sends snapshots
+// at. Every snapshot locks the scheduler to walk the graph of the build.
+const minBuildStatusInterval = 10 * time.Millisecond
+
+// BuildStatusUpdate is a snapshot of the progress of a build
+type BuildStatusUpdate struct {
+	// Total is the number of edges in the graph of the build that have been
+	// requested so far. It grows while the build discovers its inputs. Edges
+	// that were merged are counted once.
+	Total int
+	// Queued is the number of edges waiting to be dispatched
+	Queued int
+	// Running is the number of edges running asynchronous work, like
+	// computing cache keys or executing their operation
+	Running int
+	// Complete is the number of edges that completed
+	Complete int
+}
+
+// BuildStatus sends a snapshot of the progress of the running builds matching
+// req every interval. Builds are matched like in SetPriority. The channel
+// receives a final snapshot and is closed when the builds complete or ctx is
+// canceled. A closed channel is returned if no build matches req. Intervals
+// shorter than 10ms are raised to 10ms.
+func (s *scheduler) BuildStatus(ctx context.Context, req BuildRequest, interval time.Duration) <-chan BuildStatusUpdate {
+	ch := make(chan BuildStatusUpdate, 1)
+	if interval < minBuildStatusInterval {
+		interval = minBuildStatusInterval
+	}
+
+	s.mu.Lock()
+	builds := s.matchBuilds(req)
+	s.mu.Unlock()
+	if len(builds) == 0 {
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		for _, b := range builds {
+			for {
+				tick := make(chan struct{})
+				t := s.opt.Clock.AfterFunc(interval, func() { close(tick) })
+				final := false
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return
+				case <-b.done:
+					t.Stop()
+					final = true
+				case <-tick:
+				}
+				select {
+				case ch <- s.buildStatus(b):
+				case <-ctx.Done():
+					return
+				}
+				if final {
+					break
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// EstimatedRemaining returns the number of completed edges and the total
+// number of edges of the running builds matching req. Builds are matched like
+// in SetPriority. The graph of a build is discovered as its edges are
+// dispatched, so total is a lower bound that grows while the build runs. Zero
+// is returned if no build matches req.
+func (s *scheduler) EstimatedRemaining(req BuildRequest) (completed, total int) {
+	s.mu.Lock()
+	builds := s.matchBuilds(req)
+	s.mu.Unlock()
+
+	for _, b := range builds {
+		st := s.buildStatus(b)
+		completed += st.Complete
+		total += st.Total
+	}
+	return completed, total
+}
+
+// buildStatus counts the states of the edges in the graph of a build. Only
+// edges that are already loaded are visited, inputs that haven't been
+// requested yet are not counted.
+func (s *scheduler) buildStatus(b *activeBuild) BuildStatusUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.muQ.Lock()
+	defer s.muQ.Unlock()
+
+	var st BuildStatusUpdate
+	seen := map[*edge]struct{}{}
+	var walk func(Edge)
+	walk = func(edge Edge) {
+		e := s.ef.lookupEdge(edge)
+		if e == nil {
+			return
+		}
+		if _, ok := seen[e]; ok {
+			return
+		}
+		seen[e] = struct{}{}
+		st.Total++
+		_, queued := s.waitq[e]
+		_, held := s.held[e]
+		switch {
+		case e.isComplete():
+			st.Complete++
+		case queued || held:
+			st.Queued++
+		case s.hasRunningFunc(e):
+			st.Running++
+		}
+		for _, inp := range e.edge.Vertex.Inputs() {
+			walk(inp)
+		}
+	}
+	walk(b.edge.edge)
+	return st
+}
+
+// hasRunningFunc returns true if the edge has an asynchronous request that
+// hasn't completed
+func (s *scheduler) hasRunningFunc(e *edge) bool {
+	for _, p := range s.outgoing[e] {
+		if p.Target == nil && !p.Receiver.Status().Completed {
+			return true
+		}
+	}
+	return false
+}
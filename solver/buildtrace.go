@@ -0,0 +1,163 @@
+package solver
+
+import (
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TraceRecorder records how the scheduler processed the edges of the builds.
+// A recorder is set with WithTraceRecorder and the recorded trace can be
+// captured with Snapshot and compared with another trace with DiffTraces.
+type TraceRecorder struct {
+	mu       sync.Mutex
+	vertexes map[traceKey]*VertexTrace
+	order    []traceKey
+}
+
+type traceKey struct {
+	dgst  digest.Digest
+	index Index
+}
+
+// BuildTrace is a snapshot of a TraceRecorder
+type BuildTrace struct {
+	// Vertexes are sorted by the order of their first dispatch
+	Vertexes []VertexTrace
+}
+
+// VertexTrace describes how an edge was processed in a build
+type VertexTrace struct {
+	Digest digest.Digest
+	Index  Index
+	Name   string
+	// Order is the position of the first dispatch of the edge in the trace
+	Order int
+	// Dispatches is the number of times the edge was dispatched
+	Dispatches int
+	// Completed is true if the edge completed with a result
+	Completed bool
+	// Cached is true if the result was loaded from the cache
+	Cached bool
+	// MergedTo is the digest of the vertex the edge was merged into
+	MergedTo digest.Digest
+}
+
+// NewTraceRecorder returns a new empty recorder
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{vertexes: map[traceKey]*VertexTrace{}}
+}
+
+// Snapshot returns a copy of the current trace
+func (r *TraceRecorder) Snapshot() *BuildTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := &BuildTrace{Vertexes: make([]VertexTrace, 0, len(r.order))}
+	for _, k := range r.order {
+		t.Vertexes = append(t.Vertexes, *r.vertexes[k])
+	}
+	return t
+}
+
+// Reset clears the recorded trace
+func (r *TraceRecorder) Reset() {
+	r.mu.Lock()
+	r.vertexes = map[traceKey]*VertexTrace{}
+	r.order = nil
+	r.mu.Unlock()
+}
+
+func (r *TraceRecorder) get(e *edge) *VertexTrace {
+	k := traceKey{dgst: e.edge.Vertex.Digest(), index: e.edge.Index}
+	vt, ok := r.vertexes[k]
+	if !ok {
+		vt = &VertexTrace{
+			Digest: k.dgst,
+			Index:  k.index,
+			Name:   e.edge.Vertex.Name(),
+			Order:  len(r.order),
+		}
+		r.vertexes[k] = vt
+		r.order = append(r.order, k)
+	}
+	return vt
+}
+
+func (r *TraceRecorder) dispatched(e *edge) {
+	r.mu.Lock()
+	r.get(e).Dispatches++
+	r.mu.Unlock()
+}
+
+func (r *TraceRecorder) completed(e *edge) {
+	r.mu.Lock()
+	vt := r.get(e)
+	vt.Completed = true
+	vt.Cached = e.execCacheLoad
+	r.mu.Unlock()
+}
+
+func (r *TraceRecorder) merged(src, target *edge) {
+	r.mu.Lock()
+	r.get(src).MergedTo = target.edge.Vertex.Digest()
+	r.mu.Unlock()
+}
+
+// VertexTraceDiff is a divergence between two traces for the same edge
+type VertexTraceDiff struct {
+	Digest digest.Digest
+	Index  Index
+	Name   string
+	// A and B are the traces of the edge. One of them is nil if the edge was
+	// only processed in one of the builds.
+	A, B *VertexTrace
+	// OrderChanged is set if the edge was first dispatched in a different
+	// position
+	OrderChanged bool
+	// CacheChanged is set if the edge was loaded from cache in one build and
+	// executed or not completed in the other
+	CacheChanged bool
+	// MergeChanged is set if the edge was merged into a different vertex
+	MergeChanged bool
+}
+
+// DiffTraces compares two traces and returns the edges that were processed
+// differently. Edges are aligned by vertex digest and output index. Edges that
+// are only in a come first, followed by the edges only in b, both in the order
+// of the trace they appear in.
+func DiffTraces(a, b *BuildTrace) []VertexTraceDiff {
+	bv := make(map[traceKey]*VertexTrace, len(b.Vertexes))
+	for i := range b.Vertexes {
+		vt := &b.Vertexes[i]
+		bv[traceKey{dgst: vt.Digest, index: vt.Index}] = vt
+	}
+
+	var out []VertexTraceDiff
+	seen := map[traceKey]struct{}{}
+	for i := range a.Vertexes {
+		va := &a.Vertexes[i]
+		k := traceKey{dgst: va.Digest, index: va.Index}
+		seen[k] = struct{}{}
+		d := VertexTraceDiff{Digest: va.Digest, Index: va.Index, Name: va.Name, A: va}
+		vb, ok := bv[k]
+		if ok {
+			d.B = vb
+			d.OrderChanged = va.Order != vb.Order
+			d.CacheChanged = va.Completed != vb.Completed || va.Cached != vb.Cached
+			d.MergeChanged = va.MergedTo != vb.MergedTo
+			if !d.OrderChanged && !d.CacheChanged && !d.MergeChanged {
+				continue
+			}
+		}
+		out = append(out, d)
+	}
+	for i := range b.Vertexes {
+		vb := &b.Vertexes[i]
+		if _, ok := seen[traceKey{dgst: vb.Digest, index: vb.Index}]; ok {
+			continue
+		}
+		out = append(out, VertexTraceDiff{Digest: vb.Digest, Index: vb.Index, Name: vb.Name, B: vb})
+	}
+	return out
+}
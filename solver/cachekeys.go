@@ -0,0 +1,74 @@
+package solver
+
+import "context"
+
+// resolveCacheKeys drives edge to edgeStatusCacheSlow, so its cache keys are
+// computed but its operation is not executed, and returns the keys. Edges
+// whose dependencies use content based cache keys still need the results of
+// the dependencies.
+func (s *scheduler) resolveCacheKeys(ctx context.Context, edge Edge) ([]ExportableCacheKey, error) {
+	e, err := s.waitForState(ctx, edge, edgeStatusCacheSlow)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the edge may have been merged while the keys were resolved
+	if e2 := s.ef.lookupEdge(edge); e2 != nil {
+		e = e2
+	}
+	return s.edgeCacheKeys(e), nil
+}
+
+// edgeCacheKeys returns the cache keys of e. Keys that matched records in the
+// cache are returned as they are. Otherwise the definition based key is built
+// from the cache map of e and the keys of its dependencies, including their
+// content based keys, the same way commitOptions builds it when the operation
+// is executed. Returns nil if a cache map or a dependency key is still
+// missing. Called with the scheduler locked.
+func (s *scheduler) edgeCacheKeys(e *edge) []ExportableCacheKey {
+	if e.result != nil {
+		return e.result.CacheKeys()
+	}
+	if len(e.keys) > 0 {
+		return e.keys
+	}
+	if e.cacheMap == nil {
+		return nil
+	}
+	if len(e.deps) == 0 {
+		keys := make([]ExportableCacheKey, 0, len(e.cacheMapDigests))
+		for _, dgst := range e.cacheMapDigests {
+			k := NewCacheKey(dgst, e.edge.Index)
+			keys = append(keys, ExportableCacheKey{CacheKey: k, Exporter: &exporter{k: k}})
+		}
+		return keys
+	}
+	k := NewCacheKey(e.cacheMap.Digest, e.edge.Index)
+	k.deps = make([][]CacheKeyWithSelector, len(e.deps))
+	inputs := e.edge.Vertex.Inputs()
+	for i, dep := range e.deps {
+		keys := dep.keys
+		if dep.result != nil {
+			keys = dep.result.CacheKeys()
+		} else if len(keys) == 0 {
+			// keys of dependencies without cache records are only known
+			// once they are built, so they are computed the same way
+			de := s.ef.lookupEdge(inputs[i])
+			if de == nil {
+				return nil
+			}
+			keys = s.edgeCacheKeys(de)
+		}
+		for _, dk := range keys {
+			k.deps[i] = append(k.deps[i], CacheKeyWithSelector{CacheKey: dk, Selector: e.cacheMap.Deps[i].Selector})
+		}
+		if dep.slowCacheKey != nil {
+			k.deps[i] = append(k.deps[i], CacheKeyWithSelector{CacheKey: *dep.slowCacheKey})
+		}
+		if len(k.deps[i]) == 0 {
+			return nil
+		}
+	}
+	return []ExportableCacheKey{{CacheKey: k, Exporter: &exporter{k: k}}}
+}
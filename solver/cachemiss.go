@@ -0,0 +1,61 @@
+package solver
+
+// CacheMissReason describes why an edge executed its operation instead of
+// using a result from the cache
+type CacheMissReason string
+
+const (
+	// CacheMissReasonIgnoreCache is used for vertexes with
+	// VertexOptions.IgnoreCache
+	CacheMissReasonIgnoreCache CacheMissReason = "ignore cache"
+	// CacheMissReasonLoadFailed is used when the cache had records matching
+	// the keys of the edge but none of them could be loaded
+	CacheMissReasonLoadFailed CacheMissReason = "cache load failed"
+	// CacheMissReasonMergeRefused is used when the index had an edge with a
+	// matching key but the merge to it was refused, for example because the
+	// definitions differed
+	CacheMissReasonMergeRefused CacheMissReason = "merge refused"
+	// CacheMissReasonNoMatch is used when no cache record matched the keys of
+	// the edge
+	CacheMissReasonNoMatch CacheMissReason = "no match"
+)
+
+// CacheMissEvent is emitted when an edge starts executing its operation
+type CacheMissEvent struct {
+	// Edge is the edge that executes
+	Edge Edge
+	// EdgeID is the ID of the scheduler edge of Edge
+	EdgeID uint64
+	Reason CacheMissReason
+	// Keys are the cache keys of the edge that were looked up in the cache.
+	// Edges without inputs only have the keys the cache already knew.
+	Keys []ExportableCacheKey
+	// Labels are the labels of the build that first requested the edge
+	Labels map[string]string
+}
+
+// emitCacheMiss reports that e started executing its operation to
+// SchedulerOpt.OnCacheMiss
+func (s *scheduler) emitCacheMiss(e *edge) {
+	if s.opt.OnCacheMiss == nil {
+		return
+	}
+	ev := CacheMissEvent{Edge: e.edge, EdgeID: e.id, Reason: cacheMissReason(e), Keys: append([]ExportableCacheKey(nil), e.keys...)}
+	if b := e.owner; b != nil {
+		ev.Labels = b.labels
+	}
+	s.opt.OnCacheMiss(ev)
+}
+
+func cacheMissReason(e *edge) CacheMissReason {
+	switch {
+	case e.op.IgnoreCache():
+		return CacheMissReasonIgnoreCache
+	case len(e.cacheRecordsLoaded) > 0:
+		return CacheMissReasonLoadFailed
+	case e.refusedMergeKey != nil:
+		return CacheMissReasonMergeRefused
+	default:
+		return CacheMissReasonNoMatch
+	}
+}
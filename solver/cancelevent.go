@@ -0,0 +1,88 @@
+package solver
+
+import "context"
+
+// CancelReason describes why the scheduler canceled a request
+type CancelReason string
+
+const (
+	// CancelReasonContext is used when the context of the build was canceled
+	CancelReasonContext CancelReason = "context canceled"
+	// CancelReasonTimeout is used when the context of the build timed out
+	CancelReasonTimeout CancelReason = "timeout"
+	// CancelReasonMerge is used for the requests of an edge that was merged
+	// into another edge
+	CancelReasonMerge CancelReason = "merge"
+	// CancelReasonFailure is used for the requests an edge still had open when
+	// it failed, for example because one of its other dependencies failed
+	CancelReasonFailure CancelReason = "failure"
+	// CancelReasonExplicit is used when the build was canceled through the
+	// API, for example with CancelByLabel
+	CancelReasonExplicit CancelReason = "explicit"
+	// CancelReasonMemoryPressure is used for builds that were canceled to free
+	// memory
+	CancelReasonMemoryPressure CancelReason = "memory pressure"
+	// CancelReasonGroup is used for builds that were canceled with the
+	// CancelGroup they were started with
+	CancelReasonGroup CancelReason = "group"
+)
+
+// CancelEvent is emitted whenever the scheduler cancels a request
+type CancelEvent struct {
+	// Edge is the edge the canceled request was made to. For asynchronous
+	// requests of an edge, like executing its operation, it is the edge that
+	// made the request.
+	Edge Edge
+	// EdgeID is the ID of the scheduler edge of Edge
+	EdgeID uint64
+	Reason CancelReason
+	// Labels are the labels of the originating build
+	Labels map[string]string
+	// Build is the request of the originating build if it was started from a
+	// job
+	Build *BuildRequest
+	// RequestID is the request ID of the originating build, see
+	// SchedulerOpt.RequestIDKey
+	RequestID string
+}
+
+func contextCancelReason(ctx context.Context) CancelReason {
+	if ctx.Err() == context.DeadlineExceeded {
+		return CancelReasonTimeout
+	}
+	return CancelReasonContext
+}
+
+// newEdgeCancelEvent creates an event for a request from edge e. The build
+// that first requested e is used as the originating build.
+func newEdgeCancelEvent(e *edge, p *edgePipe, reason CancelReason) CancelEvent {
+	ev := CancelEvent{Edge: e.edge, EdgeID: e.id, Reason: reason}
+	if p.Target != nil {
+		ev.Edge = p.Target.edge
+		ev.EdgeID = p.Target.id
+	}
+	if b := e.owner; b != nil {
+		ev.Labels = b.labels
+		ev.Build = b.request
+		ev.RequestID = b.requestID
+	}
+	return ev
+}
+
+func (s *scheduler) emitCancel(ev CancelEvent) {
+	if s.opt.OnCancel != nil {
+		s.opt.OnCancel(ev)
+	}
+}
+
+// canceledOutgoing returns the outgoing requests of e that are already
+// canceled
+func (s *scheduler) canceledOutgoing(e *edge) map[*edgePipe]struct{} {
+	m := map[*edgePipe]struct{}{}
+	for _, p := range s.outgoing[e] {
+		if p.Sender.Request().Canceled {
+			m[p] = struct{}{}
+		}
+	}
+	return m
+}
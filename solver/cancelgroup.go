@@ -0,0 +1,95 @@
+package solver
+
+import (
+	"context"
+	"sync"
+)
+
+// CancelGroup is a cancellation scope shared by builds that are otherwise
+// unrelated, for example the jobs of a CI matrix that should all be aborted
+// when one of them fails. Builds join a group by being started with a context
+// created with WithCancelGroup. A group can span builds of different jobs and
+// solvers.
+//
+// Canceling a group cancels the requests of its builds. The edges requested
+// by the builds are canceled the same way as for canceled build contexts, so
+// edges also requested by builds outside of the group keep running for them.
+type CancelGroup struct {
+	mu      sync.Mutex
+	err     error
+	next    int
+	members map[int]func(error)
+}
+
+// NewCancelGroup returns a new group that has not been canceled
+func NewCancelGroup() *CancelGroup {
+	return &CancelGroup{members: map[int]func(error){}}
+}
+
+// Cancel cancels all running builds of the group. The builds fail with err,
+// or with context.Canceled if err is nil. Builds started with the group after
+// it has been canceled fail immediately. Returns the number of builds that
+// were running in the group.
+func (g *CancelGroup) Cancel(err error) int {
+	if err == nil {
+		err = context.Canceled
+	}
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	members := make([]func(error), 0, len(g.members))
+	for _, f := range g.members {
+		members = append(members, f)
+	}
+	g.members = map[int]func(error){}
+	g.mu.Unlock()
+
+	for _, f := range members {
+		f(err)
+	}
+	return len(members)
+}
+
+// Err returns the error the group was canceled with, nil if it hasn't been
+// canceled
+func (g *CancelGroup) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// join adds a build to the group. cancel is called when the group is
+// canceled, immediately if it has been canceled already. The returned function
+// removes the build from the group.
+func (g *CancelGroup) join(cancel func(error)) func() {
+	g.mu.Lock()
+	if err := g.err; err != nil {
+		g.mu.Unlock()
+		cancel(err)
+		return func() {}
+	}
+	id := g.next
+	g.next++
+	g.members[id] = cancel
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		delete(g.members, id)
+		g.mu.Unlock()
+	}
+}
+
+type cancelGroupKey struct{}
+
+// WithCancelGroup returns a context that adds the builds started with it to
+// group g
+func WithCancelGroup(ctx context.Context, g *CancelGroup) context.Context {
+	return context.WithValue(ctx, cancelGroupKey{}, g)
+}
+
+func cancelGroup(ctx context.Context) *CancelGroup {
+	g, _ := ctx.Value(cancelGroupKey{}).(*CancelGroup)
+	return g
+}
@@ -0,0 +1,26 @@
+package solver
+
+import "time"
+
+// Clock is the time source of the scheduler. It can be replaced with
+// WithClock to control timers and statistics in tests.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after duration d
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -33,9 +33,24 @@ func (cm *combinedCacheManager) ID() string {
 	return cm.id
 }
 
+// rank returns the lookup preference of a cache manager. Main cache is always
+// preferred, other managers are preferred in the order they were passed in.
+func (cm *combinedCacheManager) rank(c CacheManager) int {
+	if c == cm.main {
+		return -1
+	}
+	for i, c2 := range cm.cms {
+		if c == c2 {
+			return i
+		}
+	}
+	return len(cm.cms)
+}
+
 func (cm *combinedCacheManager) Query(inp []CacheKeyWithSelector, inputIndex Index, dgst digest.Digest, outputIndex Index) ([]*CacheKey, error) {
 	eg, _ := errgroup.WithContext(context.TODO())
 	keys := make(map[string]*CacheKey, len(cm.cms))
+	ranks := make(map[string]int, len(cm.cms))
 	var mu sync.Mutex
 	for _, c := range cm.cms {
 		func(c CacheManager) {
@@ -44,10 +59,12 @@ func (cm *combinedCacheManager) Query(inp []CacheKeyWithSelector, inputIndex Ind
 				if err != nil {
 					return err
 				}
+				rank := cm.rank(c)
 				mu.Lock()
 				for _, r := range recs {
-					if _, ok := keys[r.ID]; !ok || c == cm.main {
+					if prev, ok := ranks[r.ID]; !ok || rank < prev {
 						keys[r.ID] = r
+						ranks[r.ID] = rank
 					}
 				}
 				mu.Unlock()
@@ -106,6 +123,7 @@ func (cm *combinedCacheManager) Records(ck *CacheKey) ([]*CacheRecord, error) {
 	}
 
 	records := map[string]*CacheRecord{}
+	ranks := map[string]int{}
 	var mu sync.Mutex
 
 	eg, _ := errgroup.WithContext(context.TODO())
@@ -116,13 +134,15 @@ func (cm *combinedCacheManager) Records(ck *CacheKey) ([]*CacheRecord, error) {
 				if err != nil {
 					return err
 				}
+				rank := cm.rank(c)
 				mu.Lock()
 				for _, rec := range recs {
-					if _, ok := records[rec.ID]; !ok || c == cm.main {
+					if prev, ok := ranks[rec.ID]; !ok || rank < prev {
 						if c == cm.main {
 							rec.Priority = 1
 						}
 						records[rec.ID] = rec
+						ranks[rec.ID] = rank
 					}
 				}
 				mu.Unlock()
@@ -0,0 +1,81 @@
+package solver
+
+import "context"
+
+// CompletionEvent describes an edge that completed
+type CompletionEvent struct {
+	// Edge is the edge that completed
+	Edge Edge
+	// EdgeID is the ID the scheduler assigned to the edge
+	EdgeID uint64
+	// Err is the error the edge failed with, nil if it completed with a result
+	Err error
+	// Cached is true if the result was loaded from the cache instead of
+	// executing the operation
+	Cached bool
+	// Labels are the labels of the build that first requested the edge
+	Labels map[string]string
+	// Build is the request of the build that first requested the edge, nil if
+	// the build was not started by a job
+	Build *BuildRequest
+	// Meta is a copy of the metadata stored on the edge with SetEdgeMeta
+	Meta map[string]interface{}
+}
+
+// buildContext returns the context of the build that first requested e.
+// Edges that were not requested by a build get an empty context.
+func buildContext(e *edge) context.Context {
+	if e.owner == nil || e.owner.ctx == nil {
+		return context.TODO()
+	}
+	return e.owner.ctx
+}
+
+// emitCompletion passes the completion of e to SchedulerOpt.OnEdgeComplete
+func (s *scheduler) emitCompletion(e *edge) {
+	if s.opt.OnEdgeComplete == nil {
+		return
+	}
+	ev := CompletionEvent{Edge: e.edge, EdgeID: e.id, Err: e.err, Cached: e.err == nil && e.execCacheLoad, Meta: e.copyMeta()}
+	if b := e.owner; b != nil {
+		ev.Labels = b.labels
+		ev.Build = b.request
+	}
+	s.opt.OnEdgeComplete(buildContext(e), ev)
+}
+
+type tappedResult struct {
+	edge Edge
+	res  CachedResult
+}
+
+// tapResult queues the result of e for SchedulerOpt.OnResult. Called with the
+// scheduler locked.
+func (s *scheduler) tapResult(e *edge) {
+	if s.opt.OnResult == nil {
+		return
+	}
+	res, err := e.result.tryCloneCachedResult()
+	if err != nil {
+		return
+	}
+	s.tapped = append(s.tapped, tappedResult{edge: e.edge, res: res})
+}
+
+// flushResults passes the queued results to SchedulerOpt.OnResult. Called
+// with the scheduler locked, which is released while the function runs.
+func (s *scheduler) flushResults() {
+	if len(s.tapped) == 0 {
+		return
+	}
+	tapped := s.tapped
+	s.tapped = nil
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	for _, t := range tapped {
+		s.opt.OnResult(t.edge, t.res)
+		if err := t.res.Release(context.TODO()); err != nil {
+			s.opt.Logger.Warnf("buildkit scheduler: failed to release result of %s: %v", t.edge.Vertex.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package solver
+
+import (
+	"time"
+
+	"github.com/moby/buildkit/util/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// traceDispatch starts the spans of a dispatch of e for TraceDispatches. The
+// parent span starts when the edge was queued and the child span when the
+// dispatch starts, so the gap between them is the time spent in the queue.
+// The returned function finishes both spans. Spans are only recorded if the
+// build that first requested e was started with a span in its context.
+func (s *scheduler) traceDispatch(e *edge, queued time.Time) func() {
+	now := s.opt.Clock.Now()
+	if queued.IsZero() {
+		queued = now
+	}
+	name := e.edge.Vertex.Name()
+	span, ctx := tracing.StartSpan(buildContext(e), "scheduler: "+name, opentracing.StartTime(queued))
+	span.SetTag(edgeIDField, e.id)
+	span.SetTag("queue.wait", now.Sub(queued).String())
+	child, _ := tracing.StartSpan(ctx, "dispatch: "+name, opentracing.StartTime(now))
+	return func() {
+		end := opentracing.FinishOptions{FinishTime: s.opt.Clock.Now()}
+		child.SetTag("state", e.state.String())
+		child.FinishWithOptions(end)
+		span.FinishWithOptions(end)
+	}
+}
@@ -0,0 +1,139 @@
+package solver
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStopping is returned for builds started after StopGracefully was called
+var ErrStopping = errors.Errorf("scheduler is stopping")
+
+// ErrDrained is returned for builds canceled by DrainOnly
+var ErrDrained = errors.Errorf("build canceled to drain another build")
+
+// ExportFunc exports the result of an edge to a cache backend
+type ExportFunc func(context.Context, Edge, CachedResult) error
+
+// drainedEdge is an edge that completed while the scheduler was stopping
+type drainedEdge struct {
+	edge *edge
+	res  CachedResult
+}
+
+// dependencyOrder sorts drained so that every edge comes after the edges of
+// its inputs. The order is a post-order walk of the vertex graphs of the
+// edges. Inputs that were merged are followed to the loaded edge they were
+// merged to. Called with mu held.
+func (s *scheduler) dependencyOrder(drained []drainedEdge) []drainedEdge {
+	byEdge := make(map[*edge]drainedEdge, len(drained))
+	for _, d := range drained {
+		byEdge[d.edge] = d
+	}
+
+	out := make([]drainedEdge, 0, len(drained))
+	visited := map[string]struct{}{}
+	var walk func(Edge, *edge)
+	walk = func(ee Edge, e *edge) {
+		k := EdgeKey(ee)
+		if _, ok := visited[k]; !ok {
+			visited[k] = struct{}{}
+			for _, inp := range ee.Vertex.Inputs() {
+				walk(inp, s.ef.lookupEdge(inp))
+			}
+		}
+		if e == nil {
+			return
+		}
+		if !EdgeEqual(e.edge, ee) {
+			// merged, the inputs of the target come first
+			walk(e.edge, e)
+		}
+		if d, ok := byEdge[e]; ok {
+			delete(byEdge, e)
+			out = append(out, d)
+		}
+	}
+	for _, d := range drained {
+		walk(d.edge.edge, d.edge)
+	}
+	return out
+}
+
+// DrainOnly cancels the running builds that don't have a matching label and
+// waits for the builds with the label to return. The canceled builds fail with
+// ErrDrained. Edges shared with a build that keeps running are not canceled.
+// Builds started after the call are not affected, so it is usually followed by
+// stopping the scheduler. If ctx is done before the builds return its error is
+// returned and the builds keep running. Returns the number of canceled builds.
+func (s *scheduler) DrainOnly(ctx context.Context, key, value string) (int, error) {
+	s.mu.Lock()
+	var keep []*activeBuild
+	n := 0
+	for b := range s.builds {
+		if v, ok := b.labels[key]; ok && v == value {
+			keep = append(keep, b)
+			continue
+		}
+		if b.cancelErr == nil {
+			s.cancelBuild(b, CancelReasonExplicit, ErrDrained)
+			n++
+		}
+	}
+	s.mu.Unlock()
+
+	for _, b := range keep {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			return n, errors.WithStack(ctx.Err())
+		}
+	}
+	return n, nil
+}
+
+// StopGracefully stops the scheduler after the running builds have returned.
+// New builds from jobs fail with ErrStopping. If ctx is done before the builds
+// return they are canceled with the error of ctx. The edges that completed
+// while the builds were drained are passed to export once all builds have
+// returned, dependencies before the edges depending on them, so that the cache
+// backend receives the work finished during shutdown. The first error returned
+// by export is returned after all edges were exported.
+func (s *scheduler) StopGracefully(ctx context.Context, export ExportFunc) error {
+	s.mu.Lock()
+	s.stopping = true
+	builds := make([]*activeBuild, 0, len(s.builds))
+	for b := range s.builds {
+		builds = append(builds, b)
+	}
+	s.mu.Unlock()
+
+	for _, b := range builds {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			s.CancelAll(ctx.Err())
+			<-b.done
+		}
+	}
+
+	s.mu.Lock()
+	drained := s.dependencyOrder(s.drained)
+	s.drained = nil
+	s.mu.Unlock()
+
+	var exportErr error
+	for _, d := range drained {
+		if export != nil {
+			// ctx only limits waiting for the builds, the work that finished is
+			// still exported
+			if err := export(context.TODO(), d.edge.edge, d.res); err != nil && exportErr == nil {
+				exportErr = errors.Wrapf(err, "failed to export %s", d.edge.edge.Vertex.Name())
+			}
+		}
+		d.res.Release(context.TODO())
+	}
+
+	s.Stop()
+	return exportErr
+}
@@ -2,6 +2,7 @@ package solver
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -40,6 +41,7 @@ func newEdge(ed Edge, op activeOp, index *edgeIndex) *edge {
 type edge struct {
 	edge Edge
 	op   activeOp
+	id   uint64 // sequence number assigned by the scheduler, see scheduler.nextEdgeID
 
 	edgeState
 	depRequests map[pipe.Receiver]*dep
@@ -50,6 +52,9 @@ type edge struct {
 	cacheMapIndex      int
 	cacheMapDigests    []digest.Digest
 	execReq            pipe.Receiver
+	condReq            pipe.Receiver // request for the condition edge
+	condCheckReq       pipe.Receiver // request evaluating the condition
+	condDone           bool          // condition passed or the edge was skipped
 	execCacheLoad      bool
 	err                error
 	cacheRecords       map[string]*CacheRecord
@@ -64,10 +69,39 @@ type edge struct {
 	hasActiveOutgoing         bool
 
 	releaserCount int
+	onRelease     func(Edge) // SchedulerOpt.OnEdgeCleanup
 	keysDidChange bool
 	index         *edgeIndex
+	admitted      bool
 
+	// number of times the edge was taken from the queue without dispatch
+	skippedDispatches int
+
+	// index key of the last merge that was refused, protected by scheduler.mu
+	refusedMergeKey *CacheKey
+
+	// results supplied by SchedulerOpt.InputResolver, released with the edge
+	resolvedInputs []*SharedCachedResult
+
+	lastDispatch     time.Time
+	dispatchInterval time.Duration // max minDispatchInterval of incoming
+	redispatchTimer  Timer
+
+	depth int // longest dependency chain from a build request
+
+	owner    *activeBuild // first build that requested the edge
+	charged  bool         // cost of the edge was added to owner
+	retained int64        // size of the result added to owner.retained
+
+	mergedCount int // number of edges merged into this edge
+
+	orphaned bool // reported to OnOrphaned since the last open incoming request
+
+	mu                 sync.Mutex // protects secondaryExporters
 	secondaryExporters []expDep
+
+	metaMu sync.Mutex // protects meta
+	meta   map[string]interface{}
 }
 
 // dep holds state for a dependant edge
@@ -81,6 +115,7 @@ type dep struct {
 	slowCacheFoundKey bool
 	slowCacheKey      *ExportableCacheKey
 	err               error
+	wait              time.Duration // time the requests to the dependency took
 }
 
 // expDep holds secorndary exporter info for dependency
@@ -89,6 +124,21 @@ type expDep struct {
 	cacheKey CacheKeyWithSelector
 }
 
+// addSecondaryExporter records an exporter of a merged edge
+func (e *edge) addSecondaryExporter(d expDep) {
+	e.mu.Lock()
+	e.secondaryExporters = append(e.secondaryExporters, d)
+	e.mu.Unlock()
+}
+
+// getSecondaryExporters returns a copy of the secondary exporters that can be
+// used while the edge is merged with other edges
+func (e *edge) getSecondaryExporters() []expDep {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]expDep(nil), e.secondaryExporters...)
+}
+
 func newDep(i Index) *dep {
 	return &dep{index: i, keyMap: map[string]*CacheKey{}}
 }
@@ -98,6 +148,10 @@ type edgePipe struct {
 	*pipe.Pipe
 	From, Target *edge
 	mu           sync.Mutex
+	waiting      int32     // set while a function request waits before it starts
+	pending      int32     // set while the result of a function request is counted for MaxPendingResults
+	finished     int32     // set when the function returned without an error, see KeepFinishedWorkOnMerge
+	created      time.Time // time the request was made
 }
 
 // edgeState hold basic mutable state info for an edge
@@ -112,6 +166,23 @@ type edgeRequest struct {
 	desiredState edgeStatusType
 	currentState edgeState
 	currentKeys  int
+	// minDispatchInterval is the minimum time between dispatches of the target
+	// edge. Used by requests that poll the target and don't need it to be
+	// processed again right away.
+	minDispatchInterval time.Duration
+	// drain is set when the request is canceled with WithCacheOnCancel
+	drain bool
+}
+
+// drainCanceled returns true if all incoming requests were canceled with
+// WithCacheOnCancel
+func drainCanceled(incoming []pipe.Sender) bool {
+	for _, req := range incoming {
+		if r := req.Request(); !r.Canceled || !r.Payload.(*edgeRequest).drain {
+			return false
+		}
+	}
+	return len(incoming) > 0
 }
 
 // incrementReferenceCount increases the number of times release needs to be
@@ -127,9 +198,16 @@ func (e *edge) release() {
 		return
 	}
 	e.index.Release(e)
+	e.clearMeta()
 	if e.result != nil {
 		go e.result.Release(context.TODO())
 	}
+	for _, res := range e.resolvedInputs {
+		go res.Release(context.TODO())
+	}
+	if e.onRelease != nil {
+		e.onRelease(e.edge)
+	}
 }
 
 // commitOptions returns parameters for the op execution
@@ -333,16 +411,25 @@ func (e *edge) unpark(incoming []pipe.Sender, updates, allPipes []pipe.Receiver,
 		e.recalcCurrentState()
 	}
 
-	desiredState, done := e.respondToIncoming(incoming, allPipes)
+	desiredState, done := e.respondToIncoming(incoming, allPipes, f)
 	if done {
 		return
 	}
 
+	// the condition needs to pass before anything else is evaluated
+	if !e.condDone {
+		if cond := e.edge.Vertex.Options().Condition; cond != nil {
+			e.createConditionRequests(cond, f)
+			return
+		}
+		e.condDone = true
+	}
+
 	cacheMapReq := false
 	// set up new outgoing requests if needed
 	if e.cacheMapReq == nil && (e.cacheMap == nil || len(e.cacheRecords) == 0) {
 		index := e.cacheMapIndex
-		e.cacheMapReq = f.NewFuncRequest(func(ctx context.Context) (interface{}, error) {
+		e.cacheMapReq = f.NewFuncRequest(FuncRequestCacheKey, func(ctx context.Context) (interface{}, error) {
 			cm, err := e.op.CacheMap(ctx, index)
 			return cm, errors.Wrap(err, "failed to load cache key")
 		})
@@ -358,8 +445,9 @@ func (e *edge) unpark(incoming []pipe.Sender, updates, allPipes []pipe.Receiver,
 
 	if e.execReq == nil {
 		if added := e.createInputRequests(desiredState, f, false); !added && !e.hasActiveOutgoing && !cacheMapReq {
-			logrus.Errorf("buildkit scheluding error: leaving incoming open. forcing solve. Please report this with BUILDKIT_SCHEDULER_DEBUG=1")
-			debugSchedulerPreUnpark(e, incoming, updates, allPipes)
+			f.s.edgeLogger(e).Errorf("buildkit scheluding error: leaving incoming open. forcing solve. Please report this with BUILDKIT_SCHEDULER_DEBUG=1")
+			f.s.reportError(e, SchedulerErrorInvariant, errors.New("buildkit scheduler error: leaving incoming open, forcing solve"))
+			debugSchedulerPreUnpark(f.s.edgeLogger(e), e, incoming, updates, allPipes)
 			e.createInputRequests(desiredState, f, true)
 		}
 	}
@@ -431,6 +519,32 @@ func (e *edge) processUpdate(upt pipe.Receiver) (depChanged bool) {
 		return true
 	}
 
+	// response for condition edge request
+	if upt == e.condReq {
+		if err := upt.Status().Err; upt.Status().Completed && err != nil {
+			e.condReq = nil
+			if !upt.Status().Canceled && e.err == nil {
+				e.err = err
+			}
+		}
+		return false
+	}
+
+	// response for condition evaluation
+	if upt == e.condCheckReq && upt.Status().Completed {
+		if err := upt.Status().Err; err != nil {
+			e.condCheckReq = nil
+			if !upt.Status().Canceled && e.err == nil {
+				e.err = err
+			}
+		} else if upt.Status().Value.(bool) {
+			e.condDone = true
+		} else {
+			e.skip()
+		}
+		return false
+	}
+
 	// response for exec request
 	if upt == e.execReq && upt.Status().Completed {
 		if err := upt.Status().Err; err != nil {
@@ -676,7 +790,7 @@ func (e *edge) recalcCurrentState() {
 
 // respondToIncoming responds to all incoming requests. completing or
 // updating them when possible
-func (e *edge) respondToIncoming(incoming []pipe.Sender, allPipes []pipe.Receiver) (edgeStatusType, bool) {
+func (e *edge) respondToIncoming(incoming []pipe.Sender, allPipes []pipe.Receiver, f *pipeFactory) (edgeStatusType, bool) {
 	// detect the result state for the requests
 	allIncomingCanComplete := true
 	desiredState := e.state
@@ -698,6 +812,10 @@ func (e *edge) respondToIncoming(incoming []pipe.Sender, allPipes []pipe.Receive
 		}
 	}
 
+	// requests canceled with WithCacheOnCancel let a running operation finish
+	// so that its result is saved to the cache
+	drain := !e.isComplete() && allCanceled && drainCanceled(incoming)
+
 	// do not set allIncomingCanComplete if active ongoing can modify the state
 	if !allCanceled && e.state < edgeStatusComplete && len(e.keys) == 0 && e.hasActiveOutgoing {
 		allIncomingCanComplete = false
@@ -710,6 +828,14 @@ func (e *edge) respondToIncoming(incoming []pipe.Sender, allPipes []pipe.Receive
 	if allIncomingCanComplete && e.hasActiveOutgoing {
 		// cancel all current requests
 		for _, p := range allPipes {
+			if drain {
+				if p == e.execReq && f.isRunning(p) {
+					continue
+				}
+				if r, ok := p.Request().(*edgeRequest); ok {
+					r.drain = true
+				}
+			}
 			p.Cancel()
 		}
 
@@ -771,7 +897,7 @@ func (e *edge) createInputRequests(desiredState edgeStatusType, f *pipeFactory,
 	for _, dep := range e.deps {
 		desiredStateDep := dep.state
 
-		if e.noCacheMatchPossible || force {
+		if e.noCacheMatchPossible || force || e.speculateInputs(desiredState, f) {
 			desiredStateDep = edgeStatusComplete
 		} else if dep.state == edgeStatusInitial && desiredState > dep.state {
 			desiredStateDep = edgeStatusCacheFast
@@ -822,7 +948,7 @@ func (e *edge) createInputRequests(desiredState edgeStatusType, f *pipeFactory,
 			fn := e.slowCacheFunc(dep)
 			res := dep.result
 			func(pfn PreprocessFunc, fn ResultBasedCacheFunc, res Result, index Index) {
-				dep.slowCacheReq = f.NewFuncRequest(func(ctx context.Context) (interface{}, error) {
+				dep.slowCacheReq = f.NewFuncRequest(FuncRequestCacheKey, func(ctx context.Context) (interface{}, error) {
 					v, err := e.op.CalcSlowCache(ctx, index, pfn, fn, res)
 					return v, errors.Wrap(err, "failed to compute cache key")
 				})
@@ -833,6 +959,47 @@ func (e *edge) createInputRequests(desiredState edgeStatusType, f *pipeFactory,
 	return addedNew
 }
 
+// speculateInputs returns true if the results of the dependencies should be
+// requested before the cache check of the edge has completed
+func (e *edge) speculateInputs(desiredState edgeStatusType, f *pipeFactory) bool {
+	return f.s.opt.SpeculativeInputs && desiredState == edgeStatusComplete && len(e.cacheRecords) == 0
+}
+
+// createConditionRequests requests the result of the condition edge and
+// evaluates the condition when the result is available
+func (e *edge) createConditionRequests(cond *Condition, f *pipeFactory) {
+	if e.condReq == nil {
+		e.condReq = f.NewInputRequest(cond.Edge, &edgeRequest{
+			desiredState: edgeStatusComplete,
+		})
+		return
+	}
+	if !e.condReq.Status().Completed || e.condCheckReq != nil {
+		return
+	}
+	state := e.condReq.Status().Value.(*edgeState)
+	if state.result == nil {
+		e.markFailed(f, errors.Errorf("no result for condition of %s", e.edge.Vertex.Name()))
+		return
+	}
+	res := state.result.CloneCachedResult()
+	check := cond.Check
+	e.condCheckReq = f.NewFuncRequest(FuncRequestCondition, func(ctx context.Context) (interface{}, error) {
+		defer res.Release(context.TODO())
+		ok, err := check(ctx, res)
+		return ok, errors.Wrap(err, "failed to evaluate condition")
+	})
+}
+
+// skip completes the edge with a skipped result. The result gets a cache key
+// based on the vertex so that dependants can still compute their cache keys.
+func (e *edge) skip() {
+	k := NewCacheKey(digest.FromBytes([]byte(fmt.Sprintf("%s-skipped", e.edge.Vertex.Digest()))), e.edge.Index)
+	e.result = NewSharedCachedResult(NewCachedResult(skippedResult{}, []ExportableCacheKey{{CacheKey: k, Exporter: &exporter{k: k}}}))
+	e.state = edgeStatusComplete
+	e.condDone = true
+}
+
 // execIfPossible creates a request for getting the edge result if there is
 // enough state
 func (e *edge) execIfPossible(f *pipeFactory) bool {
@@ -841,7 +1008,10 @@ func (e *edge) execIfPossible(f *pipeFactory) bool {
 			e.postpone(f)
 			return true
 		}
-		e.execReq = f.NewFuncRequest(e.loadCache)
+		validate := f.s.opt.ResultValidator
+		e.execReq = f.NewFuncRequest(FuncRequestCacheLoad, func(ctx context.Context) (interface{}, error) {
+			return e.loadCache(ctx, validate)
+		})
 		e.execCacheLoad = true
 		for req := range e.depRequests {
 			req.Cancel()
@@ -852,7 +1022,11 @@ func (e *edge) execIfPossible(f *pipeFactory) bool {
 			e.postpone(f)
 			return true
 		}
-		e.execReq = f.NewFuncRequest(e.execOp)
+		validate := f.s.opt.ResultValidator
+		process := f.s.opt.ResultProcessors[e.edge.Vertex.Options().Type]
+		e.execReq = f.NewFuncRequest(FuncRequestExec, withExecTimeout(e.edge.Vertex, func(ctx context.Context) (interface{}, error) {
+			return e.execOp(ctx, process, validate)
+		}))
 		e.execCacheLoad = false
 		return true
 	}
@@ -861,13 +1035,33 @@ func (e *edge) execIfPossible(f *pipeFactory) bool {
 
 // postpone delays exec to next unpark invocation if we have unprocessed keys
 func (e *edge) postpone(f *pipeFactory) {
-	f.NewFuncRequest(func(context.Context) (interface{}, error) {
+	f.NewFuncRequest(FuncRequestOther, func(context.Context) (interface{}, error) {
 		return nil, nil
 	})
 }
 
+// ownedRequests returns the outgoing requests that processUpdate handles the
+// updates of. Requests created by postpone are not tracked.
+func (e *edge) ownedRequests() map[pipe.Receiver]struct{} {
+	m := map[pipe.Receiver]struct{}{}
+	for _, r := range []pipe.Receiver{e.cacheMapReq, e.condReq, e.condCheckReq, e.execReq} {
+		if r != nil {
+			m[r] = struct{}{}
+		}
+	}
+	for r := range e.depRequests {
+		m[r] = struct{}{}
+	}
+	for _, dep := range e.deps {
+		if dep.slowCacheReq != nil {
+			m[dep.slowCacheReq] = struct{}{}
+		}
+	}
+	return m
+}
+
 // loadCache creates a request to load edge result from cache
-func (e *edge) loadCache(ctx context.Context) (interface{}, error) {
+func (e *edge) loadCache(ctx context.Context, validate func(Edge, CachedResult) error) (interface{}, error) {
 	recs := make([]*CacheRecord, 0, len(e.cacheRecords))
 	for _, r := range e.cacheRecords {
 		recs = append(recs, r)
@@ -883,11 +1077,18 @@ func (e *edge) loadCache(ctx context.Context) (interface{}, error) {
 		return nil, errors.Wrap(err, "failed to load cache")
 	}
 
-	return NewCachedResult(res, []ExportableCacheKey{{CacheKey: rec.key, Exporter: &exporter{k: rec.key, record: rec, edge: e}}}), nil
+	cres := NewCachedResult(res, []ExportableCacheKey{{CacheKey: rec.key, Exporter: &exporter{k: rec.key, record: rec, edge: e}}})
+	if validate != nil {
+		if err := validate(e.edge, cres); err != nil {
+			go res.Release(context.TODO())
+			return nil, errors.Wrap(err, "invalid cached result")
+		}
+	}
+	return cres, nil
 }
 
 // execOp creates a request to execute the vertex operation
-func (e *edge) execOp(ctx context.Context) (interface{}, error) {
+func (e *edge) execOp(ctx context.Context, process ResultProcessor, validate func(Edge, CachedResult) error) (interface{}, error) {
 	cacheKeys, inputs := e.commitOptions()
 	results, subExporters, err := e.op.Exec(ctx, toResultSlice(inputs))
 	if err != nil {
@@ -907,6 +1108,21 @@ func (e *edge) execOp(ctx context.Context) (interface{}, error) {
 		}
 	}
 
+	if process != nil {
+		res, err = process(ctx, e.edge, res)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to process result")
+		}
+	}
+
+	// validate before the result is saved to the cache
+	if validate != nil {
+		if err := validate(e.edge, NewCachedResult(res, nil)); err != nil {
+			go res.Release(context.TODO())
+			return nil, errors.Wrap(err, "invalid result")
+		}
+	}
+
 	var exporters []CacheExporter
 
 	for _, cacheKey := range cacheKeys {
@@ -0,0 +1,81 @@
+package solver
+
+import "github.com/pkg/errors"
+
+// SetEdgeMeta stores value for key on a loaded edge. The metadata is kept
+// until the edge is released and can be read back with EdgeMeta. Callbacks
+// that are called with the scheduler locked can't call EdgeMeta, they get the
+// metadata in CompletionEvent.Meta instead. Metadata of an edge that is merged
+// is copied to the edge it was merged to, without replacing keys that are
+// already set there.
+func (s *scheduler) SetEdgeMeta(edge Edge, key string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil {
+		return errors.Errorf("edge %s is not loaded", edge.Vertex.Name())
+	}
+	e.metaMu.Lock()
+	defer e.metaMu.Unlock()
+	if e.meta == nil {
+		e.meta = map[string]interface{}{}
+	}
+	e.meta[key] = value
+	return nil
+}
+
+// EdgeMeta returns the value stored for key on the edge with SetEdgeMeta.
+// Edges that are not loaded have no metadata.
+func (s *scheduler) EdgeMeta(edge Edge, key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil {
+		return nil, false
+	}
+	e.metaMu.Lock()
+	defer e.metaMu.Unlock()
+	v, ok := e.meta[key]
+	return v, ok
+}
+
+// copyMeta returns a copy of the metadata of e, nil if there is none
+func (e *edge) copyMeta() map[string]interface{} {
+	e.metaMu.Lock()
+	defer e.metaMu.Unlock()
+	if len(e.meta) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(e.meta))
+	for k, v := range e.meta {
+		m[k] = v
+	}
+	return m
+}
+
+func (e *edge) clearMeta() {
+	e.metaMu.Lock()
+	e.meta = nil
+	e.metaMu.Unlock()
+}
+
+// mergeMeta copies the metadata of src that is not set on e
+func (e *edge) mergeMeta(src *edge) {
+	src.metaMu.Lock()
+	defer src.metaMu.Unlock()
+	if len(src.meta) == 0 {
+		return
+	}
+	e.metaMu.Lock()
+	defer e.metaMu.Unlock()
+	if e.meta == nil {
+		e.meta = map[string]interface{}{}
+	}
+	for k, v := range src.meta {
+		if _, ok := e.meta[k]; !ok {
+			e.meta[k] = v
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package solver
+
+import (
+	"sort"
+	"sync"
+)
+
+// states of a function request that hasn't started yet
+const (
+	waitingOnConcurrency int32 = 1 // waits for SchedulerOpt.Concurrency
+	waitingOnLock        int32 = 2 // waits for VertexOptions.ExclusiveLocks
+	waitingOnReceivers   int32 = 3 // waits for SchedulerOpt.MaxPendingResults
+)
+
+// exclusiveLocks serializes the asynchronous requests of edges that declare
+// the same names in VertexOptions.ExclusiveLocks
+type exclusiveLocks struct {
+	mu    sync.Mutex
+	locks map[string]*exclusiveLock
+}
+
+type exclusiveLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func newExclusiveLocks() *exclusiveLocks {
+	return &exclusiveLocks{locks: map[string]*exclusiveLock{}}
+}
+
+// acquire blocks until all the locks are held. Names need to be sorted so that
+// requests acquiring multiple locks can't deadlock.
+func (l *exclusiveLocks) acquire(names []string) (release func()) {
+	held := make([]*exclusiveLock, 0, len(names))
+	for _, name := range names {
+		l.mu.Lock()
+		lock, ok := l.locks[name]
+		if !ok {
+			lock = &exclusiveLock{ch: make(chan struct{}, 1)}
+			l.locks[name] = lock
+		}
+		lock.refs++
+		l.mu.Unlock()
+
+		lock.ch <- struct{}{}
+		held = append(held, lock)
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i].ch
+			l.mu.Lock()
+			held[i].refs--
+			if held[i].refs == 0 {
+				delete(l.locks, names[i])
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// exclusiveLockNames returns the sorted unique lock names of an edge
+func exclusiveLockNames(e *edge) []string {
+	names := e.edge.Vertex.Options().ExclusiveLocks
+	if len(names) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(names))
+	seen := map[string]struct{}{}
+	for _, n := range names {
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
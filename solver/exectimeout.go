@@ -0,0 +1,30 @@
+package solver
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrExecTimeout is returned when the operation of a vertex doesn't finish
+// within VertexOptions.ExecTimeout
+var ErrExecTimeout = errors.Errorf("operation timed out")
+
+// withExecTimeout limits the time f executing the operation of v can run to
+// VertexOptions.ExecTimeout. The context of f is canceled when the timeout
+// expires and the request fails with ErrExecTimeout naming the vertex.
+func withExecTimeout(v Vertex, f func(context.Context) (interface{}, error)) func(context.Context) (interface{}, error) {
+	timeout := v.Options().ExecTimeout
+	if timeout <= 0 {
+		return f
+	}
+	return func(ctx context.Context) (interface{}, error) {
+		execCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		res, err := f(execCtx)
+		if err != nil && ctx.Err() == nil && errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return nil, errors.Wrapf(ErrExecTimeout, "%s did not finish within %s: %v", v.Name(), timeout, err)
+		}
+		return res, err
+	}
+}
@@ -143,7 +143,7 @@ func (e *exporter) ExportTo(ctx context.Context, t CacheExporterTarget, opt Cach
 	}
 
 	if e.edge != nil {
-		for _, de := range e.edge.secondaryExporters {
+		for _, de := range e.edge.getSecondaryExporters() {
 			recs, err := de.cacheKey.CacheKey.Exporter.ExportTo(ctx, t, opt)
 			if err != nil {
 				return nil, nil
@@ -0,0 +1,64 @@
+package solver
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// FuncRequestKind is the kind of work an asynchronous request of an edge does
+type FuncRequestKind int
+
+const (
+	// FuncRequestCacheKey computes a cache key, either the cache map of the
+	// operation or a cache key based on the result of a dependency
+	FuncRequestCacheKey FuncRequestKind = iota
+	// FuncRequestExec executes the operation
+	FuncRequestExec
+	// FuncRequestCacheLoad loads the result of the edge from the cache
+	FuncRequestCacheLoad
+	// FuncRequestCondition evaluates the condition of the edge
+	FuncRequestCondition
+	// FuncRequestOther doesn't do any work on its own, like the requests
+	// delaying exec until updated cache keys are processed
+	FuncRequestOther
+
+	numFuncRequestKinds
+)
+
+func (k FuncRequestKind) String() string {
+	switch k {
+	case FuncRequestCacheKey:
+		return "cache-key"
+	case FuncRequestExec:
+		return "exec"
+	case FuncRequestCacheLoad:
+		return "cache-load"
+	case FuncRequestCondition:
+		return "condition"
+	case FuncRequestOther:
+		return "other"
+	}
+	return "unknown"
+}
+
+// withFuncKind wraps the function of an asynchronous request so that it is
+// counted as running a request of kind k while it executes
+func (s *scheduler) withFuncKind(k FuncRequestKind, f func(context.Context) (interface{}, error)) func(context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt64(&s.runningFuncs[k], 1)
+		defer atomic.AddInt64(&s.runningFuncs[k], -1)
+		return f(ctx)
+	}
+}
+
+// runningFuncRequests returns the number of running asynchronous requests of
+// each kind. Kinds without running requests are omitted.
+func (s *scheduler) runningFuncRequests() map[FuncRequestKind]int {
+	m := map[FuncRequestKind]int{}
+	for k := FuncRequestKind(0); k < numFuncRequestKinds; k++ {
+		if n := atomic.LoadInt64(&s.runningFuncs[k]); n > 0 {
+			m[k] = int(n)
+		}
+	}
+	return m
+}
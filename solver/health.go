@@ -0,0 +1,31 @@
+package solver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// beat records that the loop is making progress
+func (s *scheduler) beat() {
+	atomic.StoreInt64(&s.heartbeat, s.opt.Clock.Now().UnixNano())
+}
+
+// IsHealthy returns false if edges are queued but the loop hasn't taken an
+// edge from the queue for longer than maxStale, or if the scheduler has been
+// stopped. An idle loop with an empty queue or a paused loop is healthy no
+// matter how long ago it last ran, and an idle loop is only counted as stale
+// from the time an edge is queued to it. It doesn't lock the scheduler so it
+// can be used to detect a loop that is stuck while holding the lock.
+func (s *scheduler) IsHealthy(maxStale time.Duration) bool {
+	if s.isStopped() {
+		return false
+	}
+	s.muQ.Lock()
+	queued := len(s.waitq)
+	s.muQ.Unlock()
+	if queued == 0 || s.isPaused() {
+		return true
+	}
+	last := time.Unix(0, atomic.LoadInt64(&s.heartbeat))
+	return s.opt.Clock.Now().Sub(last) <= maxStale
+}
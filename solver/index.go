@@ -7,6 +7,12 @@ import (
 )
 
 // edgeIndex is a synchronous map for detecting edge collisions.
+//
+// The index tracks the edges that are loaded in the current process. It can
+// be pre-warmed from a persisted IndexSnapshot with
+// SchedulerOpt.IndexSnapshot. Restored keys have no edges, but the results
+// recorded for them can complete new edges with the same keys, see
+// SchedulerOpt.IndexResultLoader.
 type edgeIndex struct {
 	mu sync.Mutex
 
@@ -18,6 +24,8 @@ type indexItem struct {
 	edge  *edge
 	links map[CacheInfoLink]map[string]struct{}
 	deps  map[string]struct{}
+
+	restored *IndexedEdge // edge of the key in a restored snapshot
 }
 
 func newEdgeIndex() *edgeIndex {
@@ -37,6 +45,56 @@ func (ei *edgeIndex) Release(e *edge) {
 	delete(ei.backRefs, e)
 }
 
+// Replace moves the entries of old to e. Used when old is merged to an edge
+// that is not in the index yet.
+func (ei *edgeIndex) Replace(old, e *edge) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	ids, ok := ei.backRefs[old]
+	if !ok {
+		return
+	}
+	backRefs, ok := ei.backRefs[e]
+	if !ok {
+		backRefs = map[string]struct{}{}
+		ei.backRefs[e] = backRefs
+	}
+	for id := range ids {
+		if item, ok := ei.items[id]; ok && item.edge == old {
+			item.edge = e
+		}
+		backRefs[id] = struct{}{}
+	}
+	delete(ei.backRefs, old)
+}
+
+// Len returns the number of entries in the index
+func (ei *edgeIndex) Len() int {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	return len(ei.items)
+}
+
+// Prune releases the edges for which remove returns true and returns the
+// number of entries that were removed
+func (ei *edgeIndex) Prune(remove func(*edge) bool) int {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	n := len(ei.items)
+	for e, ids := range ei.backRefs {
+		if !remove(e) {
+			continue
+		}
+		for id := range ids {
+			ei.releaseEdge(id, e)
+		}
+		delete(ei.backRefs, e)
+	}
+	return n - len(ei.items)
+}
+
 func (ei *edgeIndex) releaseEdge(id string, e *edge) {
 	item, ok := ei.items[id]
 	if !ok {
@@ -237,6 +295,16 @@ func (ei *edgeIndex) getAllMatches(k *CacheKey) []string {
 	return out
 }
 
+func isNonShareable(e *edge) bool {
+	if e.owner != nil && e.owner.nonShareable {
+		return true
+	}
+	if e.edge.Vertex == nil {
+		return false
+	}
+	return e.edge.Vertex.Options().NonShareable
+}
+
 func isIgnoreCache(e *edge) bool {
 	if e.edge.Vertex == nil {
 		return false
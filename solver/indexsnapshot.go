@@ -0,0 +1,226 @@
+package solver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// IndexSnapshot is a serializable copy of the index used for merging edges
+// with matching cache keys. Entries are sorted by ID and the lists in them are
+// sorted, so snapshots of the same index serialize to the same output.
+type IndexSnapshot struct {
+	Entries []IndexEntry `json:"entries"`
+}
+
+// IndexEntry is a cache key in the merge index. Root keys are identified by
+// the digest and output of their cache map, other keys by a digest of the
+// links to them from their dependency keys. The IDs only depend on the keys,
+// so the same keys get the same IDs in every snapshot and process.
+type IndexEntry struct {
+	ID string `json:"id"`
+	// Edge is the edge stored for the key, nil if the key is only used as a
+	// dependency of other keys
+	Edge *IndexedEdge `json:"edge,omitempty"`
+	// Links are the keys using this key as a dependency
+	Links []IndexLink `json:"links,omitempty"`
+	// Deps are the IDs of the dependency keys of this key
+	Deps []string `json:"deps,omitempty"`
+}
+
+// IndexedEdge identifies the edge stored for a key in the merge index
+type IndexedEdge struct {
+	Digest digest.Digest `json:"digest"`
+	Index  Index         `json:"index"`
+	Name   string        `json:"name,omitempty"`
+	// ResultID is the ID of the result of the edge if it has completed
+	ResultID string `json:"resultID,omitempty"`
+}
+
+// IndexLink connects a dependency key with the keys that use it. Edges whose
+// keys share a link with the same targets were merged.
+type IndexLink struct {
+	CacheInfoLink
+	Targets []string `json:"targets"`
+}
+
+// Snapshot returns a serializable copy of the index. Reading the results of
+// the edges requires the scheduler lock to be held.
+func (ei *edgeIndex) Snapshot() *IndexSnapshot {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	cid := ei.contentIDs()
+	snap := &IndexSnapshot{Entries: make([]IndexEntry, 0, len(ei.items))}
+	for id, item := range ei.items {
+		ent := IndexEntry{ID: cid(id), Edge: item.restored}
+		if e := item.edge; e != nil {
+			ent.Edge = &IndexedEdge{Digest: e.edge.Vertex.Digest(), Index: e.edge.Index, Name: e.edge.Vertex.Name()}
+			if e.result != nil {
+				ent.Edge.ResultID = e.result.ID()
+			}
+		}
+		for l, targets := range item.links {
+			il := IndexLink{CacheInfoLink: l, Targets: make([]string, 0, len(targets))}
+			for t := range targets {
+				il.Targets = append(il.Targets, cid(t))
+			}
+			sort.Strings(il.Targets)
+			ent.Links = append(ent.Links, il)
+		}
+		sort.Slice(ent.Links, func(i, j int) bool {
+			a, b := ent.Links[i], ent.Links[j]
+			if a.Digest != b.Digest {
+				return a.Digest < b.Digest
+			}
+			if a.Input != b.Input {
+				return a.Input < b.Input
+			}
+			if a.Output != b.Output {
+				return a.Output < b.Output
+			}
+			return a.Selector < b.Selector
+		})
+		for d := range item.deps {
+			ent.Deps = append(ent.Deps, cid(d))
+		}
+		sort.Strings(ent.Deps)
+		snap.Entries = append(snap.Entries, ent)
+	}
+	sort.Slice(snap.Entries, func(i, j int) bool {
+		return snap.Entries[i].ID < snap.Entries[j].ID
+	})
+	return snap
+}
+
+// contentIDs returns a function mapping the IDs of the index to IDs derived
+// from the keys. Keys without links to them, like root keys, keep their ID.
+// Other keys get a digest of the links to them together with the content IDs
+// of the keys the links come from. Called with ei.mu held.
+func (ei *edgeIndex) contentIDs() func(string) string {
+	type ref struct {
+		link CacheInfoLink
+		from string
+	}
+	refs := map[string][]ref{}
+	for id, item := range ei.items {
+		for l, targets := range item.links {
+			for t := range targets {
+				refs[t] = append(refs[t], ref{l, id})
+			}
+		}
+	}
+
+	ids := map[string]string{}
+	var cid func(string) string
+	cid = func(id string) string {
+		if v, ok := ids[id]; ok {
+			return v
+		}
+		if len(refs[id]) == 0 {
+			ids[id] = id
+			return id
+		}
+		ids[id] = id // dependency keys can't link back, guards against bad input
+		parts := make([]string, 0, len(refs[id]))
+		for _, r := range refs[id] {
+			parts = append(parts, fmt.Sprintf("%d:%s:%d:%s:%s", r.link.Input, r.link.Digest, r.link.Output, r.link.Selector, cid(r.from)))
+		}
+		sort.Strings(parts)
+		v := digest.FromString(strings.Join(parts, ",")).String()
+		ids[id] = v
+		return v
+	}
+	return cid
+}
+
+// Restore loads the entries of a snapshot into an empty index. Restored keys
+// have no edges, the edges recorded in the snapshot are kept for Restored and
+// for later snapshots. New edges with a restored key are stored under it.
+func (ei *edgeIndex) Restore(snap *IndexSnapshot) error {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	if len(ei.items) > 0 {
+		return errors.Errorf("can't restore snapshot into index with %d entries", len(ei.items))
+	}
+	for _, ent := range snap.Entries {
+		item := &indexItem{
+			links:    map[CacheInfoLink]map[string]struct{}{},
+			deps:     map[string]struct{}{},
+			restored: ent.Edge,
+		}
+		for _, l := range ent.Links {
+			targets := map[string]struct{}{}
+			for _, t := range l.Targets {
+				targets[t] = struct{}{}
+			}
+			item.links[l.CacheInfoLink] = targets
+		}
+		for _, d := range ent.Deps {
+			item.deps[d] = struct{}{}
+		}
+		ei.items[ent.ID] = item
+	}
+	return nil
+}
+
+// Restored returns the edge recorded for k in a restored snapshot, nil if k
+// doesn't match a restored entry
+func (ei *edgeIndex) Restored(k *CacheKey) *IndexedEdge {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	for _, id := range ei.getAllMatches(k) {
+		if item, ok := ei.items[id]; ok && item.restored != nil {
+			return item.restored
+		}
+	}
+	return nil
+}
+
+// IndexSnapshot returns a serializable copy of the merge index
+func (s *scheduler) IndexSnapshot() *IndexSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ei := s.ef.mergeIndex(); ei != nil {
+		return ei.Snapshot()
+	}
+	return &IndexSnapshot{}
+}
+
+// RestoreIndex loads an index snapshot into the empty merge index
+func (s *scheduler) RestoreIndex(snap *IndexSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ei := s.ef.mergeIndex()
+	if ei == nil {
+		return errors.Errorf("scheduler has no merge index")
+	}
+	return ei.Restore(snap)
+}
+
+// loadRestoredResult completes e with the result recorded for its index key k
+// in SchedulerOpt.IndexSnapshot. Called with the scheduler locked.
+func (s *scheduler) loadRestoredResult(e *edge, k *CacheKey) {
+	if s.opt.IndexResultLoader == nil || e.isComplete() || e.execReq != nil || isIgnoreCache(e) {
+		return
+	}
+	ie := e.index.Restored(k)
+	if ie == nil || ie.ResultID == "" {
+		return
+	}
+	res, ok := s.opt.IndexResultLoader(*ie)
+	if !ok || res == nil {
+		return
+	}
+	s.edgeLogger(e).Debugf("completing edge %s with restored result %s", e.edge.Vertex.Name(), ie.ResultID)
+	e.result = NewSharedCachedResult(NewCachedResult(res, []ExportableCacheKey{{CacheKey: k, Exporter: &exporter{k: k}}}))
+	e.state = edgeStatusComplete
+	s.signal(e)
+}
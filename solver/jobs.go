@@ -3,6 +3,7 @@ package solver
 import (
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -62,9 +63,10 @@ type state struct {
 	opts  SolverOpt
 	index *edgeIndex
 
-	cache     map[string]CacheManager
-	mainCache CacheManager
-	solver    *Solver
+	cache      map[string]CacheManager
+	cacheOrder []string // lookup preference of cache, see addCache
+	mainCache  CacheManager
+	solver     *Solver
 }
 
 func (s *state) SessionIterator() session.Iterator {
@@ -147,11 +149,30 @@ func (s *state) getEdge(index Index) *edge {
 		s.op = newSharedOp(s.opts.ResolveOpFunc, s.opts.DefaultCache, s)
 	}
 
+	sch := s.solver.s
+	if !sch.reserveEdge() {
+		return nil
+	}
 	e := newEdge(Edge{Index: index, Vertex: s.vtx}, s.op, s.index)
+	e.id = sch.nextEdgeID()
+	cleanup := sch.opt.OnEdgeCleanup
+	e.onRelease = func(ed Edge) {
+		sch.unloadEdge()
+		if cleanup != nil {
+			cleanup(ed)
+		}
+	}
 	s.edges[index] = e
 	return e
 }
 
+// lookupEdge returns the edge for index if it is loaded, without creating it
+func (s *state) lookupEdge(index Index) *edge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.edges[index]
+}
+
 func (s *state) setEdge(index Index, newEdge *edge) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -167,12 +188,41 @@ func (s *state) setEdge(index Index, newEdge *edge) {
 	s.edges[index] = newEdge
 }
 
+// addCache adds a cache source for the vertex. Sources are looked up in the
+// order they were added, after the main cache. Sources with an ID that is
+// already known are ignored. Called with s.mu held.
+func (s *state) addCache(cm CacheManager) {
+	if _, ok := s.cache[cm.ID()]; ok {
+		return
+	}
+	s.cache[cm.ID()] = cm
+	s.cacheOrder = append(s.cacheOrder, cm.ID())
+}
+
+// addCacheSources adds the cache sources of src after the current sources
+func (s *state) addCacheSources(src *state) {
+	src.mu.Lock()
+	cms := make([]CacheManager, 0, len(src.cacheOrder))
+	for _, id := range src.cacheOrder {
+		cms = append(cms, src.cache[id])
+	}
+	src.mu.Unlock()
+
+	s.mu.Lock()
+	for _, cm := range cms {
+		if cm.ID() != s.mainCache.ID() {
+			s.addCache(cm)
+		}
+	}
+	s.mu.Unlock()
+}
+
 func (s *state) combinedCacheManager() CacheManager {
 	s.mu.Lock()
 	cms := make([]CacheManager, 0, len(s.cache)+1)
 	cms = append(cms, s.mainCache)
-	for _, cm := range s.cache {
-		cms = append(cms, cm)
+	for _, id := range s.cacheOrder {
+		cms = append(cms, s.cache[id])
 	}
 	s.mu.Unlock()
 
@@ -237,8 +287,9 @@ type Job struct {
 }
 
 type SolverOpt struct {
-	ResolveOpFunc ResolveOpFunc
-	DefaultCache  CacheManager
+	ResolveOpFunc    ResolveOpFunc
+	DefaultCache     CacheManager
+	SchedulerOptions []SchedulerOption
 }
 
 func NewSolver(opts SolverOpt) *Solver {
@@ -251,7 +302,12 @@ func NewSolver(opts SolverOpt) *Solver {
 		opts:    opts,
 		index:   newEdgeIndex(),
 	}
-	jl.s = newScheduler(jl)
+	jl.s = newScheduler(jl, opts.SchedulerOptions...)
+	if snap := jl.s.opt.IndexSnapshot; snap != nil {
+		if err := jl.index.Restore(snap); err != nil {
+			jl.s.opt.Logger.Warnf("failed to pre-warm merge index: %v", err)
+		}
+	}
 	jl.updateCond = sync.NewCond(jl.mu.RLocker())
 	return jl
 }
@@ -260,7 +316,7 @@ func (jl *Solver) setEdge(e Edge, newEdge *edge) {
 	jl.mu.RLock()
 	defer jl.mu.RUnlock()
 
-	st, ok := jl.actives[e.Vertex.Digest()]
+	st, ok := jl.actives[jl.stateDigest(e.Vertex)]
 	if !ok {
 		return
 	}
@@ -272,7 +328,7 @@ func (jl *Solver) getState(e Edge) *state {
 	jl.mu.RLock()
 	defer jl.mu.RUnlock()
 
-	st, ok := jl.actives[e.Vertex.Digest()]
+	st, ok := jl.actives[jl.stateDigest(e.Vertex)]
 	if !ok {
 		return nil
 	}
@@ -283,13 +339,68 @@ func (jl *Solver) getEdge(e Edge) *edge {
 	jl.mu.RLock()
 	defer jl.mu.RUnlock()
 
-	st, ok := jl.actives[e.Vertex.Digest()]
+	st, ok := jl.actives[jl.stateDigest(e.Vertex)]
 	if !ok {
 		return nil
 	}
 	return st.getEdge(e.Index)
 }
 
+func (jl *Solver) lookupEdge(e Edge) *edge {
+	jl.mu.RLock()
+	defer jl.mu.RUnlock()
+
+	st, ok := jl.actives[jl.stateDigest(e.Vertex)]
+	if !ok {
+		return nil
+	}
+	return st.lookupEdge(e.Index)
+}
+
+// releaseEdge drops e from the vertex states holding it. The edge is not
+// released if an incomplete edge still depends on its result. Called with the
+// scheduler lock held.
+func (jl *Solver) releaseEdge(e *edge) bool {
+	jl.mu.RLock()
+	defer jl.mu.RUnlock()
+
+	for _, st := range jl.actives {
+		st.mu.Lock()
+		for _, ed := range st.edges {
+			if ed == e || ed.isComplete() {
+				continue
+			}
+			for _, d := range ed.deps {
+				if d.result != nil && d.result == e.result {
+					st.mu.Unlock()
+					return false
+				}
+			}
+		}
+		st.mu.Unlock()
+	}
+
+	for _, st := range jl.actives {
+		st.mu.Lock()
+		for i, ed := range st.edges {
+			if ed == e {
+				delete(st.edges, i)
+				e.release()
+			}
+		}
+		st.mu.Unlock()
+	}
+	return true
+}
+
+func (jl *Solver) pruneIndex(remove func(*edge) bool) int {
+	return jl.index.Prune(remove)
+}
+
+func (jl *Solver) mergeIndex() *edgeIndex {
+	return jl.index
+}
+
 func (jl *Solver) subBuild(ctx context.Context, e Edge, parent Vertex) (CachedResult, error) {
 	v, err := jl.load(e.Vertex, parent, nil)
 	if err != nil {
@@ -303,6 +414,165 @@ func (jl *Solver) Close() {
 	jl.s.Stop()
 }
 
+// StopGracefully closes the solver after the running builds have returned and
+// passes the edges that completed in the meantime to export, dependencies
+// first. If ctx is done before the builds return they are canceled.
+func (jl *Solver) StopGracefully(ctx context.Context, export ExportFunc) error {
+	return jl.s.StopGracefully(ctx, export)
+}
+
+// CancelByLabel cancels all running builds with a matching label. Builds are
+// labeled by passing a context created with WithBuildLabels to Build.
+func (jl *Solver) CancelByLabel(key, value string) int {
+	return jl.s.CancelByLabel(key, value)
+}
+
+// DrainOnly cancels all running builds except the ones with a matching label
+// and waits for those to return
+func (jl *Solver) DrainOnly(ctx context.Context, key, value string) (int, error) {
+	return jl.s.DrainOnly(ctx, key, value)
+}
+
+// AbortEdge fails an edge that hasn't completed yet with ErrEdgeAborted
+func (jl *Solver) AbortEdge(e Edge) bool {
+	return jl.s.AbortEdge(e)
+}
+
+// CompletedEdges returns the completed edges of the graph of e, dependencies
+// first
+func (jl *Solver) CompletedEdges(e Edge) []Edge {
+	return jl.s.CompletedEdges(e)
+}
+
+// EdgeInfo returns the merge state of an edge
+func (jl *Solver) EdgeInfo(e Edge) *EdgeInfo {
+	return jl.s.EdgeInfo(jl.loadedEdge(e))
+}
+
+// DesiredState returns the state the scheduler is currently driving an edge
+// toward
+func (jl *Solver) DesiredState(e Edge) EdgeState {
+	return jl.s.DesiredState(e)
+}
+
+// IsHealthy returns false if the scheduler loop has not made progress for
+// longer than maxStale while edges are queued
+func (jl *Solver) IsHealthy(maxStale time.Duration) bool {
+	return jl.s.IsHealthy(maxStale)
+}
+
+// Pause stops the scheduler from dispatching edges until Resume is called
+func (jl *Solver) Pause() {
+	jl.s.Pause()
+}
+
+// Resume continues dispatching edges after Pause
+func (jl *Solver) Resume() {
+	jl.s.Resume()
+}
+
+// PendingMerges returns the edges waiting to be checked for a merge
+func (jl *Solver) PendingMerges() []MergeInfo {
+	return jl.s.PendingMerges()
+}
+
+// BuildStatus sends snapshots of the progress of a running build returned by
+// ActiveBuilds every interval
+func (jl *Solver) BuildStatus(ctx context.Context, req BuildRequest, interval time.Duration) <-chan BuildStatusUpdate {
+	return jl.s.BuildStatus(ctx, req, interval)
+}
+
+// SetEdgeMeta stores value for key on a loaded edge until it is released
+func (jl *Solver) SetEdgeMeta(e Edge, key string, value interface{}) error {
+	return jl.s.SetEdgeMeta(e, key, value)
+}
+
+// EdgeMeta returns the value stored for key on the edge with SetEdgeMeta
+func (jl *Solver) EdgeMeta(e Edge, key string) (interface{}, bool) {
+	return jl.s.EdgeMeta(e, key)
+}
+
+// EstimatedRemaining returns the number of completed and discovered edges of
+// the running builds matching req
+func (jl *Solver) EstimatedRemaining(req BuildRequest) (completed, total int) {
+	return jl.s.EstimatedRemaining(req)
+}
+
+// SetPriority changes the priority of a running build returned by
+// ActiveBuilds
+func (jl *Solver) SetPriority(req BuildRequest, prio int) int {
+	return jl.s.SetPriority(req, prio)
+}
+
+// CancelAll cancels all running builds with err without closing the solver
+func (jl *Solver) CancelAll(err error) int {
+	return jl.s.CancelAll(err)
+}
+
+// WhyBlocked returns a human-readable reason why an edge has not completed yet
+func (jl *Solver) WhyBlocked(e Edge) string {
+	return jl.s.WhyBlocked(e)
+}
+
+// DependencyReport returns the resolved state of the dependencies of a
+// completed edge
+func (jl *Solver) DependencyReport(e Edge) []DepResult {
+	return jl.s.DependencyReport(e)
+}
+
+// ActiveBuilds returns the top-level build requests that are currently running
+func (jl *Solver) ActiveBuilds() []BuildRequest {
+	return jl.s.ActiveBuilds()
+}
+
+// Stats returns the current statistics of the solver
+func (jl *Solver) Stats() Stats {
+	st := jl.s.Stats()
+	st.IndexEntries = jl.index.Len()
+	return st
+}
+
+// SchedulerErrors returns the channel receiving the internal errors of the
+// scheduler with SchedulerOpt.CollectErrors
+func (jl *Solver) SchedulerErrors() <-chan SchedulerError {
+	return jl.s.SchedulerErrors()
+}
+
+// Snapshot returns a consistent view of the scheduler state
+func (jl *Solver) Snapshot() *Snapshot {
+	snap := jl.s.Snapshot()
+	snap.Stats.IndexEntries = jl.index.Len()
+	return snap
+}
+
+// PruneIndex removes the edges that are complete and have no open requests
+// from the index used for merging edges with matching cache keys and returns
+// the number of removed entries. Later edges with the same cache keys are not
+// merged to the pruned edges anymore, they load their results from the cache
+// instead. This keeps the index from growing in a long running solver that
+// builds many distinct graphs.
+func (jl *Solver) PruneIndex() int {
+	return jl.s.pruneIndex()
+}
+
+// IndexSnapshot returns a serializable copy of the index used for merging
+// edges, for analyzing which cache keys were deduplicated
+func (jl *Solver) IndexSnapshot() *IndexSnapshot {
+	return jl.s.IndexSnapshot()
+}
+
+// RestoreIndex loads a snapshot from IndexSnapshot into the index of a solver
+// that hasn't indexed any edges yet
+func (jl *Solver) RestoreIndex(snap *IndexSnapshot) error {
+	return jl.s.RestoreIndex(snap)
+}
+
+// WriteMetrics writes the statistics of the solver to w in the OpenMetrics
+// text format
+func (jl *Solver) WriteMetrics(w io.Writer) error {
+	return jl.s.writeMetrics(w, jl.Stats())
+}
+
 func (jl *Solver) load(v, parent Vertex, j *Job) (Vertex, error) {
 	jl.mu.Lock()
 	defer jl.mu.Unlock()
@@ -327,9 +597,21 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 		inputs[i] = Edge{Index: e.Index, Vertex: v}
 	}
 
+	var condition *Condition
+	if c := v.Options().Condition; c != nil {
+		cv, err := jl.loadUnlocked(c.Edge.Vertex, parent, j, cache)
+		if err != nil {
+			return nil, err
+		}
+		condition = &Condition{Edge: Edge{Index: c.Edge.Index, Vertex: cv}, Check: c.Check}
+	}
+
 	dgst := v.Digest()
+	if condition != nil {
+		dgst = conditionDigest(dgst, condition.Edge.Vertex.Digest(), condition.Edge.Index)
+	}
 
-	dgstWithoutCache := digest.FromBytes([]byte(fmt.Sprintf("%s-ignorecache", dgst)))
+	dgstWithoutCache := ignoreCacheDigest(dgst)
 
 	// if same vertex is already loaded without cache just use that
 	st, ok := jl.actives[dgstWithoutCache]
@@ -343,9 +625,10 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 		}
 
 		v = &vertexWithCacheOptions{
-			Vertex: v,
-			dgst:   dgst,
-			inputs: inputs,
+			Vertex:    v,
+			dgst:      dgst,
+			inputs:    inputs,
+			condition: condition,
 		}
 
 		st, ok = jl.actives[dgst]
@@ -376,9 +659,7 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 	st.mu.Lock()
 	for _, cache := range v.Options().CacheSources {
 		if cache.ID() != st.mainCache.ID() {
-			if _, ok := st.cache[cache.ID()]; !ok {
-				st.cache[cache.ID()] = cache
-			}
+			st.addCache(cache)
 		}
 	}
 
@@ -398,9 +679,7 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 			}
 			parentState.childVtx[dgst] = struct{}{}
 
-			for id, c := range parentState.cache {
-				st.cache[id] = c
-			}
+			st.addCacheSources(parentState)
 		}
 	}
 
@@ -409,6 +688,49 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 	return v, nil
 }
 
+// stateDigest returns the digest the state of v is stored under. Loaded
+// vertexes carry it, for the vertexes of callers it is derived the same way
+// loadUnlocked derives it. Called with jl.mu held.
+func (jl *Solver) stateDigest(v Vertex) digest.Digest {
+	if v, ok := v.(*vertexWithCacheOptions); ok {
+		return v.dgst
+	}
+	dgst := v.Digest()
+	if c := v.Options().Condition; c != nil {
+		dgst = conditionDigest(dgst, jl.stateDigest(c.Edge.Vertex), c.Edge.Index)
+	}
+	// a vertex loaded without cache takes over the digest
+	if d := ignoreCacheDigest(dgst); jl.actives[d] != nil {
+		return d
+	}
+	return dgst
+}
+
+// ignoreCacheDigest returns the digest of the state of a vertex that ignores
+// the cache and is loaded while the same vertex with cache is already active
+func ignoreCacheDigest(dgst digest.Digest) digest.Digest {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s-ignorecache", dgst)))
+}
+
+// loadedEdge returns e with the loaded vertex of its state, whose digest is
+// the one the edges of the state have. Returns e if it is not loaded.
+func (jl *Solver) loadedEdge(e Edge) Edge {
+	jl.mu.RLock()
+	defer jl.mu.RUnlock()
+
+	if st, ok := jl.actives[jl.stateDigest(e.Vertex)]; ok {
+		return Edge{Index: e.Index, Vertex: st.vtx}
+	}
+	return e
+}
+
+// conditionDigest returns the digest of the state of a vertex with a
+// condition. The condition is not part of the vertex digest but the same
+// vertex with different conditions can't share its state.
+func conditionDigest(dgst, cond digest.Digest, index Index) digest.Digest {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s-condition-%s-%d", dgst, cond, index)))
+}
+
 func (jl *Solver) connectProgressFromState(target, src *state) {
 	for j := range src.jobs {
 		if _, ok := target.allPw[j.pw]; !ok {
@@ -492,16 +814,116 @@ func (jl *Solver) deleteIfUnreferenced(k digest.Digest, st *state) {
 }
 
 func (j *Job) Build(ctx context.Context, e Edge) (CachedResult, error) {
+	res, _, err := j.BuildWithCacheKey(ctx, e)
+	return res, err
+}
+
+// BuildWithCacheKey builds the edge and also returns the cache key that the
+// scheduler computed for the result of the edge. This key can be used for
+// exporting the cache chain of the build.
+func (j *Job) BuildWithCacheKey(ctx context.Context, e Edge) (CachedResult, ExportableCacheKey, error) {
+	return j.build(ctx, e, false)
+}
+
+// BuildNoClone builds the edge and returns the result the solver holds for it
+// instead of a clone of it. The result is only valid while the job is active
+// and may not be released or modified by the caller. This avoids the cost of
+// cloning the result for callers that only read it. It should not be used
+// together with SchedulerOpt.MaxRetainedResults that can release the result.
+func (j *Job) BuildNoClone(ctx context.Context, e Edge) (CachedResult, error) {
+	res, _, err := j.build(ctx, e, true)
+	return res, err
+}
+
+func (j *Job) build(ctx context.Context, e Edge, noClone bool) (CachedResult, ExportableCacheKey, error) {
 	if span := opentracing.SpanFromContext(ctx); span != nil {
 		j.span = span
 	}
 
+	req := &BuildRequest{JobID: j.id, Edge: e, Labels: buildLabels(ctx)}
+
+	v, err := j.list.load(e.Vertex, nil, j)
+	if err != nil {
+		return nil, ExportableCacheKey{}, err
+	}
+	e.Vertex = v
+	return j.list.s.buildWithCacheKey(ctx, e, buildOpt{request: req, noClone: noClone})
+}
+
+// ResolveCacheKeys computes the cache keys of the edge without executing its
+// operation or loading its result from the cache. Operations of dependencies
+// run only if a content based cache key needs their result. Keys of edges that
+// completed are the keys of their results.
+func (j *Job) ResolveCacheKeys(ctx context.Context, e Edge) ([]ExportableCacheKey, error) {
 	v, err := j.list.load(e.Vertex, nil, j)
 	if err != nil {
 		return nil, err
 	}
 	e.Vertex = v
-	return j.list.s.build(ctx, e)
+	return j.list.s.resolveCacheKeys(ctx, e)
+}
+
+// WaitForState drives the edge to state and waits until the state has been
+// reached without returning the result of the edge
+func (j *Job) WaitForState(ctx context.Context, e Edge, state EdgeState) error {
+	v, err := j.list.load(e.Vertex, nil, j)
+	if err != nil {
+		return err
+	}
+	e.Vertex = v
+	return j.list.s.WaitForState(ctx, e, state)
+}
+
+// Resume replays a build request taken from ActiveBuilds of another solver
+func (j *Job) Resume(ctx context.Context, req BuildRequest) (CachedResult, error) {
+	if len(req.Labels) > 0 {
+		ctx = WithBuildLabels(ctx, req.Labels)
+	}
+	return j.Build(ctx, req.Edge)
+}
+
+// InjectResult completes the edge with res instead of building it. This is an
+// advanced feature meant for seeding known results and for tests: the solver
+// trusts res to be the result of the edge and doesn't compute the cache key of
+// the edge or run its operation. Dependants use the cache keys of res to
+// compute their own cache keys. The edge is loaded for the job and the solver
+// takes ownership of res if no error is returned. Edges that are complete or
+// have started loading their result return an error.
+func (j *Job) InjectResult(e Edge, res CachedResult) error {
+	v, err := j.list.load(e.Vertex, nil, j)
+	if err != nil {
+		return err
+	}
+	e.Vertex = v
+	return j.list.s.injectResult(e, res)
+}
+
+// BuildSerialized builds the edge and returns its result serialized with
+// SchedulerOpt.ResultSerializer, so that it can be injected into a solver of
+// another process with InjectSerializedResult. The result itself is released
+// once it has been serialized.
+func (j *Job) BuildSerialized(ctx context.Context, e Edge) (*SerializedResult, error) {
+	res, err := j.Build(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Release(context.TODO())
+	return j.list.s.serializeResult(ctx, res)
+}
+
+// InjectSerializedResult deserializes sr with SchedulerOpt.ResultSerializer
+// and completes the edge with it like InjectResult. The deserialized result is
+// released if it can't be injected.
+func (j *Job) InjectSerializedResult(ctx context.Context, e Edge, sr *SerializedResult) error {
+	res, err := j.list.s.deserializeResult(ctx, sr)
+	if err != nil {
+		return err
+	}
+	if err := j.InjectResult(e, res); err != nil {
+		res.Release(context.TODO())
+		return err
+	}
+	return nil
 }
 
 func (j *Job) Discard() error {
@@ -595,6 +1017,12 @@ type sharedOp struct {
 	execRes *execRes
 	execErr error
 
+	// execMu guards execCalls and released. An exec call abandoned by
+	// FuncRequestTTL may still be running when the op is released.
+	execMu    sync.Mutex
+	execCalls int
+	released  bool
+
 	cacheRes  []*CacheMap
 	cacheDone bool
 	cacheErr  error
@@ -604,8 +1032,23 @@ type sharedOp struct {
 	slowCacheErr map[Index]error
 }
 
+// mergeCacheSources adds the cache sources of the src op to the target op when
+// the edge of src is merged into the edge of target. The sources of target keep
+// their position so lookups continue to prefer them.
+func mergeCacheSources(target, src activeOp) {
+	t, ok := target.(*sharedOp)
+	if !ok {
+		return
+	}
+	s, ok := src.(*sharedOp)
+	if !ok || t.st == s.st {
+		return
+	}
+	t.st.addCacheSources(s.st)
+}
+
 func (s *sharedOp) IgnoreCache() bool {
-	return s.st.vtx.Options().IgnoreCache
+	return s.st.vtx.Options().IgnoreCache || s.st.solver.s.replayExec(s.st.vtx.Digest())
 }
 
 func (s *sharedOp) Cache() CacheManager {
@@ -760,12 +1203,18 @@ func (s *sharedOp) Exec(ctx context.Context, inputs []Result) (outputs []Result,
 		return nil, nil, err
 	}
 	res, err := s.g.Do(ctx, "exec", func(ctx context.Context) (ret interface{}, retErr error) {
+		if !s.startExec() {
+			return nil, errors.Errorf("exec of released op %s", s.st.vtx.Name())
+		}
+		defer s.finishExec()
+
 		if s.execRes != nil || s.execErr != nil {
 			return s.execRes, s.execErr
 		}
 
 		ctx = opentracing.ContextWithSpan(progress.WithProgress(ctx, s.st.mpw), s.st.mspan)
 		ctx = withAncestorCacheOpts(ctx, s.st)
+		ctx = withResourceLimits(ctx, s.st.vtx.Options().ResourceLimits)
 
 		// no cache hit. start evaluating the node
 		span, ctx := tracing.StartSpan(ctx, s.st.vtx.Name())
@@ -821,7 +1270,40 @@ func (s *sharedOp) getOp() (Op, error) {
 	return s.op, nil
 }
 
+// startExec records a running exec call. It returns false if the op has
+// already been released.
+func (s *sharedOp) startExec() bool {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	if s.released {
+		return false
+	}
+	s.execCalls++
+	return true
+}
+
+// finishExec records the end of an exec call and releases the results if the
+// op was released while the call was running.
+func (s *sharedOp) finishExec() {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	s.execCalls--
+	if s.released && s.execCalls == 0 {
+		s.releaseExecRes()
+	}
+}
+
 func (s *sharedOp) release() {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	s.released = true
+	// running exec calls release the results when they return
+	if s.execCalls == 0 {
+		s.releaseExecRes()
+	}
+}
+
+func (s *sharedOp) releaseExecRes() {
 	if s.execRes != nil {
 		for _, r := range s.execRes.execRes {
 			go r.Release(context.TODO())
@@ -859,8 +1341,17 @@ func unwrapShared(inp []*SharedResult) []Result {
 
 type vertexWithCacheOptions struct {
 	Vertex
-	inputs []Edge
-	dgst   digest.Digest
+	inputs    []Edge
+	dgst      digest.Digest
+	condition *Condition
+}
+
+func (v *vertexWithCacheOptions) Options() VertexOptions {
+	opts := v.Vertex.Options()
+	if v.condition != nil {
+		opts.Condition = v.condition
+	}
+	return opts
 }
 
 func (v *vertexWithCacheOptions) Digest() digest.Digest {
@@ -0,0 +1,54 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRequestIDField = "request"
+	edgeIDField           = "edge"
+)
+
+// nextEdgeID returns the ID for a new edge. IDs are compact sequence numbers
+// that identify an edge in the events and logs of a scheduler, starting from
+// 1 for every scheduler.
+func (s *scheduler) nextEdgeID() uint64 {
+	return atomic.AddUint64(&s.edgeIDs, 1)
+}
+
+// requestID returns the request ID stored in ctx for SchedulerOpt.RequestIDKey
+func (s *scheduler) requestID(ctx context.Context) string {
+	if s.opt.RequestIDKey == nil {
+		return ""
+	}
+	v := ctx.Value(s.opt.RequestIDKey)
+	if v == nil {
+		return ""
+	}
+	if id, ok := v.(string); ok {
+		return id
+	}
+	return fmt.Sprint(v)
+}
+
+// buildLogger returns the logger for the messages of build b
+func (s *scheduler) buildLogger(b *activeBuild) logrus.FieldLogger {
+	if b == nil || b.requestID == "" {
+		return s.opt.Logger
+	}
+	return s.opt.Logger.WithField(s.opt.RequestIDField, b.requestID)
+}
+
+// edgeLogger returns the logger for the messages of edge e. Edges are logged
+// with their ID and the request ID of the build that first requested them.
+func (s *scheduler) edgeLogger(e *edge) logrus.FieldLogger {
+	l := s.buildLogger(e.owner)
+	if e.id == 0 {
+		return l
+	}
+	return l.WithField(edgeIDField, e.id)
+}
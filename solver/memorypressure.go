@@ -0,0 +1,120 @@
+package solver
+
+import "github.com/pkg/errors"
+
+// ErrMemoryPressure is returned for builds that were canceled to free memory
+// after SchedulerOpt.MemoryPressure fired
+var ErrMemoryPressure = errors.Errorf("build canceled due to memory pressure")
+
+// ReclaimStep is a way of reclaiming memory under memory pressure
+type ReclaimStep int
+
+const (
+	// ReclaimPruneIndex removes the complete edges from the index for merging
+	// edges, like Solver.PruneIndex
+	ReclaimPruneIndex ReclaimStep = iota
+	// ReclaimRetainedResults releases the results of the completed edges that
+	// are not used anymore. Only results tracked for
+	// SchedulerOpt.MaxRetainedResults are released.
+	ReclaimRetainedResults
+	// ReclaimCancelBuilds cancels the builds chosen by
+	// SchedulerOpt.MemoryPressureSelector with ErrMemoryPressure
+	ReclaimCancelBuilds
+)
+
+var defaultMemoryPressureSteps = []ReclaimStep{ReclaimCancelBuilds}
+
+// BuildUsage is the memory retained by a running build
+type BuildUsage struct {
+	Build  *BuildRequest
+	Labels map[string]string
+	// RetainedSize is the total size of the results of the completed edges
+	// first requested by the build, as reported by SchedulerOpt.ResultSize.
+	// Results released by the scheduler are not counted.
+	RetainedSize int64
+
+	b *activeBuild
+}
+
+// largestBuild selects the build retaining the most memory. Nothing is
+// selected if no build retains any measured results.
+func largestBuild(builds []BuildUsage) []BuildUsage {
+	var max *BuildUsage
+	for i, b := range builds {
+		if b.RetainedSize > 0 && (max == nil || b.RetainedSize > max.RetainedSize) {
+			max = &builds[i]
+		}
+	}
+	if max == nil {
+		return nil
+	}
+	return []BuildUsage{*max}
+}
+
+// watchMemoryPressure sheds builds every time the memory pressure signal fires
+func (s *scheduler) watchMemoryPressure(signal <-chan struct{}) {
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case _, ok := <-signal:
+			if !ok {
+				return
+			}
+			s.reclaimMemory()
+		}
+	}
+}
+
+// reclaimMemory runs the memory pressure steps until one of them reclaims
+// anything
+func (s *scheduler) reclaimMemory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	steps := s.opt.MemoryPressureSteps
+	if len(steps) == 0 {
+		steps = defaultMemoryPressureSteps
+	}
+	for _, step := range steps {
+		var n int
+		switch step {
+		case ReclaimPruneIndex:
+			n = s.pruneIndexLocked()
+		case ReclaimRetainedResults:
+			n = s.releaseRetained()
+		case ReclaimCancelBuilds:
+			n = s.shedBuilds()
+		}
+		if n > 0 {
+			return
+		}
+	}
+}
+
+// shedBuilds cancels the builds chosen by the memory pressure selector and
+// returns the number of canceled builds. Called with s.mu held.
+func (s *scheduler) shedBuilds() int {
+	usage := make([]BuildUsage, 0, len(s.builds))
+	for b := range s.builds {
+		if b.cancelErr != nil {
+			continue
+		}
+		usage = append(usage, BuildUsage{Build: b.request, Labels: b.labels, RetainedSize: b.retained, b: b})
+	}
+	selector := s.opt.MemoryPressureSelector
+	if selector == nil {
+		selector = largestBuild
+	}
+	n := 0
+	for _, u := range selector(usage) {
+		b := u.b
+		if _, ok := s.builds[b]; !ok || b.cancelErr != nil {
+			continue
+		}
+		s.buildLogger(b).Warnf("canceling build of %s due to memory pressure, retained %d bytes", b.edge.edge.Vertex.Name(), b.retained)
+		s.cancelBuild(b, CancelReasonMemoryPressure, ErrMemoryPressure)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,97 @@
+package solver
+
+import "sync/atomic"
+
+// deferMerge queues an edge whose keys have changed for the merge loop
+func (s *scheduler) deferMerge(e *edge) {
+	if _, ok := s.mergesQueued[e]; ok {
+		return
+	}
+	s.mergesQueued[e] = struct{}{}
+	s.merges = append(s.merges, e)
+	select {
+	case s.mergeSignal <- struct{}{}:
+	default:
+	}
+}
+
+// mergeLoop merges the queued edges in batches of SchedulerOpt.DeferredMerges
+func (s *scheduler) mergeLoop() {
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-s.mergeSignal:
+		}
+		for s.mergeBatch() {
+		}
+	}
+}
+
+// mergeBatch merges the next batch of queued edges. Returns true if more edges
+// are queued.
+func (s *scheduler) mergeBatch() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.opt.DeferredMerges
+	if n > len(s.merges) {
+		n = len(s.merges)
+	}
+	batch := s.merges[:n]
+	s.merges = append([]*edge(nil), s.merges[n:]...)
+	for _, e := range batch {
+		delete(s.mergesQueued, e)
+		// edge was merged, released or completed while it was queued
+		if e.isComplete() || s.ef.lookupEdge(e.edge) != e {
+			s.releaseMergeHold(e)
+			continue
+		}
+		s.tryMerge(e)
+		s.releaseMergeHold(e)
+	}
+	return len(s.merges) > 0
+}
+
+// holdForMerge returns true if the dispatch of e has to wait for the merge
+// loop because of HoldPendingMerges
+func (s *scheduler) holdForMerge(e *edge) bool {
+	if !s.opt.HoldPendingMerges || s.mergesQueued == nil {
+		return false
+	}
+	if _, ok := s.mergesQueued[e]; !ok {
+		return false
+	}
+	s.mergesHeld[e] = struct{}{}
+	return true
+}
+
+// releaseMergeHold dispatches e again if it was held for HoldPendingMerges.
+// Edges that were merged are not dispatched as their requests moved to the
+// target.
+func (s *scheduler) releaseMergeHold(e *edge) {
+	if _, ok := s.mergesHeld[e]; !ok {
+		return
+	}
+	delete(s.mergesHeld, e)
+	if s.ef.lookupEdge(e.edge) == e {
+		s.signal(e)
+	}
+}
+
+// adoptFinishedExec makes the finished operation of src the operation of
+// target for SchedulerOpt.KeepFinishedWorkOnMerge. Returns false if the
+// request needs to be canceled. Called with the scheduler locked.
+func (s *scheduler) adoptFinishedExec(target, src *edge, out *edgePipe) bool {
+	if !s.opt.KeepFinishedWorkOnMerge || out.Receiver != src.execReq || atomic.LoadInt32(&out.finished) == 0 {
+		return false
+	}
+	if target.execReq != nil || target.isComplete() {
+		return false
+	}
+	s.edgeLogger(src).Debugf("keeping finished operation of edge %s for %s", src.edge.Vertex.Name(), target.edge.Vertex.Name())
+	target.execReq = out.Receiver
+	target.execCacheLoad = src.execCacheLoad
+	src.execReq = nil
+	return true
+}
@@ -0,0 +1,110 @@
+package solver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const metricsPrefix = "buildkit_scheduler_"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metric families in the OpenMetrics text format
+type metricsWriter struct {
+	w      *bufio.Writer
+	labels string
+}
+
+func newMetricsWriter(w io.Writer, name string) *metricsWriter {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	if name != "" {
+		mw.labels = fmt.Sprintf(`scheduler="%s"`, labelEscaper.Replace(name))
+	}
+	return mw
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# TYPE %s%s %s\n", metricsPrefix, name, typ)
+	fmt.Fprintf(mw.w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+}
+
+// sample writes a sample of the current family. labels are pairs of label
+// names and values.
+func (mw *metricsWriter) sample(name string, v float64, labels ...string) {
+	l := mw.labels
+	for i := 0; i+1 < len(labels); i += 2 {
+		if l != "" {
+			l += ","
+		}
+		l += fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if l != "" {
+		l = "{" + l + "}"
+	}
+	fmt.Fprintf(mw.w, "%s%s%s %v\n", metricsPrefix, name, l, v)
+}
+
+func (mw *metricsWriter) gauge(name, help string, v float64) {
+	mw.family(name, "gauge", help)
+	mw.sample(name, v)
+}
+
+func (mw *metricsWriter) counter(name, help string, v float64) {
+	mw.family(name, "counter", help)
+	mw.sample(name+"_total", v)
+}
+
+func (mw *metricsWriter) close() error {
+	fmt.Fprint(mw.w, "# EOF\n")
+	return mw.w.Flush()
+}
+
+// WriteMetrics writes the statistics of the scheduler to w in the OpenMetrics
+// text format, labeled with SchedulerOpt.Name if it is set. The cache hit
+// ratio is calculated over SchedulerOpt.StatsWindow.
+func (s *scheduler) WriteMetrics(w io.Writer) error {
+	return s.writeMetrics(w, s.Stats())
+}
+
+func (s *scheduler) writeMetrics(w io.Writer, st Stats) error {
+	mw := newMetricsWriter(w, s.opt.Name)
+
+	var waiting float64
+	if st.LoopWaiting {
+		waiting = 1
+	}
+
+	mw.gauge("queue_length", "Number of edges waiting for dispatch.", float64(st.QueueLength))
+	mw.gauge("loop_waiting", "Whether the scheduler loop is idle.", waiting)
+	mw.gauge("utilization", "Fraction of the concurrency limit used by running requests.", st.Utilization)
+	mw.gauge("func_requests_waiting", "Number of asynchronous requests waiting to start.", float64(st.FuncRequestsWaiting))
+	mw.counter("dispatches", "Number of dispatched edges.", float64(st.Dispatch.Dispatches))
+
+	mw.family("dispatch_seconds", "counter", "Time spent in the phases of dispatching edges.")
+	for _, p := range []struct {
+		phase string
+		d     time.Duration
+	}{
+		{"collect", st.Dispatch.Collect},
+		{"receive", st.Dispatch.Receive},
+		{"unpark", st.Dispatch.Unpark},
+		{"filter", st.Dispatch.Filter},
+		{"merge", st.Dispatch.Merge},
+	} {
+		mw.sample("dispatch_seconds_total", p.d.Seconds(), "phase", p.phase)
+	}
+
+	mw.counter("merged_edges", "Number of edges merged to an edge with a matching cache key.", float64(st.MergedEdges))
+
+	mw.family("completed_edges", "counter", "Number of completed edges by how their result was computed.")
+	mw.sample("completed_edges_total", float64(st.CachedEdges), "result", "cached")
+	mw.sample("completed_edges_total", float64(st.ExecutedEdges), "result", "executed")
+
+	mw.gauge("index_entries", "Number of entries in the index for merging edges.", float64(st.IndexEntries))
+	mw.gauge("cache_hit_ratio", "Ratio of edges completed from the cache in the statistics window.", st.CacheHitRatio(s.opt.StatsWindow))
+
+	return mw.close()
+}
@@ -0,0 +1,21 @@
+package solver
+
+import "github.com/moby/buildkit/solver/internal/pipe"
+
+// checkOrphaned reports e to SchedulerOpt.OnOrphaned if it has active
+// outgoing requests but no open incoming requests
+func (s *scheduler) checkOrphaned(e *edge, incoming []pipe.Sender) {
+	for _, req := range incoming {
+		if !req.Request().Canceled && !req.Status().Completed {
+			e.orphaned = false
+			return
+		}
+	}
+	if e.orphaned || !e.hasActiveOutgoing || e.isComplete() {
+		return
+	}
+	e.orphaned = true
+	if s.opt.OnOrphaned != nil {
+		s.opt.OnOrphaned(e.edge)
+	}
+}
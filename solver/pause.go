@@ -0,0 +1,54 @@
+package solver
+
+import "sync/atomic"
+
+// Pause stops the loop from dispatching edges until Resume is called. Edges
+// are still queued while the scheduler is paused, so builds started in the
+// meantime wait in the queue and continue after Resume. Requests that are
+// already running are not interrupted. It can be used to coordinate with
+// maintenance, like replacing the cache backend, without stopping the
+// scheduler.
+func (s *scheduler) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resume == nil {
+		s.resume = make(chan struct{})
+		atomic.StoreInt32(&s.paused, 1)
+	}
+}
+
+// Resume continues dispatching edges after Pause. It does nothing if the
+// scheduler is not paused.
+func (s *scheduler) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resume != nil {
+		atomic.StoreInt32(&s.paused, 0)
+		close(s.resume)
+		s.resume = nil
+	}
+}
+
+// isPaused returns true if Pause has been called without a matching Resume
+func (s *scheduler) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// waitResumed blocks the loop until the scheduler is resumed or stopped. It is
+// called with mu held and releases it while waiting. Returns false if the
+// scheduler is not paused.
+func (s *scheduler) waitResumed() bool {
+	ch := s.resume
+	if ch == nil {
+		return false
+	}
+	s.pausedWaiting = true
+	s.mu.Unlock()
+	select {
+	case <-ch:
+	case <-s.stopped:
+	}
+	s.mu.Lock()
+	s.pausedWaiting = false
+	return true
+}
@@ -0,0 +1,59 @@
+package solver
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pendingResults counts the asynchronous requests that completed but whose
+// results have not been received by their edges yet. Only completed requests
+// are counted so that running operations starting nested builds can't
+// deadlock on the limit.
+type pendingResults struct {
+	mu       sync.Mutex
+	n, max   int
+	released chan struct{} // closed and replaced when a result is received
+}
+
+func newPendingResults(max int) *pendingResults {
+	return &pendingResults{max: max, released: make(chan struct{})}
+}
+
+// wait blocks until the number of pending results is below the limit. It
+// returns false if canceled is closed first.
+func (pr *pendingResults) wait(canceled <-chan struct{}) bool {
+	for {
+		pr.mu.Lock()
+		if pr.n < pr.max {
+			pr.mu.Unlock()
+			return true
+		}
+		released := pr.released
+		pr.mu.Unlock()
+		select {
+		case <-released:
+		case <-canceled:
+			return false
+		}
+	}
+}
+
+// add counts the result of p until it is received
+func (pr *pendingResults) add(p *edgePipe) {
+	pr.mu.Lock()
+	pr.n++
+	pr.mu.Unlock()
+	atomic.StoreInt32(&p.pending, 1)
+}
+
+// done is called when the completion of p was received
+func (pr *pendingResults) done(p *edgePipe) {
+	if !atomic.CompareAndSwapInt32(&p.pending, 1, 0) {
+		return
+	}
+	pr.mu.Lock()
+	pr.n--
+	close(pr.released)
+	pr.released = make(chan struct{})
+	pr.mu.Unlock()
+}
@@ -0,0 +1,92 @@
+package solver
+
+// PipeEventType is the type of a PipeEvent
+type PipeEventType string
+
+const (
+	// PipeEventRequest is sent when an edge or a build makes a new request to
+	// an edge
+	PipeEventRequest PipeEventType = "request"
+	// PipeEventResponse is sent when the requesting edge receives an update or
+	// the final response for its request
+	PipeEventResponse PipeEventType = "response"
+)
+
+// PipeEvent is a request between two edges or a response received for it
+type PipeEvent struct {
+	Type PipeEventType
+	// From is the requesting edge. It is nil for the requests of builds.
+	From   *Edge
+	Target Edge
+	// FromID and TargetID are the IDs the scheduler assigned to the edges.
+	// FromID is zero for the requests of builds.
+	FromID   uint64
+	TargetID uint64
+	// DesiredState is the state requested from the target edge
+	DesiredState string
+	// State is the state of the target edge in the response
+	State string
+	// Keys is the number of cache keys of the target edge in the response
+	Keys      int
+	Completed bool
+	Canceled  bool
+	Err       error
+}
+
+// tracePipe returns true if the requests of the pipe need to be traced
+func (s *scheduler) tracePipe(p *edgePipe) bool {
+	if s.opt.PipeTracer == nil || p.Target == nil {
+		return false
+	}
+	if s.opt.TracePipes == nil {
+		return true
+	}
+	return s.opt.TracePipes(p.Target.edge) || (p.From != nil && s.opt.TracePipes(p.From.edge))
+}
+
+func (s *scheduler) traceRequest(p *edgePipe) {
+	if !s.tracePipe(p) {
+		return
+	}
+	ev := PipeEvent{
+		Type:     PipeEventRequest,
+		Target:   p.Target.edge,
+		TargetID: p.Target.id,
+	}
+	if p.From != nil {
+		from := p.From.edge
+		ev.From = &from
+		ev.FromID = p.From.id
+	}
+	if req, ok := p.Sender.Request().Payload.(*edgeRequest); ok {
+		ev.DesiredState = req.desiredState.String()
+		ev.Keys = req.currentKeys
+	}
+	s.opt.PipeTracer(ev)
+}
+
+func (s *scheduler) traceResponse(p *edgePipe) {
+	if !s.tracePipe(p) {
+		return
+	}
+	from := p.From.edge
+	status := p.Receiver.Status()
+	ev := PipeEvent{
+		Type:      PipeEventResponse,
+		From:      &from,
+		Target:    p.Target.edge,
+		FromID:    p.From.id,
+		TargetID:  p.Target.id,
+		Completed: status.Completed,
+		Canceled:  status.Canceled,
+		Err:       status.Err,
+	}
+	if req, ok := p.Receiver.Request().(*edgeRequest); ok {
+		ev.DesiredState = req.desiredState.String()
+	}
+	if st, ok := status.Value.(*edgeState); ok && st != nil {
+		ev.State = st.state.String()
+		ev.Keys = len(st.keys)
+	}
+	s.opt.PipeTracer(ev)
+}
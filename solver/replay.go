@@ -0,0 +1,101 @@
+package solver
+
+import (
+	"math"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// replayState is the trace the scheduler replays for SchedulerOpt.Replay
+type replayState struct {
+	// vertexes and executed are not modified after the scheduler is created
+	vertexes map[traceKey]*VertexTrace
+	executed map[digest.Digest]struct{} // vertexes with an edge that was executed
+
+	dispatched map[traceKey]struct{} // protected by scheduler.mu
+}
+
+func newReplayState(t *BuildTrace) *replayState {
+	rs := &replayState{
+		vertexes:   make(map[traceKey]*VertexTrace, len(t.Vertexes)),
+		executed:   map[digest.Digest]struct{}{},
+		dispatched: map[traceKey]struct{}{},
+	}
+	for i := range t.Vertexes {
+		vt := &t.Vertexes[i]
+		rs.vertexes[traceKey{dgst: vt.Digest, index: vt.Index}] = vt
+		if vt.Completed && !vt.Cached {
+			rs.executed[vt.Digest] = struct{}{}
+		}
+	}
+	return rs
+}
+
+func replayKey(e *edge) traceKey {
+	return traceKey{dgst: e.edge.Vertex.Digest(), index: e.edge.Index}
+}
+
+// order returns the position of the first dispatch of e in the trace. Edges
+// that have been dispatched before or are not in the trace return -1 so they
+// don't hold back the recorded order.
+func (rs *replayState) order(e *edge) int {
+	k := replayKey(e)
+	if _, ok := rs.dispatched[k]; ok {
+		return -1
+	}
+	vt, ok := rs.vertexes[k]
+	if !ok {
+		return -1
+	}
+	return vt.Order
+}
+
+// replayNext returns the queued edge that comes first in the replayed trace,
+// together with the element before it in the queue
+func (s *scheduler) replayNext() (prev, next *dispatcher) {
+	var p *dispatcher
+	min := math.MaxInt32
+	for l := s.next; l != nil; p, l = l, l.next {
+		o := s.replay.order(l.e)
+		if o < 0 {
+			return p, l
+		}
+		if o < min {
+			prev, next, min = p, l, o
+		}
+	}
+	return prev, next
+}
+
+// replayDispatched marks the first dispatch of e for the replayed trace
+func (s *scheduler) replayDispatched(e *edge) {
+	if s.replay != nil {
+		s.replay.dispatched[replayKey(e)] = struct{}{}
+	}
+}
+
+// replayExec returns true if the vertex was executed in the replayed trace and
+// must not be loaded from the cache
+func (s *scheduler) replayExec(dgst digest.Digest) bool {
+	if s.replay == nil {
+		return false
+	}
+	_, ok := s.replay.executed[dgst]
+	return ok
+}
+
+// checkReplay logs a warning if e completed differently than in the replayed
+// trace
+func (s *scheduler) checkReplay(e *edge) {
+	if s.replay == nil {
+		return
+	}
+	vt, ok := s.replay.vertexes[replayKey(e)]
+	if !ok {
+		return
+	}
+	cached := e.err == nil && e.execCacheLoad
+	if vt.Completed != (e.err == nil) || vt.Cached != cached {
+		s.edgeLogger(e).Warnf("replay of %s diverged from the trace: completed %v cached %v, expected completed %v cached %v", e.edge.Vertex.Name(), e.err == nil, cached, vt.Completed, vt.Cached)
+	}
+}
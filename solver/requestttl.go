@@ -0,0 +1,58 @@
+package solver
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRequestExpired is returned for asynchronous requests of an edge that did
+// not return within SchedulerOpt.FuncRequestTTL
+var ErrRequestExpired = errors.Errorf("request expired")
+
+// withRequestTTL wraps the function of an asynchronous request of e so that
+// the request fails with ErrRequestExpired if the function doesn't return
+// within SchedulerOpt.FuncRequestTTL. Called with mu held.
+func (s *scheduler) withRequestTTL(e *edge, f func(context.Context) (interface{}, error)) func(context.Context) (interface{}, error) {
+	ttl := s.opt.FuncRequestTTL
+	logger := s.edgeLogger(e)
+	name := e.edge.Vertex.Name()
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	return func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		done := make(chan result, 1)
+		go func() {
+			v, err := f(ctx)
+			done <- result{v, err}
+		}()
+
+		expired := make(chan struct{})
+		t := s.opt.Clock.AfterFunc(ttl, func() { close(expired) })
+		defer t.Stop()
+
+		select {
+		case r := <-done:
+			return r.v, r.err
+		case <-expired:
+		}
+		logger.Warnf("canceling request of edge %s that didn't return within %s", name, ttl)
+		// the function keeps running after the request is abandoned. Its
+		// context is canceled so that it can return early.
+		cancel()
+		go func() {
+			// a result returned after the request expired has no receiver
+			if r := <-done; r.err == nil {
+				if res, ok := r.v.(CachedResult); ok {
+					res.Release(context.TODO())
+				}
+			}
+		}()
+		return nil, errors.Wrapf(ErrRequestExpired, "%s after %s", name, ttl)
+	}
+}
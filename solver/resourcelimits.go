@@ -0,0 +1,31 @@
+package solver
+
+import "context"
+
+// ResourceLimits are the resources the operation of a vertex may use when it
+// is executed. The solver doesn't enforce the limits, it passes them to the
+// operation so that the executor can apply them.
+type ResourceLimits struct {
+	// CPUs is the number of CPUs the operation may use. Zero is unlimited.
+	CPUs float64
+	// Memory is the maximum memory in bytes the operation may use. Zero is
+	// unlimited.
+	Memory int64
+}
+
+type resourceLimitsKey struct{}
+
+func withResourceLimits(ctx context.Context, limits *ResourceLimits) context.Context {
+	if limits == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, resourceLimitsKey{}, limits)
+}
+
+// ResourceLimitsFromContext returns the VertexOptions.ResourceLimits of the
+// vertex whose operation is executed with ctx. It returns nil if the vertex
+// doesn't set any limits.
+func ResourceLimitsFromContext(ctx context.Context) *ResourceLimits {
+	limits, _ := ctx.Value(resourceLimitsKey{}).(*ResourceLimits)
+	return limits
+}
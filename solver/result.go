@@ -9,10 +9,15 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrResultReleased is returned for builds whose result was released before
+// it could be cloned for the caller
+var ErrResultReleased = errors.Errorf("result already released")
+
 // SharedResult is a result that can be cloned
 type SharedResult struct {
-	mu   sync.Mutex
-	main Result
+	mu       sync.Mutex
+	main     Result
+	released bool
 }
 
 func NewSharedResult(main Result) *SharedResult {
@@ -28,9 +33,27 @@ func (r *SharedResult) Clone() Result {
 	return r2
 }
 
+// tryClone is like Clone but fails if there is no result to clone or the
+// result has been released
+func (r *SharedResult) tryClone() (Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.main == nil {
+		return nil, errors.Errorf("no result to clone")
+	}
+	if r.released {
+		return nil, errors.WithStack(ErrResultReleased)
+	}
+	r1, r2 := dup(r.main)
+	r.main = r1
+	return r2, nil
+}
+
 func (r *SharedResult) Release(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.released = true
 	return r.main.Release(ctx)
 }
 
@@ -82,6 +105,14 @@ func (r *SharedCachedResult) CloneCachedResult() CachedResult {
 	return &clonedCachedResult{Result: r.SharedResult.Clone(), cr: r.CachedResult}
 }
 
+func (r *SharedCachedResult) tryCloneCachedResult() (CachedResult, error) {
+	res, err := r.SharedResult.tryClone()
+	if err != nil {
+		return nil, err
+	}
+	return &clonedCachedResult{Result: res, cr: r.CachedResult}, nil
+}
+
 func (r *SharedCachedResult) Clone() Result {
 	return r.CloneCachedResult()
 }
@@ -107,3 +138,28 @@ type SharedCachedResult struct {
 	*SharedResult
 	CachedResult
 }
+
+// IsSkipped returns true if the result was produced by a vertex that was
+// skipped because its condition was false
+func IsSkipped(r Result) bool {
+	_, ok := r.Sys().(skippedResult)
+	return ok
+}
+
+type skippedResult struct{}
+
+func (skippedResult) ID() string {
+	return ""
+}
+
+func (skippedResult) Release(context.Context) error {
+	return nil
+}
+
+func (r skippedResult) Sys() interface{} {
+	return r
+}
+
+func (r skippedResult) Clone() Result {
+	return r
+}
@@ -0,0 +1,106 @@
+package solver
+
+import (
+	"context"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ErrNotSerializable is returned by a ResultSerializer for results it can't
+// serialize
+var ErrNotSerializable = errors.Errorf("result is not serializable")
+
+// ResultSerializer converts results to and from bytes so that a result built
+// by one process can be injected into the solver of another process. The
+// serializer defines which result types are serializable: Serialize returns
+// an error wrapping ErrNotSerializable for the results it doesn't support.
+// Deserialize has to return a result that is valid in the current process,
+// for example by importing the data referenced by the serialized form.
+type ResultSerializer interface {
+	Serialize(context.Context, Result) ([]byte, error)
+	Deserialize(context.Context, []byte) (Result, error)
+}
+
+// SerializedResult is the serialized form of a CachedResult
+type SerializedResult struct {
+	// Data is the result serialized by SchedulerOpt.ResultSerializer
+	Data []byte `json:"data"`
+	// CacheKeys are the cache keys of the result
+	CacheKeys []SerializedCacheKey `json:"cacheKeys"`
+}
+
+// SerializedCacheKey is the serialized form of a cache key. Keys are
+// serialized with all their dependency keys, keys shared by several
+// dependencies are repeated. The exporters of the keys are not serialized, so
+// a cache export from the process that deserialized the result includes the
+// cache keys but no cache records of the process that built it.
+type SerializedCacheKey struct {
+	Digest digest.Digest             `json:"digest"`
+	Output Index                     `json:"output"`
+	Deps   [][]SerializedCacheKeyDep `json:"deps,omitempty"`
+}
+
+// SerializedCacheKeyDep is a dependency of a serialized cache key
+type SerializedCacheKeyDep struct {
+	Selector digest.Digest      `json:"selector,omitempty"`
+	CacheKey SerializedCacheKey `json:"cacheKey"`
+}
+
+// serializeResult converts res with SchedulerOpt.ResultSerializer
+func (s *scheduler) serializeResult(ctx context.Context, res CachedResult) (*SerializedResult, error) {
+	if s.opt.ResultSerializer == nil {
+		return nil, errors.Wrap(ErrNotSerializable, "no result serializer")
+	}
+	dt, err := s.opt.ResultSerializer.Serialize(ctx, res)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to serialize result %s", res.ID())
+	}
+	sr := &SerializedResult{Data: dt}
+	for _, k := range res.CacheKeys() {
+		sr.CacheKeys = append(sr.CacheKeys, serializeCacheKey(k.CacheKey))
+	}
+	return sr, nil
+}
+
+// deserializeResult converts sr back to a result with
+// SchedulerOpt.ResultSerializer
+func (s *scheduler) deserializeResult(ctx context.Context, sr *SerializedResult) (CachedResult, error) {
+	if s.opt.ResultSerializer == nil {
+		return nil, errors.Wrap(ErrNotSerializable, "no result serializer")
+	}
+	res, err := s.opt.ResultSerializer.Deserialize(ctx, sr.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to deserialize result")
+	}
+	keys := make([]ExportableCacheKey, 0, len(sr.CacheKeys))
+	for _, sk := range sr.CacheKeys {
+		keys = append(keys, deserializeCacheKey(sk))
+	}
+	return NewCachedResult(res, keys), nil
+}
+
+func serializeCacheKey(k *CacheKey) SerializedCacheKey {
+	sk := SerializedCacheKey{Digest: k.Digest(), Output: k.Output()}
+	for _, dd := range k.Deps() {
+		deps := make([]SerializedCacheKeyDep, 0, len(dd))
+		for _, d := range dd {
+			deps = append(deps, SerializedCacheKeyDep{Selector: d.Selector, CacheKey: serializeCacheKey(d.CacheKey.CacheKey)})
+		}
+		sk.Deps = append(sk.Deps, deps)
+	}
+	return sk
+}
+
+func deserializeCacheKey(sk SerializedCacheKey) ExportableCacheKey {
+	k := NewCacheKey(sk.Digest, sk.Output)
+	if len(sk.Deps) > 0 {
+		k.deps = make([][]CacheKeyWithSelector, len(sk.Deps))
+	}
+	for i, dd := range sk.Deps {
+		for _, d := range dd {
+			k.deps[i] = append(k.deps[i], CacheKeyWithSelector{Selector: d.Selector, CacheKey: deserializeCacheKey(d.CacheKey)})
+		}
+	}
+	return ExportableCacheKey{CacheKey: k, Exporter: &exporter{k: k}}
+}
@@ -0,0 +1,82 @@
+package solver
+
+import "container/list"
+
+// resultRetention tracks the completed edges in least recently used order for
+// limiting the number of results the scheduler holds on to. Protected by
+// scheduler.mu.
+type resultRetention struct {
+	lru   *list.List
+	items map[*edge]*list.Element
+}
+
+func newResultRetention() resultRetention {
+	return resultRetention{
+		lru:   list.New(),
+		items: map[*edge]*list.Element{},
+	}
+}
+
+// touchResult marks the result of e as recently used and evicts the least
+// recently used results if there are more than MaxRetainedResults. The
+// result of e itself is never evicted, so it stays available to the caller.
+func (s *scheduler) touchResult(e *edge) {
+	if s.opt.MaxRetainedResults <= 0 || e.result == nil {
+		return
+	}
+	if el, ok := s.retention.items[e]; ok {
+		s.retention.lru.MoveToFront(el)
+		return
+	}
+	s.retention.items[e] = s.retention.lru.PushFront(e)
+
+	for el := s.retention.lru.Back(); el != nil && s.retention.lru.Len() > s.opt.MaxRetainedResults; {
+		prev := el.Prev()
+		if ev := el.Value.(*edge); ev != e && s.canEvict(ev) && s.ef.releaseEdge(ev) {
+			s.retention.lru.Remove(el)
+			delete(s.retention.items, ev)
+			s.unchargeRetained(ev)
+		}
+		el = prev
+	}
+}
+
+// releaseRetained releases all results tracked for MaxRetainedResults that are
+// not used anymore and returns the number of released results
+func (s *scheduler) releaseRetained() int {
+	n := 0
+	for el := s.retention.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if e := el.Value.(*edge); s.canEvict(e) && s.ef.releaseEdge(e) {
+			s.retention.lru.Remove(el)
+			delete(s.retention.items, e)
+			s.unchargeRetained(e)
+			n++
+		}
+		el = prev
+	}
+	return n
+}
+
+// unchargeRetained removes the size of the released result of e from the
+// memory retained by its owner
+func (s *scheduler) unchargeRetained(e *edge) {
+	if e.owner != nil {
+		e.owner.retained -= e.retained
+	}
+	e.retained = 0
+}
+
+// canEvict returns false if the result of e is still used by the scheduler
+func (s *scheduler) canEvict(e *edge) bool {
+	if len(s.incoming[e]) > 0 || len(s.outgoing[e]) > 0 {
+		return false
+	}
+	// builds clone the result after they have been completed
+	for b := range s.builds {
+		if st, ok := b.pipe.Receiver.Status().Value.(*edgeState); ok && st.result == e.result {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package solver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultSaturationThreshold = 10 * time.Second
+
+// SaturationEvent is emitted when an asynchronous request of an edge has been
+// waiting for SchedulerOpt.Concurrency longer than
+// SchedulerOpt.SaturationThreshold. It means that the operations that already
+// run, not the scheduler, are holding back the build.
+type SaturationEvent struct {
+	// Edge is the edge that made the request
+	Edge Edge
+	// EdgeID is the ID the scheduler assigned to the edge
+	EdgeID uint64
+	// Waiting is the time the request has been waiting for
+	Waiting time.Duration
+	// Labels are the labels of the build that first requested the edge
+	Labels map[string]string
+	// Build is the request of the build if it was started from a job
+	Build *BuildRequest
+}
+
+// acquireSlot waits for the concurrency limit for the request p and reports
+// requests that wait longer than the saturation threshold
+func (s *scheduler) acquireSlot(p *edgePipe) {
+	atomic.StoreInt32(&p.waiting, waitingOnConcurrency)
+	select {
+	case s.sem <- struct{}{}:
+		return
+	default:
+	}
+	if s.opt.OnSaturated == nil {
+		s.sem <- struct{}{}
+		return
+	}
+	start := s.opt.Clock.Now()
+	t := s.opt.Clock.AfterFunc(s.opt.SaturationThreshold, func() {
+		s.mu.Lock()
+		p.mu.Lock()
+		e := p.From
+		p.mu.Unlock()
+		ev := SaturationEvent{Edge: e.edge, EdgeID: e.id, Waiting: s.opt.Clock.Now().Sub(start)}
+		if b := e.owner; b != nil {
+			ev.Labels = b.labels
+			ev.Build = b.request
+		}
+		s.mu.Unlock()
+		s.opt.OnSaturated(ev)
+	})
+	s.sem <- struct{}{}
+	t.Stop()
+}
+
+// funcRequestsWaiting returns the number of asynchronous requests that haven't
+// started because of the concurrency limit, exclusive locks or pending results.
+// Called with s.mu held.
+func (s *scheduler) funcRequestsWaiting() int {
+	n := 0
+	for _, out := range s.outgoing {
+		for _, p := range out {
+			if atomic.LoadInt32(&p.waiting) != 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package solver
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// SchedulerErrorKind describes what kind of internal error of the scheduler a
+// SchedulerError is
+type SchedulerErrorKind string
+
+const (
+	// SchedulerErrorPanic is used for panics recovered while dispatching an
+	// edge
+	SchedulerErrorPanic SchedulerErrorKind = "panic"
+	// SchedulerErrorInvariant is used when the state of an edge violates an
+	// invariant of the scheduler after it was dispatched
+	SchedulerErrorInvariant SchedulerErrorKind = "invariant"
+)
+
+// SchedulerError is an internal error of the scheduler. These errors are not
+// caused by the builds or the operations, they point to bugs in the scheduler.
+type SchedulerError struct {
+	// Edge is the edge that was dispatched when the error happened
+	Edge Edge
+	// EdgeID is the ID the scheduler assigned to the edge
+	EdgeID uint64
+	Kind   SchedulerErrorKind
+	Err    error
+	// Stack is the stack of the goroutine that detected the error. For panics
+	// it includes the frames of the panic.
+	Stack []byte
+}
+
+func (e SchedulerError) Error() string {
+	return fmt.Sprintf("scheduler %s on edge %d: %v", e.Kind, e.EdgeID, e.Err)
+}
+
+// SchedulerErrors returns the channel receiving the internal errors of the
+// scheduler with SchedulerOpt.CollectErrors. Nil is returned if errors are not
+// collected.
+func (s *scheduler) SchedulerErrors() <-chan SchedulerError {
+	return s.schedErrors
+}
+
+// reportError sends an internal error of the scheduler for e to the channel
+// returned by SchedulerErrors together with the current stack. Errors are
+// dropped if the channel is full.
+func (s *scheduler) reportError(e *edge, kind SchedulerErrorKind, err error) {
+	if s.schedErrors == nil {
+		return
+	}
+	select {
+	case s.schedErrors <- SchedulerError{Edge: e.edge, EdgeID: e.id, Kind: kind, Err: err, Stack: debug.Stack()}:
+	default:
+		s.edgeLogger(e).Warnf("dropping scheduler error, collected errors are not received: %v", err)
+	}
+}
+
+// recoverDispatch recovers a panic in the dispatch of e, reports it and fails
+// the edge with it. An edge that had already failed is not dispatched again,
+// so that an edge that keeps panicking doesn't block the loop. Deferred with
+// mu held.
+func (s *scheduler) recoverDispatch(e *edge) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := errors.Errorf("buildkit scheduler error: panic in dispatch of %s: %v", e.edge.Vertex.Name(), r)
+	s.reportError(e, SchedulerErrorPanic, err)
+	s.edgeLogger(e).Errorf("%v", err)
+	if e.err != nil {
+		return
+	}
+	e.err = err
+	s.signal(e)
+}
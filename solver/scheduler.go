@@ -2,11 +2,15 @@ package solver
 
 import (
 	"context"
+	"math/rand"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/moby/buildkit/solver/internal/pipe"
 	"github.com/moby/buildkit/util/cond"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -19,27 +23,533 @@ func init() {
 	}
 }
 
-func newScheduler(ef edgeFactory) *scheduler {
+const (
+	defaultAdmissionInterval    = 100 * time.Millisecond
+	defaultMaxSkippedDispatches = 100
+)
+
+// ErrSchedulerOverloaded is returned by build when the number of edges waiting
+// for dispatch is over SchedulerOpt.MaxQueueLength
+var ErrSchedulerOverloaded = errors.Errorf("scheduler overloaded")
+
+// ErrGraphTooDeep is returned for edges that are nested deeper in the build
+// graph than SchedulerOpt.MaxEdgeDepth allows
+var ErrGraphTooDeep = errors.Errorf("build graph too deep")
+
+// ErrSchedulerStopped is returned for builds and requests made after the
+// scheduler was stopped
+var ErrSchedulerStopped = errors.Errorf("scheduler stopped")
+
+// ErrTooManyPipes is returned for requests to or from an edge that already
+// has SchedulerOpt.MaxEdgePipes open requests in that direction
+var ErrTooManyPipes = errors.Errorf("too many requests for edge")
+
+// ErrTooManyEdges is returned for builds and requests that need a new edge
+// while SchedulerOpt.MaxEdges edges are loaded
+var ErrTooManyEdges = errors.Errorf("too many edges")
+
+// ErrEdgeComplete is returned when injecting a result for an edge that already
+// has a result or has failed
+var ErrEdgeComplete = errors.Errorf("edge already complete")
+
+// ErrCacheKeyCollision is logged when two edges with matching cache keys are
+// not merged because SchedulerOpt.DefinitionDigest returned different digests
+// for their vertexes
+var ErrCacheKeyCollision = errors.Errorf("cache key collision")
+
+// ErrMergeTimeout is logged when merging two edges is abandoned because
+// verifying it took longer than SchedulerOpt.MergeTimeout
+var ErrMergeTimeout = errors.Errorf("merge timed out")
+
+// errMergeStale is logged when merging two edges is abandoned because one of
+// them was merged or released while the merge was verified
+var errMergeStale = errors.Errorf("merged edges changed during verification")
+
+// SchedulerOpt defines optional configuration for the scheduler
+type SchedulerOpt struct {
+	// AdmissionRate limits how many edges that have not been dispatched before
+	// can enter dispatch per AdmissionInterval. Edges over the limit are held
+	// back until the next interval. This smooths out the load when a large
+	// graph is added at once. Zero disables the limit.
+	AdmissionRate int
+	// AdmissionInterval is the interval for AdmissionRate. Defaults to 100ms.
+	AdmissionInterval time.Duration
+	// MaxQueueLength is the high-water mark for the number of edges waiting
+	// for dispatch. New builds started while the queue is longer fail with
+	// ErrSchedulerOverloaded. Zero disables the limit.
+	MaxQueueLength int
+	// BlockWhenOverloaded makes new builds wait for the queue to drain below
+	// MaxQueueLength instead of failing.
+	BlockWhenOverloaded bool
+	// MaxSkippedDispatches is the number of times an edge can be taken from
+	// the queue without getting dispatched before a warning is logged for it.
+	// Defaults to 100.
+	MaxSkippedDispatches int
+	// DispatchGate is called before an incomplete edge is processed. If it
+	// returns an error the edge fails with that error and no new work is
+	// started for it.
+	DispatchGate func(Edge) error
+	// ResultValidator is called with every result produced for an edge,
+	// either by executing the operation or loading it from the cache, before
+	// the edge completes with it. If it returns an error an executed result is
+	// not saved to the cache and the edge fails. A cached result that doesn't
+	// pass is skipped like a cache record that fails to load. The validator
+	// runs outside of the scheduler loop.
+	ResultValidator func(Edge, CachedResult) error
+	// ResultProcessors transform the results of executed operations before
+	// they are validated, saved to the cache and returned. Processors are
+	// selected by VertexOptions.Type. Results loaded from the cache have
+	// already been processed and are not passed to the processors again.
+	ResultProcessors map[string]ResultProcessor
+	// IndexSnapshot pre-warms the merge index when the solver is created, so
+	// that the first edges after a restart can match the keys of a previous
+	// session
+	IndexSnapshot *IndexSnapshot
+	// IndexResultLoader loads the result recorded in IndexSnapshot for the
+	// key of an edge. An edge whose index key matches a restored entry with a
+	// result completes with the loaded result instead of running its
+	// operation. Returning false evaluates the edge as usual. It is called
+	// with the scheduler locked, so it must not block or call back into the
+	// scheduler.
+	IndexResultLoader func(IndexedEdge) (Result, bool)
+	// ResultSerializer converts results to and from a form that can be moved
+	// to another process, see Job.BuildSerialized and
+	// Job.InjectSerializedResult. Without a serializer results can't be
+	// serialized.
+	ResultSerializer ResultSerializer
+	// OnCancel is called when the scheduler cancels a request. It is called
+	// synchronously, possibly while the scheduler is locked, so it must not
+	// block or call back into the scheduler.
+	OnCancel func(CancelEvent)
+	// OnCacheMiss is called with a CacheMissEvent when an edge starts
+	// executing its operation, describing why no cached result was used. It
+	// is called synchronously with the scheduler locked, so it must not block
+	// or call back into the scheduler.
+	OnCacheMiss func(CacheMissEvent)
+	// OnSaturated is called with a SaturationEvent when an asynchronous request
+	// has been waiting for the Concurrency limit longer than
+	// SaturationThreshold. It is called from a separate goroutine without the
+	// scheduler locked.
+	OnSaturated func(SaturationEvent)
+	// SaturationThreshold is the time a request waits for the Concurrency
+	// limit before OnSaturated is called for it. Defaults to 10 seconds.
+	SaturationThreshold time.Duration
+	// OnEdgeCleanup is called when the solver drops its last reference to an
+	// edge and releases its result. This happens when the jobs using the edge
+	// are discarded, when the edge was merged to another edge or after its
+	// result was evicted for MaxRetainedResults. It is called synchronously
+	// while the solver is locked, so it must not block or call back into the
+	// solver.
+	OnEdgeCleanup func(Edge)
+	// UnsafeCloneFallback returns the shared result of an edge from a build
+	// when the result can't be cloned for the caller, for example because it
+	// has been released already, instead of failing the build. Releasing the
+	// returned result releases it for every user of the edge, so this is only
+	// safe for results whose Release doesn't free anything.
+	UnsafeCloneFallback bool
+	// ResultExtractor returns the result of a build from the value the
+	// request to the edge of the build completed with. The default extracts
+	// the result of the edge state. Shared results are cloned for the caller,
+	// other results are returned as they are.
+	ResultExtractor func(interface{}) (CachedResult, error)
+	// OnOrphaned is called when an edge still has outgoing requests running,
+	// like executing its operation, while none of its incoming requests are
+	// open anymore because they were canceled or completed. The edge cancels
+	// the orphaned requests in the same dispatch, unless its requests were
+	// canceled with WithCacheOnCancel. It is called once until the edge gets a
+	// new request, synchronously with the scheduler locked, so it must not
+	// block or call back into the scheduler.
+	OnOrphaned func(Edge)
+	// WarnUncacheable logs a warning for every edge that completes with a
+	// result while no cache key could be computed for it, for example
+	// because one of its inputs never provided a key. Such edges are never
+	// merged or found in the cache, which usually points to a vertex that is
+	// uncacheable by accident. Vertexes with IgnoreCache or NonShareable are
+	// not reported. The edges are counted in Stats.UncacheableEdges.
+	WarnUncacheable bool
+	// OnEdgeComplete is called once when an edge completes with a result or
+	// an error. The context is the context of the build that first requested
+	// the edge, so trace spans and other values the build was started with can
+	// be looked up from it. It is called synchronously with the scheduler
+	// locked, so it must not block or call back into the scheduler.
+	OnEdgeComplete func(context.Context, CompletionEvent)
+	// OnResult is called for every edge that completes with a result, in any
+	// build. It is called after the dispatch that completed the edge, without
+	// the scheduler locked. The result is released when the function returns,
+	// so it needs to be cloned to be kept.
+	OnResult func(Edge, CachedResult)
+	// InputResolver is called before an edge requests one of its inputs. If
+	// it returns a result, the input is not evaluated and the requesting edge
+	// receives the result as if the input had completed with it. The result
+	// needs to have cache keys so the requesting edge can compute its own
+	// cache key, and it is released with the requesting edge. Returning false
+	// evaluates the input as usual. It is called with the scheduler locked,
+	// so it must not block or call back into the scheduler.
+	InputResolver func(Edge) (CachedResult, bool)
+	// MaxRetainedResults limits the number of results of completed edges the
+	// scheduler holds on to. When the limit is exceeded the least recently
+	// used results that no running build depends on are released. An edge
+	// whose result was released is evaluated again, using the cache, if it is
+	// requested later. Zero disables the limit.
+	MaxRetainedResults int
+	// MaxEdgeDepth is the maximum number of dependency levels between a build
+	// request and an edge. Edges nested deeper fail with ErrGraphTooDeep.
+	// Zero disables the limit.
+	MaxEdgeDepth int
+	// MaxEdgePipes limits the number of open incoming requests to an edge and
+	// the number of open outgoing requests from an edge. This bounds the
+	// memory used by graphs with a huge fan-in or fan-out. Requests over the
+	// limit fail with ErrTooManyPipes. Zero disables the limit.
+	MaxEdgePipes int
+	// MaxEdges limits the number of edges loaded at the same time. Builds and
+	// requests that need a new edge over the limit fail with
+	// ErrTooManyEdges, so a huge graph can't exhaust the memory of the
+	// scheduler. Edges are unloaded when the jobs using them are discarded.
+	// Zero disables the limit.
+	MaxEdges int
+	// QueuePolicy defines the order queued edges are dispatched in. Defaults to
+	// QueuePolicyFIFO.
+	QueuePolicy QueuePolicy
+	// PriorityAging raises the priority of a queued edge by one for every
+	// PriorityAging it has been waiting in the queue with QueuePolicyPriority,
+	// so edges of low priority builds are eventually dispatched even while
+	// higher priority work keeps arriving. Zero disables aging.
+	PriorityAging time.Duration
+	// TraceDispatches records a span for every dispatch of an edge in the
+	// trace of the build that first requested it. The span starts when the
+	// edge was queued and has a child span covering the dispatch itself, so
+	// traces show how long each edge waited in the queue and how long its
+	// processing took.
+	TraceDispatches bool
+	// StatsWindow is the longest window windowed statistics like
+	// Stats.CacheHitRatio can be calculated for. Defaults to 10 minutes.
+	StatsWindow time.Duration
+	// Name identifies the scheduler in the output of WriteMetrics
+	Name string
+	// Concurrency limits the number of asynchronous requests edges can run at
+	// the same time. This includes computing cache keys, loading the cache
+	// and executing operations. Operations that start nested builds through
+	// the same scheduler must not run with a limit as they can deadlock.
+	// Zero disables the limit.
+	Concurrency int
+	// Logger receives the warnings of the scheduler. Defaults to the standard
+	// logrus logger.
+	Logger logrus.FieldLogger
+	// RequestIDKey is the context key of the client request ID of builds. The
+	// value stored for it in the context of a build is added as the
+	// RequestIDField field to the logs of the edges owned by the build and is
+	// set as the RequestID of the CancelEvents the build originates.
+	RequestIDKey interface{}
+	// RequestIDField is the name of the log field of the request ID. Defaults
+	// to "request".
+	RequestIDField string
+	// manualDispatch disables the scheduler loop. Edges are only dispatched
+	// with step.
+	manualDispatch bool
+	// Trace enables logging every dispatch of the scheduler at debug level, the
+	// same as setting BUILDKIT_SCHEDULER_DEBUG=1.
+	Trace bool
+	// Clock is the time source for the admission rate, dispatch intervals and
+	// statistics. Defaults to the system clock.
+	Clock Clock
+	// TraceRecorder records the dispatches, merges and completions of edges
+	TraceRecorder *TraceRecorder
+	// Replay makes the scheduler reproduce a trace recorded with a
+	// TraceRecorder. Queued edges are dispatched in the order of their first
+	// dispatch in the trace, overriding QueuePolicy, and the vertexes that were
+	// executed in the trace skip the cache. Edges are only reordered while they
+	// are in the queue, so asynchronous requests completing in a different
+	// order than in the trace can still change it; setting Concurrency to 1
+	// keeps the replay closest to the trace. Results that were loaded from the
+	// cache can only be loaded again if the cache still has them. A warning is
+	// logged for every edge that completes differently than in the trace.
+	Replay *BuildTrace
+	// ResultSize returns the memory retained by a result. It is used to
+	// account the memory of the running builds for MemoryPressure.
+	ResultSize func(Result) int64
+	// MemoryPressure is a signal from the memory monitor of the host. Every
+	// time it fires the builds chosen by MemoryPressureSelector are canceled
+	// with ErrMemoryPressure.
+	MemoryPressure <-chan struct{}
+	// MemoryPressureSelector chooses the builds to cancel under memory
+	// pressure. It is called with the scheduler locked and must not call back
+	// into it. Defaults to the build retaining the most memory.
+	MemoryPressureSelector func([]BuildUsage) []BuildUsage
+	// MemoryPressureSteps are the ways of reclaiming memory tried in order
+	// every time MemoryPressure fires. The steps after the first step that
+	// reclaims anything are left for the next signal, so work is only
+	// canceled if the memory can't be reclaimed otherwise. Defaults to
+	// ReclaimCancelBuilds.
+	MemoryPressureSteps []ReclaimStep
+	// PipeTracer receives the requests made between edges and the responses
+	// received for them. It is called synchronously with the scheduler locked
+	// and must not block or call back into the scheduler.
+	PipeTracer func(PipeEvent)
+	// TracePipes selects the edges whose requests are passed to PipeTracer.
+	// Requests are traced if either side is selected. Defaults to all edges.
+	TracePipes func(Edge) bool
+	// DefinitionDigest returns a digest of the definition of a vertex that has
+	// to match for edges with the same cache key to be merged. It is meant for
+	// debugging cache correctness: edges whose digests differ are not merged
+	// and ErrCacheKeyCollision is logged. It is called for every merge so it
+	// should only be set while debugging. It is called without the scheduler
+	// lock and ctx is canceled when MergeTimeout expires.
+	DefinitionDigest func(ctx context.Context, v Vertex) (digest.Digest, error)
+	// MergeSelector rewrites the selector of dependency index of an edge src
+	// that is merged into target before the dependency keys of src are
+	// recorded as secondary exporters of target. The default records the
+	// selector of the cache map of src. Exported cache records link the keys
+	// with the returned selector, so a selector that doesn't describe the
+	// same part of the dependency makes later builds load a wrong result from
+	// the cache. Content based keys are recorded without a selector and are
+	// not passed to it. It is called with the scheduler locked.
+	MergeSelector func(target, src Edge, index Index, sel digest.Digest) digest.Digest
+	// IndexKeyPolicy defines which cache keys of the dependencies of an edge
+	// are used to find edges to merge with. Defaults to IndexKeyPolicyAll.
+	IndexKeyPolicy IndexKeyPolicy
+	// PreferMergeTarget decides the direction of a merge. By default an edge
+	// whose key matches an edge that is already in the index is merged to the
+	// existing edge, which keeps its cache sources and gets the sources of
+	// the other edge added. If PreferMergeTarget returns true the existing
+	// edge is merged to the incoming edge instead, for example because the
+	// cache sources of the incoming edge are closer. It is only called while
+	// neither edge has started loading or executing its result, and with
+	// the scheduler locked.
+	PreferMergeTarget func(existing, incoming Edge) bool
+	// MergeTimeout limits the time spent merging two edges, including the
+	// verification with DefinitionDigest. If the merge takes longer it is
+	// abandoned, leaving the edges separate, and ErrMergeTimeout is logged.
+	// Zero waits for the verification without a limit.
+	MergeTimeout time.Duration
+	// DeferredMerges moves merging edges with matching cache keys out of the
+	// dispatch of the edges. Merges are queued and performed by a separate
+	// goroutine that merges at most this many edges at a time before it
+	// yields the scheduler lock. Zero merges the edges during dispatch.
+	DeferredMerges int
+	// HoldPendingMerges keeps edges queued for DeferredMerges from being
+	// dispatched until the merge loop has checked them, so two edges with
+	// matching cache keys don't both start their operations before they are
+	// merged. This adds the merge delay to the edges whose keys changed.
+	// Without DeferredMerges edges are checked in the dispatch their keys
+	// changed in and the option has no effect.
+	HoldPendingMerges bool
+	// KeepFinishedWorkOnMerge hands the operation of an edge that is merged
+	// to the edge it is merged to if the operation has already returned its
+	// result and only the delivery of the result is left, instead of
+	// canceling it with the other requests of the merged edge. Operations
+	// that are still running are canceled as usual. It has no effect if the
+	// target edge has started its own operation.
+	KeepFinishedWorkOnMerge bool
+	// SpeculativeInputs requests the results of the dependencies of an edge
+	// that needs to complete while its own cache check is still running,
+	// instead of only requesting their cache keys first. This lowers the
+	// latency of cache misses. If the edge turns out to be a cache hit the
+	// dependency requests are canceled, but work they already did is wasted.
+	SpeculativeInputs bool
+	// MaxPendingResults limits the number of asynchronous requests that
+	// completed but whose results have not been received by their edges yet.
+	// New requests wait before they start until the edges that are behind
+	// have been dispatched, or until they are canceled. This bounds the memory
+	// held by large intermediate values when a downstream edge is slow to
+	// consume them. Running requests are not counted. Zero disables the limit.
+	MaxPendingResults int
+	// FuncRequestTTL limits the time the function of an asynchronous request,
+	// like computing a cache key or executing an operation, can run. A
+	// function that hasn't returned after FuncRequestTTL has its context
+	// canceled and the request fails with ErrRequestExpired, so a function
+	// that never returns doesn't keep its edge open forever. A warning is
+	// logged for every expired request. The function itself is not waited
+	// for. Zero disables the limit.
+	FuncRequestTTL time.Duration
+	// VerifyUpdates checks after every unpark that the edge handled all the
+	// updates it was called with and panics otherwise. An update is handled
+	// if it belongs to a request of the edge and the edge still tracks the
+	// request unless it completed. It is meant for catching bugs in unpark.
+	VerifyUpdates bool
+	// CollectErrors sends the internal errors of the scheduler to the channel
+	// returned by SchedulerErrors, which is buffered for CollectErrors
+	// errors. Panics while dispatching an edge are recovered and fail the
+	// edge instead of crashing the process, failed VerifyUpdates checks fail
+	// the edge instead of panicking, and edges left with open requests are
+	// reported in addition to failing. Errors that don't fit in the buffer are
+	// logged and dropped. Zero disables collecting.
+	CollectErrors int
+}
+
+func newScheduler(ef edgeFactory, opts ...SchedulerOption) *scheduler {
+	var opt SchedulerOpt
+	for _, o := range opts {
+		o(&opt)
+	}
+	if opt.Logger == nil {
+		opt.Logger = logrus.StandardLogger()
+	}
+	if opt.Clock == nil {
+		opt.Clock = realClock{}
+	}
+	if opt.SaturationThreshold <= 0 {
+		opt.SaturationThreshold = defaultSaturationThreshold
+	}
+	if opt.RequestIDField == "" {
+		opt.RequestIDField = defaultRequestIDField
+	}
+	if opt.AdmissionInterval <= 0 {
+		opt.AdmissionInterval = defaultAdmissionInterval
+	}
+	if opt.MaxSkippedDispatches <= 0 {
+		opt.MaxSkippedDispatches = defaultMaxSkippedDispatches
+	}
+	if opt.StatsWindow <= 0 {
+		opt.StatsWindow = defaultStatsWindow
+	}
 	s := &scheduler{
 		waitq:    map[*edge]struct{}{},
 		incoming: map[*edge][]*edgePipe{},
 		outgoing: map[*edge][]*edgePipe{},
+		held:     map[*edge]struct{}{},
+		builds:   map[*activeBuild]struct{}{},
 
 		stopped: make(chan struct{}),
 		closed:  make(chan struct{}),
 
-		ef: ef,
+		ef:    ef,
+		opt:   opt,
+		debug: debugScheduler || opt.Trace,
+		stats: schedulerStats{window: opt.StatsWindow},
+
+		retention: newResultRetention(),
+		locks:     newExclusiveLocks(),
+	}
+	if opt.Concurrency > 0 {
+		s.sem = make(chan struct{}, opt.Concurrency)
+	}
+	if opt.CollectErrors > 0 {
+		s.schedErrors = make(chan SchedulerError, opt.CollectErrors)
+	}
+	if opt.MaxPendingResults > 0 {
+		s.pending = newPendingResults(opt.MaxPendingResults)
+	}
+	if opt.Replay != nil {
+		s.replay = newReplayState(opt.Replay)
 	}
 	s.cond = cond.NewStatefulCond(&s.mu)
+	s.beat()
 
-	go s.loop()
+	if opt.manualDispatch {
+		close(s.closed)
+	} else {
+		go s.loop()
+	}
+	if opt.MemoryPressure != nil {
+		go s.watchMemoryPressure(opt.MemoryPressure)
+	}
+	if opt.DeferredMerges > 0 {
+		s.mergesQueued = map[*edge]struct{}{}
+		s.mergesHeld = map[*edge]struct{}{}
+		s.mergeSignal = make(chan struct{}, 1)
+		go s.mergeLoop()
+	}
 
 	return s
 }
 
 type dispatcher struct {
-	next *dispatcher
-	e    *edge
+	next   *dispatcher
+	e      *edge
+	queued time.Time // time the edge was added to the queue
+}
+
+// ResultProcessor transforms the result of an edge. It takes ownership of res
+// and needs to release it if it returns a different result. An error fails
+// the edge. Processors run outside of the scheduler loop.
+type ResultProcessor func(ctx context.Context, e Edge, res Result) (Result, error)
+
+// activeBuild is a build request that is being processed by the scheduler
+type activeBuild struct {
+	edge     *edge
+	pipe     *pipe.Pipe
+	labels   map[string]string
+	request  *BuildRequest
+	cost     int64 // accumulated cost of the dispatched edges for fair queuing
+	priority int   // priority of the edges owned by the build
+
+	retained  int64 // size of the results of the edges owned by the build
+	cancelErr error // reason the build was canceled by the scheduler
+	requestID string
+	ctx       context.Context // context the build was started with
+
+	nonShareable bool // edges owned by the build are not merged
+	merged       bool // the requested edge was merged to another edge, protected by mu
+
+	done chan struct{} // closed when the build has returned
+}
+
+// BuildRequest is a top-level build request of a job. Active requests can be
+// listed with ActiveBuilds and replayed on another solver that uses the same
+// cache with Job.Resume. Results cached by the original solver are reused.
+// Vertexes are kept in memory so requests can only be replayed within the same
+// process.
+type BuildRequest struct {
+	JobID  string
+	Edge   Edge
+	Labels map[string]string
+}
+
+type buildLabelsKey struct{}
+
+// WithBuildLabels returns a context that attaches labels to the builds started
+// with it. Labels can be used to address running builds, for example with
+// CancelByLabel.
+func WithBuildLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, buildLabelsKey{}, labels)
+}
+
+func buildLabels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(buildLabelsKey{}).(map[string]string)
+	return labels
+}
+
+type buildPriorityKey struct{}
+
+type cacheOnCancelKey struct{}
+
+// WithCacheOnCancel returns a context for builds that save as much to the cache
+// as possible when they are canceled. Canceling such a build doesn't start new
+// work, but operations that are already running are left to finish and save
+// their results to the cache before the build returns. Operations waiting for
+// the concurrency limit or an exclusive lock are canceled. Edges shared with
+// builds that are canceled without it are canceled as usual.
+func WithCacheOnCancel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheOnCancelKey{}, true)
+}
+
+type nonShareableBuildKey struct{}
+
+// WithNonShareableBuild returns a context for builds whose edges are handled
+// like vertexes with VertexOptions.NonShareable. The edges owned by the build
+// are not added to the cache key index and never merge with other edges, so
+// they don't record secondary exporters and their results are not shared with
+// other builds through the index. Results are still saved to the cache by the
+// operations. Edges the build shares with other builds by vertex digest are
+// owned by the build that requested them first.
+func WithNonShareableBuild(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nonShareableBuildKey{}, true)
+}
+
+func isNonShareableBuild(ctx context.Context) bool {
+	v, _ := ctx.Value(nonShareableBuildKey{}).(bool)
+	return v
+}
+
+// WithBuildPriority returns a context that sets the priority of the builds
+// started with it for QueuePolicyPriority. Builds default to priority 0.
+func WithBuildPriority(ctx context.Context, prio int) context.Context {
+	return context.WithValue(ctx, buildPriorityKey{}, prio)
+}
+
+func buildPriority(ctx context.Context) int {
+	prio, _ := ctx.Value(buildPriorityKey{}).(int)
+	return prio
 }
 
 type scheduler struct {
@@ -47,17 +557,61 @@ type scheduler struct {
 	mu   sync.Mutex
 	muQ  sync.Mutex
 
-	ef edgeFactory
+	ef    edgeFactory
+	opt   SchedulerOpt
+	debug bool
+	sem   chan struct{} // limits running async requests if Concurrency is set
+	// pending limits async requests with unreceived results if
+	// MaxPendingResults is set
+	pending *pendingResults
+	locks   *exclusiveLocks
 
 	waitq       map[*edge]struct{}
 	next        *dispatcher
 	last        *dispatcher
+	capacity    chan struct{} // closed when the queue drains below MaxQueueLength
 	stopped     chan struct{}
 	stoppedOnce sync.Once
 	closed      chan struct{}
 
 	incoming map[*edge][]*edgePipe
 	outgoing map[*edge][]*edgePipe
+	builds   map[*activeBuild]struct{}
+
+	// admission ramp state, protected by mu
+	admitStart time.Time
+	admitCount int
+	held       map[*edge]struct{}
+	heldTimer  Timer
+
+	stats     schedulerStats
+	retention resultRetention
+	waiting   bool      // loop is waiting for a signal, protected by mu
+	queuedAt  time.Time // time the last edge taken from the queue was queued, protected by mu
+
+	heartbeat int64  // unix nanoseconds of the last loop iteration, accessed atomically
+	edgeIDs   uint64 // last assigned edge ID, accessed atomically
+	liveEdges int64  // number of loaded edges, accessed atomically
+
+	runningFuncs [numFuncRequestKinds]int64 // running requests per kind, accessed atomically
+
+	schedErrors chan SchedulerError // internal errors for SchedulerOpt.CollectErrors
+
+	stopping bool          // StopGracefully was called, protected by mu
+	drained  []drainedEdge // edges completed while stopping, protected by mu
+
+	tapped []tappedResult // results waiting for SchedulerOpt.OnResult, protected by mu
+
+	resume        chan struct{} // closed by Resume, non-nil while paused, protected by mu
+	paused        int32         // set while paused, accessed atomically
+	pausedWaiting bool          // loop is blocked by Pause, protected by mu
+
+	replay *replayState
+
+	merges       []*edge // edges queued for DeferredMerges, protected by mu
+	mergesQueued map[*edge]struct{}
+	mergesHeld   map[*edge]struct{} // edges not dispatched for HoldPendingMerges
+	mergeSignal  chan struct{}
 }
 
 func (s *scheduler) Stop() {
@@ -67,6 +621,16 @@ func (s *scheduler) Stop() {
 	<-s.closed
 }
 
+// isStopped returns true if Stop has been called
+func (s *scheduler) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *scheduler) loop() {
 	defer func() {
 		close(s.closed)
@@ -87,40 +651,314 @@ func (s *scheduler) loop() {
 			return
 		default:
 		}
-		s.muQ.Lock()
-		l := s.next
-		if l != nil {
-			if l == s.last {
-				s.last = nil
-			}
-			s.next = l.next
-			delete(s.waitq, l.e)
+		if s.waitResumed() {
+			continue
 		}
-		s.muQ.Unlock()
-		if l == nil {
+		e := s.dequeue()
+		if e == nil {
+			s.waiting = true
 			s.cond.Wait()
+			s.waiting = false
+			s.stats.wakeups++
 			continue
 		}
-		s.dispatch(l.e)
+		s.process(e)
+		s.flushResults()
+	}
+}
+
+// dequeue removes the next edge to dispatch from the queue. Returns nil if the
+// queue is empty.
+func (s *scheduler) dequeue() *edge {
+	s.beat()
+
+	s.muQ.Lock()
+	defer s.muQ.Unlock()
+
+	l := s.pop()
+	if l == nil {
+		return nil
+	}
+	delete(s.waitq, l.e)
+	s.queuedAt = l.queued
+	if s.capacity != nil && len(s.waitq) <= s.opt.MaxQueueLength {
+		close(s.capacity)
+		s.capacity = nil
+	}
+	return l.e
+}
+
+// process dispatches an edge taken from the queue unless the dispatch needs to
+// be delayed. Returns true if the edge was dispatched.
+func (s *scheduler) process(e *edge) bool {
+	if s.holdForMerge(e) {
+		s.skipDispatch(e)
+		return false
+	}
+	if d := redispatchDelay(e, s.opt.Clock.Now()); d > 0 {
+		s.deferDispatch(e, d)
+		s.skipDispatch(e)
+		return false
+	}
+	if !s.admit(e) {
+		s.skipDispatch(e)
+		return false
+	}
+	e.skippedDispatches = 0
+	s.charge(e)
+	s.replayDispatched(e)
+	if s.opt.TraceDispatches {
+		defer s.traceDispatch(e, s.queuedAt)()
+	}
+	if s.schedErrors != nil {
+		defer s.recoverDispatch(e)
+	}
+	s.dispatch(e)
+	return true
+}
+
+// step takes a single edge from the queue and processes it. It is used for
+// driving schedulers that were created with manual dispatch instead of the
+// loop, for example in tests that check the exact dispatch order. Returns nil
+// if nothing was queued.
+func (s *scheduler) step() *edge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.resume != nil {
+		return nil
+	}
+	e := s.dequeue()
+	if e == nil {
+		return nil
+	}
+	s.process(e)
+	s.flushResults()
+	return e
+}
+
+// pop removes the next edge to dispatch from the queue. Called with muQ held.
+func (s *scheduler) pop() *dispatcher {
+	var prev, l *dispatcher
+	switch {
+	case s.replay != nil:
+		prev, l = s.replayNext()
+	case s.opt.QueuePolicy == QueuePolicyFair:
+		prev, l = s.fairNext()
+	case s.opt.QueuePolicy == QueuePolicyPriority:
+		prev, l = s.priorityNext()
+	default:
+		l = s.next
+	}
+	if l == nil {
+		return nil
+	}
+	if prev == nil {
+		s.next = l.next
+	} else {
+		prev.next = l.next
+	}
+	if l == s.last {
+		s.last = prev
+	}
+	l.next = nil
+	return l
+}
+
+// fairNext returns the first queued edge of the build that has accumulated the
+// least cost, together with the element before it in the queue. Edges without
+// an owning build are not accounted and are dispatched first.
+func (s *scheduler) fairNext() (prev, next *dispatcher) {
+	var p *dispatcher
+	for l := s.next; l != nil; p, l = l, l.next {
+		if l.e.owner == nil {
+			return p, l
+		}
+		if next == nil || l.e.owner.cost < next.e.owner.cost {
+			prev, next = p, l
+		}
+	}
+	return prev, next
+}
+
+// priorityNext returns the first queued edge of the build with the highest
+// priority, together with the element before it in the queue. Edges without an
+// owning build have priority 0. With PriorityAging the time an edge has been
+// queued is added to its priority.
+func (s *scheduler) priorityNext() (prev, next *dispatcher) {
+	var now time.Time
+	if s.opt.PriorityAging > 0 {
+		now = s.opt.Clock.Now()
+	}
+	var p *dispatcher
+	prio := 0
+	for l := s.next; l != nil; p, l = l, l.next {
+		lp := 0
+		if l.e.owner != nil {
+			lp = l.e.owner.priority
+		}
+		if s.opt.PriorityAging > 0 {
+			lp += int(now.Sub(l.queued) / s.opt.PriorityAging)
+		}
+		if next == nil || lp > prio {
+			prev, next, prio = p, l, lp
+		}
+	}
+	return prev, next
+}
+
+// leastBuildCost returns the lowest cost of the active builds. Called with mu
+// held.
+func (s *scheduler) leastBuildCost() int64 {
+	var cost int64
+	first := true
+	for b := range s.builds {
+		if first || b.cost < cost {
+			cost = b.cost
+			first = false
+		}
+	}
+	return cost
+}
+
+// charge adds the cost of an edge to the build that owns it on the first
+// dispatch of the edge
+func (s *scheduler) charge(e *edge) {
+	if e.charged || e.owner == nil {
+		return
+	}
+	e.charged = true
+	cost := e.edge.Vertex.Options().Cost
+	if cost <= 0 {
+		cost = 1
+	}
+	e.owner.cost += int64(cost)
+}
+
+// redispatchDelay returns how long the dispatch of an edge needs to be delayed
+// to respect the minimum dispatch interval requested for it
+func redispatchDelay(e *edge, now time.Time) time.Duration {
+	if e.dispatchInterval <= 0 || e.isComplete() {
+		return 0
+	}
+	return e.lastDispatch.Add(e.dispatchInterval).Sub(now)
+}
+
+// deferDispatch queues the edge again after a delay. A small random jitter is
+// added so that edges polling with the same interval don't get dispatched in
+// bursts.
+func (s *scheduler) deferDispatch(e *edge, d time.Duration) {
+	if e.redispatchTimer != nil {
+		return
+	}
+	d += time.Duration(rand.Int63n(int64(d)/10 + 1))
+	e.redispatchTimer = s.opt.Clock.AfterFunc(d, func() {
+		s.mu.Lock()
+		e.redispatchTimer = nil
+		s.mu.Unlock()
+		s.signal(e)
+	})
+}
+
+// skipDispatch records that an edge was taken from the queue but not
+// dispatched. An edge that keeps getting skipped is starving, this can only
+// happen because of a bug in the scheduler so it is reported.
+func (s *scheduler) skipDispatch(e *edge) {
+	e.skippedDispatches++
+	if e.skippedDispatches == s.opt.MaxSkippedDispatches {
+		s.edgeLogger(e).Warnf("buildkit scheduler: edge %s %s has been queued %d times without dispatch", e.edge.Vertex.Name(), e.edge.Vertex.Digest(), e.skippedDispatches)
+	}
+}
+
+// admit returns true if the edge can be dispatched now. Edges that haven't
+// been dispatched before are subject to the admission rate and are held back
+// until the next interval if too many new edges were admitted recently.
+func (s *scheduler) admit(e *edge) bool {
+	if s.opt.AdmissionRate <= 0 || e.admitted {
+		return true
+	}
+	now := s.opt.Clock.Now()
+	if now.Sub(s.admitStart) >= s.opt.AdmissionInterval {
+		s.admitStart = now
+		s.admitCount = 0
+	}
+	if s.admitCount < s.opt.AdmissionRate {
+		s.admitCount++
+		e.admitted = true
+		return true
+	}
+	if s.debug {
+		s.edgeLogger(e).Debugf("holding edge %s for admission", e.edge.Vertex.Name())
+	}
+	s.held[e] = struct{}{}
+	if s.heldTimer == nil {
+		s.heldTimer = s.opt.Clock.AfterFunc(s.admitStart.Add(s.opt.AdmissionInterval).Sub(now), s.releaseHeld)
+	}
+	return false
+}
+
+// releaseHeld requeues the edges that were held back by admit
+func (s *scheduler) releaseHeld() {
+	s.mu.Lock()
+	held := s.held
+	s.held = map[*edge]struct{}{}
+	s.heldTimer = nil
+	s.mu.Unlock()
+
+	for e := range held {
+		s.signal(e)
 	}
 }
 
 // dispatch schedules an edge to be processed
 func (s *scheduler) dispatch(e *edge) {
+	hadResult := e.result != nil
+	wasComplete := e.isComplete()
+	timings := &s.stats.dispatch
+	timings.Dispatches++
+	t := s.opt.Clock.Now()
+
+	if s.opt.DispatchGate != nil && !e.isComplete() {
+		if err := s.opt.DispatchGate(e.edge); err != nil {
+			// failed edge completes its incoming requests with the error and
+			// cancels the outgoing ones on unpark
+			e.err = err
+		}
+	}
+	if s.opt.MaxEdgeDepth > 0 && e.depth > s.opt.MaxEdgeDepth && !e.isComplete() {
+		e.err = errors.Wrapf(ErrGraphTooDeep, "%s at depth %d", e.edge.Vertex.Name(), e.depth)
+	}
+
 	inc := make([]pipe.Sender, len(s.incoming[e]))
+	e.dispatchInterval = 0
 	for i, p := range s.incoming[e] {
 		inc[i] = p.Sender
+		if req := p.Sender.Request(); !req.Canceled {
+			if d := req.Payload.(*edgeRequest).minDispatchInterval; d > e.dispatchInterval {
+				e.dispatchInterval = d
+			}
+		}
 	}
+	e.lastDispatch = s.opt.Clock.Now()
 	out := make([]pipe.Receiver, len(s.outgoing[e]))
 	for i, p := range s.outgoing[e] {
 		out[i] = p.Receiver
 	}
 
+	t = s.lap(&timings.Collect, t)
+
 	e.hasActiveOutgoing = false
 	updates := []pipe.Receiver{}
-	for _, p := range out {
+	for i, p := range out {
 		if ok := p.Receive(); ok {
 			updates = append(updates, p)
+			s.traceResponse(s.outgoing[e][i])
+			if p.Status().Completed {
+				if s.pending != nil {
+					s.pending.done(s.outgoing[e][i])
+				}
+				s.recordDepWait(e, s.outgoing[e][i])
+			}
 		}
 		if !p.Status().Completed {
 			e.hasActiveOutgoing = true
@@ -128,16 +966,78 @@ func (s *scheduler) dispatch(e *edge) {
 	}
 
 	pf := &pipeFactory{s: s, e: e}
+	t = s.lap(&timings.Receive, t)
+
+	s.checkOrphaned(e, inc)
+
+	var canceled map[*edgePipe]struct{}
+	if s.opt.OnCancel != nil && !e.isComplete() {
+		canceled = s.canceledOutgoing(e)
+	}
+
+	if s.opt.TraceRecorder != nil {
+		s.opt.TraceRecorder.dispatched(e)
+	}
+
+	var owned map[pipe.Receiver]struct{}
+	if s.opt.VerifyUpdates {
+		owned = e.ownedRequests()
+	}
 
 	// unpark the edge
-	if debugScheduler {
-		debugSchedulerPreUnpark(e, inc, updates, out)
+	if s.debug {
+		debugSchedulerPreUnpark(s.edgeLogger(e), e, inc, updates, out)
 	}
+	execReq := e.execReq
 	e.unpark(inc, updates, out, pf)
-	if debugScheduler {
-		debugSchedulerPostUnpark(e, inc)
+	if s.debug {
+		debugSchedulerPostUnpark(s.edgeLogger(e), e, inc)
+	}
+	if e.execReq != nil && e.execReq != execReq && !e.execCacheLoad {
+		s.emitCacheMiss(e)
+	}
+	if s.opt.VerifyUpdates {
+		if err := verifyUpdates(e, owned, updates); err != nil {
+			if s.schedErrors == nil {
+				panic(err)
+			}
+			s.reportError(e, SchedulerErrorInvariant, err)
+			e.markFailed(pf, err)
+		}
+	}
+	if !hadResult && e.result != nil {
+		s.stats.record(e.execCacheLoad, s.opt.Clock.Now())
+		if s.opt.ResultSize != nil && e.owner != nil {
+			e.retained = s.opt.ResultSize(e.result)
+			e.owner.retained += e.retained
+		}
+		if s.opt.TraceRecorder != nil {
+			s.opt.TraceRecorder.completed(e)
+		}
+		if s.stopping {
+			s.drained = append(s.drained, drainedEdge{edge: e, res: e.result.CloneCachedResult()})
+		}
+		s.tapResult(e)
+	}
+	if !wasComplete && e.isComplete() {
+		if s.opt.WarnUncacheable {
+			s.checkCacheable(e)
+		}
+		s.emitCompletion(e)
+		s.checkReplay(e)
+	}
+	s.touchResult(e)
+	if canceled != nil && e.err != nil {
+		// failed edge cancels the requests it still had open
+		for _, p := range s.outgoing[e] {
+			if _, ok := canceled[p]; !ok && p.Sender.Request().Canceled {
+				s.emitCancel(newEdgeCancelEvent(e, p, CancelReasonFailure))
+			}
+		}
 	}
 
+	t = s.lap(&timings.Unpark, t)
+
 postUnpark:
 	// set up new requests that didn't complete/were added by this run
 	openIncoming := make([]*edgePipe, 0, len(inc))
@@ -164,31 +1064,33 @@ postUnpark:
 		delete(s.outgoing, e)
 	}
 
+	t = s.lap(&timings.Filter, t)
+
 	// if keys changed there might be possiblity for merge with other edge
 	if e.keysDidChange {
-		if k := e.currentIndexKey(); k != nil {
-			// skip this if not at least 1 key per dep
-			origEdge := e.index.LoadOrStore(k, e)
-			if origEdge != nil {
-				logrus.Debugf("merging edge %s to %s\n", e.edge.Vertex.Name(), origEdge.edge.Vertex.Name())
-				if s.mergeTo(origEdge, e) {
-					s.ef.setEdge(e.edge, origEdge)
-				}
-			}
+		if s.opt.DeferredMerges > 0 {
+			s.deferMerge(e)
+		} else {
+			s.tryMerge(e)
 		}
 		e.keysDidChange = false
 	}
+	t = s.lap(&timings.Merge, t)
 
 	// validation to avoid deadlocks/resource leaks:
 	// TODO: if these start showing up in error reports they can be changed
 	// to error the edge instead. They can only appear from algorithm bugs in
 	// unpark(), not for any external input.
 	if len(openIncoming) > 0 && len(openOutgoing) == 0 {
-		e.markFailed(pf, errors.New("buildkit scheduler error: return leaving incoming open. Please report this with BUILDKIT_SCHEDULER_DEBUG=1"))
+		err := errors.New("buildkit scheduler error: return leaving incoming open. Please report this with BUILDKIT_SCHEDULER_DEBUG=1")
+		s.reportError(e, SchedulerErrorInvariant, err)
+		e.markFailed(pf, err)
 		goto postUnpark
 	}
 	if len(openIncoming) == 0 && len(openOutgoing) > 0 {
-		e.markFailed(pf, errors.New("buildkit scheduler error: return leaving outgoing open. Please report this with BUILDKIT_SCHEDULER_DEBUG=1"))
+		err := errors.New("buildkit scheduler error: return leaving outgoing open. Please report this with BUILDKIT_SCHEDULER_DEBUG=1")
+		s.reportError(e, SchedulerErrorInvariant, err)
+		e.markFailed(pf, err)
 		goto postUnpark
 	}
 }
@@ -197,7 +1099,11 @@ postUnpark:
 func (s *scheduler) signal(e *edge) {
 	s.muQ.Lock()
 	if _, ok := s.waitq[e]; !ok {
-		d := &dispatcher{e: e}
+		if len(s.waitq) == 0 {
+			// an idle loop is only late from the time it has work
+			s.beat()
+		}
+		d := &dispatcher{e: e, queued: s.opt.Clock.Now()}
 		if s.last == nil {
 			s.next = d
 		} else {
@@ -205,6 +1111,7 @@ func (s *scheduler) signal(e *edge) {
 		}
 		s.last = d
 		s.waitq[e] = struct{}{}
+		s.stats.signals++
 		s.cond.Signal()
 	}
 	s.muQ.Unlock()
@@ -212,47 +1119,451 @@ func (s *scheduler) signal(e *edge) {
 
 // build evaluates edge into a result
 func (s *scheduler) build(ctx context.Context, edge Edge) (CachedResult, error) {
+	res, _, err := s.buildWithCacheKey(ctx, edge, buildOpt{})
+	return res, err
+}
+
+// acceptBuild returns an error if the scheduler doesn't take new builds.
+// Called with the scheduler locked.
+func (s *scheduler) acceptBuild(opt buildOpt) error {
+	if s.isStopped() {
+		return errors.WithStack(ErrSchedulerStopped)
+	}
+	if s.stopping && opt.request != nil {
+		return errors.WithStack(ErrStopping)
+	}
+	return nil
+}
+
+// hasReusableResult returns true if e has a result that is returned to new
+// builds without a dispatch, because its keys didn't change since it
+// completed
+func hasReusableResult(e *edge) bool {
+	return e.result != nil && e.err == nil && e.state == edgeStatusComplete && !e.keysDidChange
+}
+
+// buildOpt defines optional parameters for a build
+type buildOpt struct {
+	// request is the original request the edge was loaded from
+	request *BuildRequest
+	// noClone returns the result of the edge without cloning it
+	noClone bool
+}
+
+// buildWithCacheKey evaluates edge into a result and returns the cache key of
+// the completed edge that produced the result
+func (s *scheduler) buildWithCacheKey(ctx context.Context, edge Edge, opt buildOpt) (CachedResult, ExportableCacheKey, error) {
+	// edges that already have a result return it without a dispatch, so
+	// they don't wait for capacity or count against the pipe limits
+	s.mu.Lock()
+	if s.acceptBuild(opt) == nil {
+		if e := s.ef.lookupEdge(edge); e != nil && hasReusableResult(e) {
+			s.touchResult(e)
+			res, key, err := s.buildResult(e, &e.edgeState, opt)
+			s.mu.Unlock()
+			return res, key, err
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.waitCapacity(ctx); err != nil {
+		return nil, ExportableCacheKey{}, err
+	}
+
 	s.mu.Lock()
+	if err := s.acceptBuild(opt); err != nil {
+		s.mu.Unlock()
+		return nil, ExportableCacheKey{}, err
+	}
 	e := s.ef.getEdge(edge)
 	if e == nil {
 		s.mu.Unlock()
-		return nil, errors.Errorf("invalid request %v for build", edge)
+		if err := s.checkEdgeLimit(); err != nil {
+			return nil, ExportableCacheKey{}, err
+		}
+		return nil, ExportableCacheKey{}, errors.Errorf("invalid request %v for build", edge)
 	}
 
-	wait := make(chan struct{})
+	// the edge may have completed while waiting for capacity
+	if hasReusableResult(e) {
+		s.touchResult(e)
+		res, key, err := s.buildResult(e, &e.edgeState, opt)
+		s.mu.Unlock()
+		return res, key, err
+	}
 
-	var p *pipe.Pipe
-	p = s.newPipe(e, nil, pipe.Request{Payload: &edgeRequest{desiredState: edgeStatusComplete}})
-	p.OnSendCompletion = func() {
-		p.Receiver.Receive()
-		if p.Receiver.Status().Completed {
-			close(wait)
-		}
+	if err := s.checkPipeLimit(e, nil); err != nil {
+		s.mu.Unlock()
+		return nil, ExportableCacheKey{}, err
+	}
+	p, wait := s.newRequestPipe(e, edgeStatusComplete)
+	b := &activeBuild{edge: e, pipe: p, labels: buildLabels(ctx), request: opt.request, priority: buildPriority(ctx), requestID: s.requestID(ctx), ctx: ctx, nonShareable: isNonShareableBuild(ctx), done: make(chan struct{})}
+	// new builds start from the least used cost so they don't get to run
+	// ahead of the existing builds for the cost they missed
+	b.cost = s.leastBuildCost()
+	if e.owner == nil {
+		e.owner = b
 	}
+	s.builds[b] = struct{}{}
 	s.mu.Unlock()
 
+	defer func() {
+		s.mu.Lock()
+		delete(s.builds, b)
+		s.mu.Unlock()
+		close(b.done)
+	}()
+
+	if g := cancelGroup(ctx); g != nil {
+		defer g.join(func(err error) {
+			s.mu.Lock()
+			if _, ok := s.builds[b]; ok && b.cancelErr == nil {
+				s.cancelBuild(b, CancelReasonGroup, err)
+			}
+			s.mu.Unlock()
+		})()
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	drain, _ := ctx.Value(cacheOnCancelKey{}).(bool)
+
 	go func() {
-		<-ctx.Done()
-		p.Receiver.Cancel()
+		select {
+		case <-ctx.Done():
+			s.emitCancel(CancelEvent{Edge: edge, EdgeID: e.id, Reason: contextCancelReason(ctx), Labels: b.labels, Build: b.request, RequestID: b.requestID})
+			if drain {
+				s.mu.Lock()
+				p.Receiver.Request().(*edgeRequest).drain = true
+				s.mu.Unlock()
+			}
+			p.Receiver.Cancel()
+		case <-wait:
+		}
 	}()
 
 	<-wait
+	s.fillBuildInfo(b)
 
 	if err := p.Receiver.Status().Err; err != nil {
-		return nil, err
+		s.mu.Lock()
+		cancelErr := b.cancelErr
+		s.mu.Unlock()
+		if cancelErr != nil {
+			return nil, ExportableCacheKey{}, errors.WithStack(cancelErr)
+		}
+		return nil, ExportableCacheKey{}, err
+	}
+	return s.buildResult(e, p.Receiver.Status().Value, opt)
+}
+
+// extractResult returns the result from the value a build request completed
+// with. The value is *edgeState unless a ResultExtractor is set.
+func (s *scheduler) extractResult(v interface{}) (CachedResult, error) {
+	if s.opt.ResultExtractor != nil {
+		return s.opt.ResultExtractor(v)
+	}
+	st, ok := v.(*edgeState)
+	if !ok {
+		return nil, errors.Errorf("invalid build response %T", v)
+	}
+	if st.result == nil {
+		return nil, nil
+	}
+	return st.result, nil
+}
+
+// recordDepWait adds the time the completed request p took to the wait time of
+// the dependency of e it was made to
+func (s *scheduler) recordDepWait(e *edge, p *edgePipe) {
+	if p.Target == nil {
+		return
+	}
+	for _, d := range e.deps {
+		if d.req == p.Receiver {
+			d.wait += s.opt.Clock.Now().Sub(p.created)
+			return
+		}
+	}
+}
+
+// buildResult returns a clone of the result of a build and its cache key. If
+// the result can't be cloned the build fails, unless UnsafeCloneFallback is
+// set.
+func (s *scheduler) buildResult(e *edge, v interface{}, opt buildOpt) (CachedResult, ExportableCacheKey, error) {
+	res, err := s.extractResult(v)
+	if err != nil {
+		return nil, ExportableCacheKey{}, err
+	}
+	if res == nil {
+		return nil, ExportableCacheKey{}, errors.Errorf("build of %s completed without a result", e.edge.Vertex.Name())
+	}
+	var key ExportableCacheKey
+	if keys := res.CacheKeys(); len(keys) > 0 {
+		key = keys[0]
+	}
+	shared, ok := res.(*SharedCachedResult)
+	if opt.noClone || !ok {
+		// results of a ResultExtractor that are not shared are owned by the
+		// caller
+		return res, key, nil
+	}
+	cr, err := shared.tryCloneCachedResult()
+	if err != nil {
+		if !s.opt.UnsafeCloneFallback {
+			return nil, ExportableCacheKey{}, errors.Wrapf(err, "failed to clone result of %s", e.edge.Vertex.Name())
+		}
+		s.edgeLogger(e).Warnf("returning shared result of %s that failed to clone: %v", e.edge.Vertex.Name(), err)
+		return res, key, nil
+	}
+	return cr, key, nil
+}
+
+// WaitForState drives edge to state and waits until the state has been
+// reached. Unlike build the result of the edge is not returned. Waiting for
+// EdgeStateCacheSlow resolves the cache keys of the edge without executing
+// its operation.
+func (s *scheduler) WaitForState(ctx context.Context, edge Edge, state EdgeState) error {
+	if !state.valid() {
+		return errors.Errorf("invalid edge state %s", state)
+	}
+	_, err := s.waitForState(ctx, edge, edgeStatusType(state))
+	return err
+}
+
+// waitForState is WaitForState that also returns the edge the request was
+// sent to
+func (s *scheduler) waitForState(ctx context.Context, edge Edge, state edgeStatusType) (*edge, error) {
+	s.mu.Lock()
+	if s.isStopped() {
+		s.mu.Unlock()
+		return nil, errors.WithStack(ErrSchedulerStopped)
+	}
+	e := s.ef.getEdge(edge)
+	if e == nil {
+		s.mu.Unlock()
+		if err := s.checkEdgeLimit(); err != nil {
+			return nil, err
+		}
+		return nil, errors.Errorf("invalid request %v for wait", edge)
+	}
+	p, wait := s.newRequestPipe(e, state)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.emitCancel(CancelEvent{Edge: edge, EdgeID: e.id, Reason: contextCancelReason(ctx)})
+			p.Receiver.Cancel()
+		case <-wait:
+		}
+	}()
+
+	<-wait
+
+	return e, p.Receiver.Status().Err
+}
+
+// newRequestPipe creates a request for edge that doesn't come from another
+// edge. The returned channel is closed when the request has completed.
+func (s *scheduler) newRequestPipe(e *edge, state edgeStatusType) (*pipe.Pipe, <-chan struct{}) {
+	wait := make(chan struct{})
+	var closeWait sync.Once
+
+	var p *pipe.Pipe
+	p = s.newPipe(e, nil, pipe.Request{Payload: &edgeRequest{desiredState: state}})
+	p.OnSendCompletion = func() {
+		p.Receiver.Receive()
+		// pipes may be re-routed on merges so completion can be sent more
+		// than once
+		if p.Receiver.Status().Completed {
+			closeWait.Do(func() { close(wait) })
+		}
+	}
+	return p, wait
+}
+
+// CancelByLabel cancels all running builds that have label key set to value
+// and returns the number of canceled builds. Only the requests made by the
+// matching builds are canceled. Edges that are shared with other builds keep
+// running for them.
+func (s *scheduler) CancelByLabel(key, value string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for b := range s.builds {
+		if v, ok := b.labels[key]; ok && v == value {
+			s.cancelBuild(b, CancelReasonExplicit, nil)
+			n++
+		}
+	}
+	return n
+}
+
+// CancelAll cancels all running builds. The builds fail with err, or with
+// context.Canceled if err is nil. The scheduler keeps running and accepts new
+// builds. Returns the number of canceled builds.
+func (s *scheduler) CancelAll(err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for b := range s.builds {
+		if b.cancelErr == nil {
+			s.cancelBuild(b, CancelReasonExplicit, err)
+			n++
+		}
+	}
+	return n
+}
+
+// SetPriority changes the priority of the running builds matching req for
+// QueuePolicyPriority. Builds match if they were started by the same job for
+// the same edge. The new priority applies to all queued and future edges owned
+// by the builds. Returns the number of updated builds.
+func (s *scheduler) SetPriority(req BuildRequest, prio int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	builds := s.matchBuilds(req)
+	for _, b := range builds {
+		b.priority = prio
+	}
+	return len(builds)
+}
+
+// injectResult completes an edge with res without computing its cache key or
+// running its operation. Dependants that requested the edge are signaled as
+// if unpark had produced the result. The scheduler takes ownership of res if
+// no error is returned.
+func (s *scheduler) injectResult(edge Edge, res CachedResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.getEdge(edge)
+	if e == nil {
+		if err := s.checkEdgeLimit(); err != nil {
+			return err
+		}
+		return errors.Errorf("failed to get edge %s", edge.Vertex.Name())
+	}
+	if e.isComplete() {
+		return errors.Wrapf(ErrEdgeComplete, "%s", edge.Vertex.Name())
+	}
+	if e.execReq != nil {
+		// the result of the running operation would replace the injected one
+		return errors.Errorf("edge %s is already loading its result", edge.Vertex.Name())
+	}
+	e.result = NewSharedCachedResult(res)
+	e.state = edgeStatusComplete
+	s.signal(e)
+	return nil
+}
+
+// matchBuilds returns the running builds that were started by the same job for
+// the same edge as req
+func (s *scheduler) matchBuilds(req BuildRequest) []*activeBuild {
+	var out []*activeBuild
+	for b := range s.builds {
+		if b.request == nil || b.request.JobID != req.JobID {
+			continue
+		}
+		if b.request.Edge.Index != req.Edge.Index || b.request.Edge.Vertex.Digest() != req.Edge.Vertex.Digest() {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// cancelBuild cancels the request of a build. If err is set the build fails
+// with it instead of the error of the canceled request.
+func (s *scheduler) cancelBuild(b *activeBuild, reason CancelReason, err error) {
+	if err != nil {
+		b.cancelErr = err
+	}
+	s.emitCancel(CancelEvent{Edge: b.edge.edge, EdgeID: b.edge.id, Reason: reason, Labels: b.labels, Build: b.request, RequestID: b.requestID})
+	b.pipe.Receiver.Cancel()
+}
+
+// waitCapacity checks that the dispatch queue is not over the high-water mark.
+// Depending on the configuration, it either fails or waits for the queue to
+// drain if it is.
+func (s *scheduler) waitCapacity(ctx context.Context) error {
+	if s.opt.MaxQueueLength <= 0 {
+		return nil
+	}
+	for {
+		s.muQ.Lock()
+		if len(s.waitq) <= s.opt.MaxQueueLength {
+			s.muQ.Unlock()
+			return nil
+		}
+		if !s.opt.BlockWhenOverloaded {
+			s.muQ.Unlock()
+			return errors.WithStack(ErrSchedulerOverloaded)
+		}
+		if s.capacity == nil {
+			s.capacity = make(chan struct{})
+		}
+		ch := s.capacity
+		s.muQ.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// raiseDepth sets the depth of e to depth if that is deeper and passes the
+// change on to the inputs e has requests to, so that the depth of an edge is
+// the longest chain from any of its requesters. Inputs that are pushed over
+// SchedulerOpt.MaxEdgeDepth are queued so that their dispatch fails them.
+func (s *scheduler) raiseDepth(e *edge, depth int) {
+	type raise struct {
+		e     *edge
+		depth int
+	}
+	stack := []raise{{e, depth}}
+	for len(stack) > 0 {
+		r := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if r.depth <= r.e.depth {
+			continue
+		}
+		r.e.depth = r.depth
+		if r.e != e && s.opt.MaxEdgeDepth > 0 && r.depth > s.opt.MaxEdgeDepth {
+			s.signal(r.e)
+		}
+		for _, p := range s.outgoing[r.e] {
+			if p.Target != nil && !p.Receiver.Status().Completed {
+				stack = append(stack, raise{p.Target, r.depth + 1})
+			}
+		}
 	}
-	return p.Receiver.Status().Value.(*edgeState).result.CloneCachedResult(), nil
 }
 
 // newPipe creates a new request pipe between two edges
 func (s *scheduler) newPipe(target, from *edge, req pipe.Request) *pipe.Pipe {
 	p := &edgePipe{
-		Pipe:   pipe.New(req),
-		Target: target,
-		From:   from,
+		Pipe:    pipe.New(req),
+		Target:  target,
+		From:    from,
+		created: s.opt.Clock.Now(),
+	}
+
+	if from != nil {
+		s.raiseDepth(target, from.depth+1)
+	}
+	if from != nil && target.owner == nil {
+		target.owner = from.owner
 	}
 
 	s.signal(target)
@@ -270,13 +1581,144 @@ func (s *scheduler) newPipe(target, from *edge, req pipe.Request) *pipe.Pipe {
 		defer p.mu.Unlock()
 		s.signal(p.Target)
 	}
+	s.traceRequest(p)
 	return p.Pipe
 }
 
+// pruneIndex removes the complete edges without open requests from the index
+// for merging edges
+func (s *scheduler) pruneIndex() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pruneIndexLocked()
+}
+
+func (s *scheduler) pruneIndexLocked() int {
+	return s.ef.pruneIndex(func(e *edge) bool {
+		return e.isComplete() && len(s.incoming[e]) == 0 && len(s.outgoing[e]) == 0
+	})
+}
+
+// checkPipeLimit returns an error if a new request from edge from to target
+// would exceed SchedulerOpt.MaxEdgePipes
+func (s *scheduler) checkPipeLimit(target, from *edge) error {
+	if s.opt.MaxEdgePipes <= 0 {
+		return nil
+	}
+	if len(s.incoming[target]) >= s.opt.MaxEdgePipes {
+		return errors.Wrapf(ErrTooManyPipes, "%d incoming requests for %s", len(s.incoming[target]), target.edge.Vertex.Name())
+	}
+	if from != nil && len(s.outgoing[from]) >= s.opt.MaxEdgePipes {
+		return errors.Wrapf(ErrTooManyPipes, "%d outgoing requests from %s", len(s.outgoing[from]), from.edge.Vertex.Name())
+	}
+	return nil
+}
+
+// reserveEdge counts a new edge. Returns false if SchedulerOpt.MaxEdges edges
+// are already loaded.
+func (s *scheduler) reserveEdge() bool {
+	for {
+		n := atomic.LoadInt64(&s.liveEdges)
+		if s.opt.MaxEdges > 0 && n >= int64(s.opt.MaxEdges) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.liveEdges, n, n+1) {
+			return true
+		}
+	}
+}
+
+// unloadEdge stops counting an edge reserved with reserveEdge
+func (s *scheduler) unloadEdge() {
+	atomic.AddInt64(&s.liveEdges, -1)
+}
+
+// checkEdgeLimit returns ErrTooManyEdges if no new edge can be loaded
+func (s *scheduler) checkEdgeLimit() error {
+	if n := atomic.LoadInt64(&s.liveEdges); s.opt.MaxEdges > 0 && n >= int64(s.opt.MaxEdges) {
+		return errors.Wrapf(ErrTooManyEdges, "%d edges loaded", n)
+	}
+	return nil
+}
+
+// newErroredPipe creates a request from edge from that has already failed with
+// err. The edge receives the error on its next dispatch.
+func (s *scheduler) newErroredPipe(from *edge, req *edgeRequest, err error) pipe.Receiver {
+	return s.newFinalizedPipe(from, req, &edgeState{}, err)
+}
+
+// newFinalizedPipe creates a request pipe that is already completed with the
+// state and error
+func (s *scheduler) newFinalizedPipe(from *edge, req *edgeRequest, state *edgeState, err error) pipe.Receiver {
+	p := &edgePipe{
+		Pipe: pipe.New(pipe.Request{Payload: req}),
+		From: from,
+	}
+	p.OnSendCompletion = func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		s.signal(p.From)
+	}
+	s.outgoing[from] = append(s.outgoing[from], p)
+	p.Sender.Finalize(state, err)
+	return p.Receiver
+}
+
+// resolveInput returns a completed pipe for the input request if
+// SchedulerOpt.InputResolver supplies a result for the input
+func (s *scheduler) resolveInput(from *edge, ee Edge, req *edgeRequest) (pipe.Receiver, bool) {
+	if s.opt.InputResolver == nil || s.isStopped() {
+		return nil, false
+	}
+	res, ok := s.opt.InputResolver(ee)
+	if !ok || res == nil {
+		return nil, false
+	}
+	keys := res.CacheKeys()
+	if len(keys) == 0 {
+		s.edgeLogger(from).Warnf("ignoring resolved result without cache keys for input %s", ee.Vertex.Name())
+		res.Release(context.TODO())
+		return nil, false
+	}
+	shared := NewSharedCachedResult(res)
+	from.resolvedInputs = append(from.resolvedInputs, shared)
+	if s.debug {
+		s.opt.Logger.Debugf("> resolvedInput %s", ee.Vertex.Name())
+	}
+	return s.newFinalizedPipe(from, req, &edgeState{
+		state:  edgeStatusComplete,
+		result: shared,
+		keys:   keys,
+	}, nil), true
+}
+
 // newRequestWithFunc creates a new request pipe that invokes a async function
 func (s *scheduler) newRequestWithFunc(e *edge, f func(context.Context) (interface{}, error)) pipe.Receiver {
+	var p *edgePipe
+	if s.opt.FuncRequestTTL > 0 {
+		f = s.withRequestTTL(e, f)
+	}
+	if s.opt.KeepFinishedWorkOnMerge {
+		fn := f
+		f = func(ctx context.Context) (interface{}, error) {
+			v, err := fn(ctx)
+			if err == nil {
+				atomic.StoreInt32(&p.finished, 1)
+			}
+			return v, err
+		}
+	}
+	if s.pending != nil {
+		fn := f
+		f = func(ctx context.Context) (interface{}, error) {
+			// counted before the result is sent so that it isn't received
+			// before it is counted
+			defer s.pending.add(p)
+			return fn(ctx)
+		}
+	}
 	pp, start := pipe.NewWithFunction(f)
-	p := &edgePipe{
+	p = &edgePipe{
 		Pipe: pp,
 		From: e,
 	}
@@ -286,15 +1728,80 @@ func (s *scheduler) newRequestWithFunc(e *edge, f func(context.Context) (interfa
 		s.signal(p.From)
 	}
 	s.outgoing[e] = append(s.outgoing[e], p)
-	go start()
+	locks := exclusiveLockNames(e)
+	if s.sem == nil && s.pending == nil && len(locks) == 0 {
+		go start()
+		return p.Receiver
+	}
+	var canceled chan struct{}
+	if s.pending != nil {
+		canceled = make(chan struct{})
+		var once sync.Once
+		onReceiveCompletion := pp.OnReceiveCompletion
+		pp.OnReceiveCompletion = func() {
+			onReceiveCompletion()
+			if pp.Sender.Request().Canceled {
+				once.Do(func() { close(canceled) })
+			}
+		}
+	}
+	// pending results and locks are acquired before the concurrency limit so
+	// that requests waiting for them don't hold on to the limit
+	switch {
+	case s.pending != nil:
+		atomic.StoreInt32(&p.waiting, waitingOnReceivers)
+	case len(locks) > 0:
+		atomic.StoreInt32(&p.waiting, waitingOnLock)
+	default:
+		atomic.StoreInt32(&p.waiting, waitingOnConcurrency)
+	}
+	go func() {
+		if s.pending != nil && !s.pending.wait(canceled) {
+			atomic.StoreInt32(&p.waiting, 0)
+			pp.Sender.Finalize(nil, context.Canceled)
+			return
+		}
+		if len(locks) > 0 {
+			atomic.StoreInt32(&p.waiting, waitingOnLock)
+			release := s.locks.acquire(locks)
+			defer release()
+		}
+		if s.sem != nil {
+			s.acquireSlot(p)
+			defer func() { <-s.sem }()
+		}
+		atomic.StoreInt32(&p.waiting, 0)
+		start()
+	}()
 	return p.Receiver
 }
 
 // mergeTo merges the state from one edge to another. source edge is discarded.
+// The scheduler lock is released while the merge is verified with
+// DefinitionDigest.
 func (s *scheduler) mergeTo(target, src *edge) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if s.opt.MergeTimeout > 0 {
+		t := s.opt.Clock.AfterFunc(s.opt.MergeTimeout, cancel)
+		defer t.Stop()
+	}
+
 	if !target.edge.Vertex.Options().IgnoreCache && src.edge.Vertex.Options().IgnoreCache {
 		return false
 	}
+	if err := checkMergeCompatible(target, src); err != nil {
+		s.edgeLogger(src).Warnf("refusing to merge edge %s to %s: %v", src.edge.Vertex.Name(), target.edge.Vertex.Name(), err)
+		return false
+	}
+	if err := s.verifyDefinitions(ctx, target, src); err != nil {
+		if errors.Is(err, ErrMergeTimeout) || errors.Is(err, errMergeStale) {
+			s.edgeLogger(src).Warnf("abandoning merge of edge %s to %s: %v", src.edge.Vertex.Name(), target.edge.Vertex.Name(), err)
+			return false
+		}
+		s.edgeLogger(src).Errorf("refusing to merge edge %s to %s: %v", src.edge.Vertex.Name(), target.edge.Vertex.Name(), err)
+		return false
+	}
 	for _, inc := range s.incoming[src] {
 		inc.mu.Lock()
 		inc.Target = target
@@ -307,36 +1814,254 @@ func (s *scheduler) mergeTo(target, src *edge) bool {
 		out.From = target
 		s.outgoing[target] = append(s.outgoing[target], out)
 		out.mu.Unlock()
+		if s.adoptFinishedExec(target, src, out) {
+			continue
+		}
+		s.emitCancel(newEdgeCancelEvent(src, out, CancelReasonMerge))
 		out.Receiver.Cancel()
 	}
 
 	delete(s.incoming, src)
 	delete(s.outgoing, src)
+	s.raiseDepth(target, src.depth)
+	if target.owner == nil {
+		target.owner = src.owner
+	}
+	target.mergedCount += src.mergedCount + 1
+	s.markMergedBuilds(src)
+	if s.opt.TraceRecorder != nil {
+		s.opt.TraceRecorder.merged(src, target)
+	}
 	s.signal(target)
 
 	for i, d := range src.deps {
+		sel := src.cacheMap.Deps[i].Selector
+		if s.opt.MergeSelector != nil {
+			sel = s.opt.MergeSelector(target.edge, src.edge, Index(i), sel)
+		}
 		for _, k := range d.keys {
-			target.secondaryExporters = append(target.secondaryExporters, expDep{i, CacheKeyWithSelector{CacheKey: k, Selector: src.cacheMap.Deps[i].Selector}})
+			target.addSecondaryExporter(expDep{i, CacheKeyWithSelector{CacheKey: k, Selector: sel}})
 		}
 		if d.slowCacheKey != nil {
-			target.secondaryExporters = append(target.secondaryExporters, expDep{i, CacheKeyWithSelector{CacheKey: *d.slowCacheKey}})
+			target.addSecondaryExporter(expDep{i, CacheKeyWithSelector{CacheKey: *d.slowCacheKey}})
 		}
 		if d.result != nil {
 			for _, dk := range d.result.CacheKeys() {
-				target.secondaryExporters = append(target.secondaryExporters, expDep{i, CacheKeyWithSelector{CacheKey: dk, Selector: src.cacheMap.Deps[i].Selector}})
+				target.addSecondaryExporter(expDep{i, CacheKeyWithSelector{CacheKey: dk, Selector: sel}})
+			}
+		}
+	}
+
+	mergeCacheSources(target.op, src.op)
+	target.mergeMeta(src)
+	s.stats.merges++
+
+	return true
+}
+
+// checkMergeCompatible verifies that the dependencies of src line up with the
+// dependencies of target. Secondary exporters are recorded on target by the
+// dependency index of src so both edges need the same dependency structure.
+func checkMergeCompatible(target, src *edge) error {
+	if len(src.deps) != len(target.deps) {
+		return errors.Errorf("dependency count mismatch: %d != %d", len(src.deps), len(target.deps))
+	}
+	if len(src.deps) == 0 {
+		return nil
+	}
+	if src.cacheMap == nil {
+		return errors.Errorf("source edge has no cache map")
+	}
+	if len(src.cacheMap.Deps) != len(src.deps) {
+		return errors.Errorf("source cache map has %d deps for %d dependencies", len(src.cacheMap.Deps), len(src.deps))
+	}
+	if target.cacheMap != nil && len(target.cacheMap.Deps) != len(src.cacheMap.Deps) {
+		return errors.Errorf("cache map dependency count mismatch: %d != %d", len(src.cacheMap.Deps), len(target.cacheMap.Deps))
+	}
+	return nil
+}
+
+// tryMerge merges e to an edge with a matching cache key if one exists. If
+// the merge is refused it is not attempted again until the index key of e
+// changes, even if the keys of e changed in a way that doesn't affect it.
+func (s *scheduler) tryMerge(e *edge) {
+	// non-shareable edges are not added to the index so they never merge
+	// to another edge or become a merge target
+	if k := s.indexKey(e); k != nil && !isNonShareable(e) {
+		if sameIndexKey(e.refusedMergeKey, k) {
+			return
+		}
+		// skip this if not at least 1 key per dep
+		origEdge := e.index.LoadOrStore(k, e)
+		if origEdge == nil {
+			s.loadRestoredResult(e, k)
+		}
+		if origEdge != nil {
+			if s.preferIncoming(origEdge, e) && s.mergeTo(e, origEdge) {
+				s.edgeLogger(e).Debugf("merging edge %s to %s\n", origEdge.edge.Vertex.Name(), e.edge.Vertex.Name())
+				e.index.Replace(origEdge, e)
+				s.ef.setEdge(origEdge.edge, e)
+				return
 			}
+			s.edgeLogger(e).Debugf("merging edge %s to %s\n", e.edge.Vertex.Name(), origEdge.edge.Vertex.Name())
+			if s.mergeTo(origEdge, e) {
+				s.ef.setEdge(e.edge, origEdge)
+			} else {
+				e.refusedMergeKey = k
+			}
+		}
+	}
+}
+
+// checkCacheable logs a warning for WarnUncacheable if e completed with a
+// result without a cache key
+func (s *scheduler) checkCacheable(e *edge) {
+	if e.err != nil || e.result == nil || IsSkipped(e.result) || isIgnoreCache(e) || isNonShareable(e) {
+		return
+	}
+	if e.cacheMap != nil && s.indexKey(e) != nil {
+		return
+	}
+	s.stats.uncacheable++
+	s.edgeLogger(e).Warnf("edge %s completed without a cache key, its result can't be reused", e.edge.Vertex.Name())
+}
+
+// indexKey returns the key e is added to the index with, following
+// SchedulerOpt.IndexKeyPolicy. Returns nil if a dependency has no keys yet.
+func (s *scheduler) indexKey(e *edge) *CacheKey {
+	k := e.currentIndexKey()
+	if k == nil || s.opt.IndexKeyPolicy != IndexKeyPolicyFirst {
+		return k
+	}
+	for i, keys := range k.deps {
+		if len(keys) > 1 {
+			k.deps[i] = keys[:1]
 		}
 	}
+	return k
+}
 
-	// TODO(tonistiigi): merge cache providers
+// preferIncoming returns true if the existing edge in the index should be
+// merged to the incoming edge e, see SchedulerOpt.PreferMergeTarget
+func (s *scheduler) preferIncoming(existing, e *edge) bool {
+	if s.opt.PreferMergeTarget == nil {
+		return false
+	}
+	for _, ed := range []*edge{existing, e} {
+		if ed.isComplete() || ed.execReq != nil {
+			return false
+		}
+	}
+	return s.opt.PreferMergeTarget(existing.edge, e.edge)
+}
 
+// sameIndexKey returns true if the index keys are built from the same
+// dependency keys
+func sameIndexKey(a, b *CacheKey) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.Digest() != b.Digest() || a.Output() != b.Output() || len(a.deps) != len(b.deps) {
+		return false
+	}
+	for i := range a.deps {
+		if len(a.deps[i]) != len(b.deps[i]) {
+			return false
+		}
+		for j, k := range a.deps[i] {
+			if k.Selector != b.deps[i][j].Selector || k.CacheKey.CacheKey != b.deps[i][j].CacheKey.CacheKey {
+				return false
+			}
+		}
+	}
 	return true
 }
 
+// verifyDefinitions checks that the definitions of the vertexes of the merged
+// edges match if DefinitionDigest is set. Called with the scheduler locked,
+// the lock is released while DefinitionDigest runs and the edges are checked
+// again before returning.
+func (s *scheduler) verifyDefinitions(ctx context.Context, target, src *edge) error {
+	if s.opt.DefinitionDigest == nil {
+		return nil
+	}
+	loaded := s.loadedEdges(target, src)
+	tv, sv := target.edge.Vertex, src.edge.Vertex
+
+	s.mu.Unlock()
+	var err error
+	if s.opt.MergeTimeout <= 0 {
+		err = s.compareDefinitions(ctx, tv, sv)
+	} else {
+		// a DefinitionDigest that doesn't return on cancellation keeps
+		// running in the background but its result is ignored
+		done := make(chan error, 1)
+		go func() {
+			done <- s.compareDefinitions(ctx, tv, sv)
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+		}
+	}
+	s.mu.Lock()
+
+	if ctx.Err() != nil {
+		return errors.Wrapf(ErrMergeTimeout, "merge took longer than %s", s.opt.MergeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	for i, e := range s.loadedEdges(target, src) {
+		if e != loaded[i] {
+			return errors.WithStack(errMergeStale)
+		}
+	}
+	return nil
+}
+
+// loadedEdges returns the edges loaded for the Edges of target and src, which
+// differ from target and src once they are merged or released
+func (s *scheduler) loadedEdges(target, src *edge) [2]*edge {
+	if s.ef == nil {
+		return [2]*edge{target, src}
+	}
+	return [2]*edge{s.ef.lookupEdge(target.edge), s.ef.lookupEdge(src.edge)}
+}
+
+// compareDefinitions returns ErrCacheKeyCollision if the definition digests of
+// the vertexes differ
+func (s *scheduler) compareDefinitions(ctx context.Context, target, src Vertex) error {
+	dt, err := s.opt.DefinitionDigest(ctx, target)
+	if err != nil {
+		return errors.Wrapf(err, "failed to digest definition of %s", target.Name())
+	}
+	ds, err := s.opt.DefinitionDigest(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to digest definition of %s", src.Name())
+	}
+	if dt != ds {
+		return errors.Wrapf(ErrCacheKeyCollision, "definition %s != %s", ds, dt)
+	}
+	return nil
+}
+
 // edgeFactory allows access to the edges from a shared graph
 type edgeFactory interface {
 	getEdge(Edge) *edge
+	// lookupEdge returns the loaded edge for an Edge, or the edge it was
+	// merged to. Unlike getEdge it doesn't create a missing edge and returns
+	// nil instead, so it can be used for queries without side effects.
+	lookupEdge(Edge) *edge
 	setEdge(Edge, *edge)
+	// releaseEdge drops a completed edge so that a new edge is created for
+	// the next request to it. Returns false if the edge is still in use.
+	releaseEdge(*edge) bool
+	// pruneIndex removes the edges for which remove returns true from the
+	// index for merging edges and returns the number of removed entries
+	pruneIndex(remove func(*edge) bool) int
+	// mergeIndex returns the index for merging edges, nil if there is none
+	mergeIndex() *edgeIndex
 }
 
 type pipeFactory struct {
@@ -345,46 +2070,89 @@ type pipeFactory struct {
 }
 
 func (pf *pipeFactory) NewInputRequest(ee Edge, req *edgeRequest) pipe.Receiver {
+	if r, ok := pf.s.resolveInput(pf.e, ee, req); ok {
+		return r
+	}
 	target := pf.s.ef.getEdge(ee)
 	if target == nil {
+		if err := pf.s.checkEdgeLimit(); err != nil {
+			return pf.s.newErroredPipe(pf.e, req, err)
+		}
 		panic("failed to get edge") // TODO: return errored pipe
 	}
+	if pf.s.isStopped() {
+		return pf.s.newErroredPipe(pf.e, req, errors.WithStack(ErrSchedulerStopped))
+	}
+	if err := pf.s.checkPipeLimit(target, pf.e); err != nil {
+		return pf.s.newErroredPipe(pf.e, req, err)
+	}
 	p := pf.s.newPipe(target, pf.e, pipe.Request{Payload: req})
-	if debugScheduler {
-		logrus.Debugf("> newPipe %s %p desiredState=%s", ee.Vertex.Name(), p, req.desiredState)
+	if pf.s.debug {
+		pf.s.opt.Logger.Debugf("> newPipe %s %p desiredState=%s", ee.Vertex.Name(), p, req.desiredState)
 	}
 	return p.Receiver
 }
 
-func (pf *pipeFactory) NewFuncRequest(f func(context.Context) (interface{}, error)) pipe.Receiver {
-	p := pf.s.newRequestWithFunc(pf.e, f)
-	if debugScheduler {
-		logrus.Debugf("> newFunc %p", p)
+// isRunning returns true if the function request r of the edge has started
+func (pf *pipeFactory) isRunning(r pipe.Receiver) bool {
+	for _, p := range pf.s.outgoing[pf.e] {
+		if p.Receiver == r {
+			return atomic.LoadInt32(&p.waiting) == 0
+		}
+	}
+	return false
+}
+
+func (pf *pipeFactory) NewFuncRequest(kind FuncRequestKind, f func(context.Context) (interface{}, error)) pipe.Receiver {
+	p := pf.s.newRequestWithFunc(pf.e, pf.s.withFuncKind(kind, f))
+	if pf.s.debug {
+		pf.s.opt.Logger.Debugf("> newFunc %p", p)
 	}
 	return p
 }
 
-func debugSchedulerPreUnpark(e *edge, inc []pipe.Sender, updates, allPipes []pipe.Receiver) {
-	logrus.Debugf(">> unpark %s req=%d upt=%d out=%d state=%s %s", e.edge.Vertex.Name(), len(inc), len(updates), len(allPipes), e.state, e.edge.Vertex.Digest())
+// verifyUpdates checks that unpark handled all updates. owned are the requests
+// of the edge before unpark. Updates of requests the edge doesn't own are only
+// valid for completed requests, like the ones created by postpone, as there is
+// nothing waiting for them.
+func verifyUpdates(e *edge, owned map[pipe.Receiver]struct{}, updates []pipe.Receiver) error {
+	retained := e.ownedRequests()
+	for i, upt := range updates {
+		completed := upt.Status().Completed
+		if _, ok := owned[upt]; !ok {
+			if !completed {
+				return errors.Errorf("buildkit scheduler error: update-%d %p of %s was not handled by unpark", i, upt, e.edge.Vertex.Name())
+			}
+			continue
+		}
+		if _, ok := retained[upt]; !ok && !completed {
+			return errors.Errorf("buildkit scheduler error: unpark of %s dropped open request update-%d %p", e.edge.Vertex.Name(), i, upt)
+		}
+	}
+	return nil
+}
+
+func debugSchedulerPreUnpark(l logrus.FieldLogger, e *edge, inc []pipe.Sender, updates, allPipes []pipe.Receiver) {
+	l.Debugf(">> unpark %s req=%d upt=%d out=%d state=%s %s", e.edge.Vertex.Name(), len(inc), len(updates), len(allPipes), e.state, e.edge.Vertex.Digest())
 
 	for i, dep := range e.deps {
 		des := edgeStatusInitial
 		if dep.req != nil {
 			des = dep.req.Request().(*edgeRequest).desiredState
 		}
-		logrus.Debugf(":: dep%d %s state=%s des=%s keys=%d hasslowcache=%v preprocessfunc=%v", i, e.edge.Vertex.Inputs()[i].Vertex.Name(), dep.state, des, len(dep.keys), e.slowCacheFunc(dep) != nil, e.preprocessFunc(dep) != nil)
+		l.Debugf(":: dep%d %s state=%s des=%s keys=%d hasslowcache=%v preprocessfunc=%v", i, e.edge.Vertex.Inputs()[i].Vertex.Name(), dep.state, des, len(dep.keys), e.slowCacheFunc(dep) != nil, e.preprocessFunc(dep) != nil)
 	}
 
 	for i, in := range inc {
 		req := in.Request()
-		logrus.Debugf("> incoming-%d: %p dstate=%s canceled=%v", i, in, req.Payload.(*edgeRequest).desiredState, req.Canceled)
+		l.Debugf("> incoming-%d: %p dstate=%s canceled=%v", i, in, req.Payload.(*edgeRequest).desiredState, req.Canceled)
 	}
 
 	for i, up := range updates {
 		if up == e.cacheMapReq {
-			logrus.Debugf("> update-%d: %p cacheMapReq complete=%v", i, up, up.Status().Completed)
+			l.Debugf("> update-%d: %p cacheMapReq complete=%v", i, up, up.Status().Completed)
 		} else if up == e.execReq {
-			logrus.Debugf("> update-%d: %p execReq complete=%v", i, up, up.Status().Completed)
+			l.Debugf("> update-%d: %p execReq complete=%v", i, up, up.Status().Completed)
 		} else {
 			st, ok := up.Status().Value.(*edgeState)
 			if ok {
@@ -392,17 +2160,17 @@ func debugSchedulerPreUnpark(e *edge, inc []pipe.Sender, updates, allPipes []pip
 				if dep, ok := e.depRequests[up]; ok {
 					index = int(dep.index)
 				}
-				logrus.Debugf("> update-%d: %p input-%d keys=%d state=%s", i, up, index, len(st.keys), st.state)
+				l.Debugf("> update-%d: %p input-%d keys=%d state=%s", i, up, index, len(st.keys), st.state)
 			} else {
-				logrus.Debugf("> update-%d: unknown", i)
+				l.Debugf("> update-%d: unknown", i)
 			}
 		}
 	}
 }
 
-func debugSchedulerPostUnpark(e *edge, inc []pipe.Sender) {
+func debugSchedulerPostUnpark(l logrus.FieldLogger, e *edge, inc []pipe.Sender) {
 	for i, in := range inc {
-		logrus.Debugf("< incoming-%d: %p completed=%v", i, in, in.Status().Completed)
+		l.Debugf("< incoming-%d: %p completed=%v", i, in, in.Status().Completed)
 	}
-	logrus.Debugf("<< unpark %s\n", e.edge.Vertex.Name())
+	l.Debugf("<< unpark %s\n", e.edge.Vertex.Name())
 }
@@ -1,20 +1,26 @@
 package solver
 
 import (
+	"bytes"
 	"context"
 	_ "crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver/internal/pipe"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
@@ -632,6 +638,167 @@ func TestSingleCancelParallel(t *testing.T) {
 	require.NoError(t, eg.Wait())
 }
 
+func TestCancelByLabel(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	bothStarted := blockingFuncion(2)
+	var startedOnce sync.Once
+
+	// exec may be restarted for the remaining build after the cancellation
+	shared := vtx(vtxOpt{
+		name:  "shared",
+		value: "shared",
+		execPreFunc: func(ctx context.Context) error {
+			startedOnce.Do(func() { close(started) })
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		},
+	})
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		j, err := s.NewJob("job0")
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				value:        "result0",
+				cachePreFunc: bothStarted,
+				inputs:       []Edge{{Vertex: shared}},
+			}),
+		}
+
+		_, err = j.Build(WithBuildLabels(ctx, map[string]string{"tenant": "a"}), g)
+		require.Error(t, err)
+		require.Equal(t, true, errors.Is(err, context.Canceled))
+		close(release)
+		return nil
+	})
+
+	eg.Go(func() error {
+		j, err := s.NewJob("job1")
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v1",
+				value:        "result1",
+				cachePreFunc: bothStarted,
+				inputs:       []Edge{{Vertex: shared}},
+			}),
+		}
+
+		res, err := j.Build(WithBuildLabels(ctx, map[string]string{"tenant": "b"}), g)
+		require.NoError(t, err)
+		require.Equal(t, unwrap(res), "result1")
+		return err
+	})
+
+	<-started
+	require.Equal(t, 0, s.CancelByLabel("tenant", "c"))
+	require.Equal(t, 1, s.CancelByLabel("tenant", "a"))
+
+	require.NoError(t, eg.Wait())
+}
+
+func TestDrainOnly(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	started := blockingFuncion(2)
+	release := make(chan struct{})
+	var running int64
+	block := func(ctx context.Context) error {
+		if err := started(ctx); err != nil {
+			return err
+		}
+		atomic.AddInt64(&running, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(WithBuildLabels(ctx, map[string]string{"user": "fg"}), Edge{Vertex: vtx(vtxOpt{
+			name:        "v0",
+			value:       "result0",
+			execPreFunc: block,
+		})})
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
+		}
+		return err
+	})
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := j1.Build(WithBuildLabels(ctx, map[string]string{"user": "bg"}), Edge{Vertex: vtx(vtxOpt{
+			name:        "v1",
+			execPreFunc: block,
+		})})
+		canceled <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&running) == 2
+	}, time.Second, time.Millisecond)
+
+	// the foreground build keeps running past the deadline
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	n, err := s.DrainOnly(tctx, "user", "fg")
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, errors.Is(<-canceled, ErrDrained))
+
+	done := make(chan struct{})
+	go func() {
+		n, err := s.DrainOnly(ctx, "user", "fg")
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("drain returned before the build")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	require.NoError(t, eg.Wait())
+}
+
 func TestMultiLevelCalculation(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
@@ -1311,6 +1478,64 @@ func TestErrorReturns(t *testing.T) {
 
 }
 
+func TestDispatchGate(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	errDenied := errors.Errorf("denied")
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithDispatchGate(func(e Edge) error {
+				if e.Vertex.Name() == "v1" {
+					return errDenied
+				}
+				return nil
+			}),
+		},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			inputs: []Edge{
+				{Vertex: vtx(vtxOpt{
+					name:  "v1",
+					value: "result1",
+				})},
+				{Vertex: vtx(vtxOpt{
+					name:  "v2",
+					value: "result2",
+				})},
+			},
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	_, err = j0.Build(ctx, g0)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, errDenied))
+
+	// denied vertex never loads its cache key or executes
+	require.Equal(t, int64(0), *g0.Vertex.(*vertex).execCallCount)
+	require.True(t, *g0.Vertex.(*vertex).cacheCallCount < 3)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
 func TestMultipleCacheSources(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
@@ -1427,6 +1652,34 @@ func TestMultipleCacheSources(t *testing.T) {
 	j1 = nil
 }
 
+func TestMergeCacheSourcesOrder(t *testing.T) {
+	t.Parallel()
+
+	main := NewInMemoryCacheManager()
+	c1 := NewInMemoryCacheManager()
+	c2 := NewInMemoryCacheManager()
+	c3 := NewInMemoryCacheManager()
+
+	target := &state{mainCache: main, cache: map[string]CacheManager{}}
+	target.addCache(c2)
+	target.addCache(c1)
+
+	src := &state{mainCache: main, cache: map[string]CacheManager{}}
+	src.addCache(c3)
+	src.addCache(c1)
+
+	mergeCacheSources(&sharedOp{st: target}, &sharedOp{st: src})
+
+	cm, ok := target.combinedCacheManager().(*combinedCacheManager)
+	require.True(t, ok)
+
+	ids := make([]string, 0, len(cm.cms))
+	for _, c := range cm.cms {
+		ids = append(ids, c.ID())
+	}
+	require.Equal(t, []string{main.ID(), c2.ID(), c1.ID(), c3.ID()}, ids)
+}
+
 func TestRepeatBuildWithIgnoreCache(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
@@ -2177,15 +2430,12 @@ func TestCacheExporting(t *testing.T) {
 	require.Equal(t, expTarget.records[2].links, 0)
 }
 
-func TestCacheExportingModeMin(t *testing.T) {
+func TestCacheExportingWithBuildKey(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
 
-	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
-
 	l := NewSolver(SolverOpt{
 		ResolveOpFunc: testOpResolver,
-		DefaultCache:  cacheManager,
 	})
 	defer l.Close()
 
@@ -2201,117 +2451,75 @@ func TestCacheExportingModeMin(t *testing.T) {
 	g0 := Edge{
 		Vertex: vtxSum(1, vtxOpt{
 			inputs: []Edge{
-				{Vertex: vtxSum(2, vtxOpt{
-					inputs: []Edge{
-						{Vertex: vtxConst(3, vtxOpt{})},
-					},
-				})},
-				{Vertex: vtxConst(5, vtxOpt{})},
+				{Vertex: vtxConst(2, vtxOpt{})},
+				{Vertex: vtxConst(3, vtxOpt{})},
 			},
 		}),
 	}
 
-	res, err := j0.Build(ctx, g0)
+	res, key, err := j0.BuildWithCacheKey(ctx, g0)
 	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
+	require.Equal(t, unwrapInt(res), 6)
+	require.NotNil(t, key.CacheKey)
+	require.Equal(t, res.CacheKeys()[0].Digest(), key.Digest())
 
 	require.NoError(t, j0.Discard())
 	j0 = nil
 
 	expTarget := newTestExporterTarget()
 
-	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(false))
+	_, err = key.Exporter.ExportTo(ctx, expTarget, testExporterOpts(true))
 	require.NoError(t, err)
 
 	expTarget.normalize()
 
-	require.Equal(t, len(expTarget.records), 4)
-	require.Equal(t, expTarget.records[0].results, 1)
-	require.Equal(t, expTarget.records[1].results, 0)
-	require.Equal(t, expTarget.records[2].results, 0)
-	require.Equal(t, expTarget.records[3].results, 0)
-	require.Equal(t, expTarget.records[0].links, 2)
-	require.Equal(t, expTarget.records[1].links, 1)
-	require.Equal(t, expTarget.records[2].links, 0)
-	require.Equal(t, expTarget.records[3].links, 0)
-
-	j1, err := l.NewJob("j1")
-	require.NoError(t, err)
-
-	defer func() {
-		if j1 != nil {
-			j1.Discard()
-		}
-	}()
-
-	res, err = j1.Build(ctx, g0)
-	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
-
-	require.NoError(t, j1.Discard())
-	j1 = nil
-
-	expTarget = newTestExporterTarget()
-
-	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(false))
-	require.NoError(t, err)
-
-	expTarget.normalize()
-	// the order of the records isn't really significant
-	require.Equal(t, len(expTarget.records), 4)
-	require.Equal(t, expTarget.records[0].results, 1)
-	require.Equal(t, expTarget.records[1].results, 0)
-	require.Equal(t, expTarget.records[2].results, 0)
-	require.Equal(t, expTarget.records[3].results, 0)
-	require.Equal(t, expTarget.records[0].links, 2)
-	require.Equal(t, expTarget.records[1].links, 1)
-	require.Equal(t, expTarget.records[2].links, 0)
-	require.Equal(t, expTarget.records[3].links, 0)
+	require.Equal(t, len(expTarget.records), 3)
+}
 
-	// one more check with all mode
-	j2, err := l.NewJob("j2")
-	require.NoError(t, err)
+func TestDependencyWait(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-	defer func() {
-		if j2 != nil {
-			j2.Discard()
-		}
-	}()
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
 
-	res, err = j2.Build(ctx, g0)
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
+	defer j0.Discard()
 
-	require.NoError(t, j2.Discard())
-	j2 = nil
-
-	expTarget = newTestExporterTarget()
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{})},
+				{Vertex: vtxConst(3, vtxOpt{
+					execPreFunc: func(context.Context) error {
+						time.Sleep(50 * time.Millisecond)
+						return nil
+					},
+				})},
+			},
+		}),
+	}
 
-	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(true))
+	res, err := j0.Build(ctx, g0)
 	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 6)
 
-	expTarget.normalize()
-	// the order of the records isn't really significant
-	require.Equal(t, len(expTarget.records), 4)
-	require.Equal(t, expTarget.records[0].results, 1)
-	require.Equal(t, expTarget.records[1].results, 1)
-	require.Equal(t, expTarget.records[2].results, 0)
-	require.Equal(t, expTarget.records[3].results, 0)
-	require.Equal(t, expTarget.records[0].links, 2)
-	require.Equal(t, expTarget.records[1].links, 1)
-	require.Equal(t, expTarget.records[2].links, 0)
-	require.Equal(t, expTarget.records[3].links, 0)
+	// the slow dependency is on the critical path
+	deps := l.DependencyReport(g0)
+	require.Equal(t, 2, len(deps))
+	require.True(t, deps[1].Wait >= 50*time.Millisecond)
+	require.True(t, deps[1].Wait > deps[0].Wait)
 }
 
-func TestSlowCacheAvoidAccess(t *testing.T) {
+func TestDependencyReport(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
 
-	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
-
 	l := NewSolver(SolverOpt{
 		ResolveOpFunc: testOpResolver,
-		DefaultCache:  cacheManager,
 	})
 	defer l.Close()
 
@@ -2325,15 +2533,266 @@ func TestSlowCacheAvoidAccess(t *testing.T) {
 	}()
 
 	g0 := Edge{
-		Vertex: vtx(vtxOpt{
-			name:         "v0",
-			cacheKeySeed: "seed0",
-			cachePreFunc: func(context.Context) error {
-				select {
-				case <-time.After(50 * time.Millisecond):
-				case <-ctx.Done():
-				}
-				return nil
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{})},
+				{Vertex: vtxConst(3, vtxOpt{})},
+			},
+		}),
+	}
+
+	require.Nil(t, l.DependencyReport(g0))
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 6)
+
+	deps := l.DependencyReport(g0)
+	require.Equal(t, 2, len(deps))
+	for i, d := range deps {
+		require.Equal(t, Index(i), d.Index)
+		require.True(t, d.HasResult)
+		require.False(t, d.Cached)
+		require.Equal(t, 1, len(d.CacheKeys))
+	}
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+
+	j1, err := l.NewJob("j1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	// different root with same inputs loads the inputs from cache
+	g1 := Edge{
+		Vertex: vtxSum(5, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{})},
+				{Vertex: vtxConst(3, vtxOpt{})},
+			},
+		}),
+	}
+
+	res, err = j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 10)
+
+	deps = l.DependencyReport(g1)
+	require.Equal(t, 2, len(deps))
+	for _, d := range deps {
+		require.True(t, d.HasResult)
+		require.True(t, d.Cached)
+	}
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
+func TestCompletedEdgesOrder(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	c2 := vtxConst(2, vtxOpt{})
+	s1 := vtxSum(1, vtxOpt{inputs: []Edge{{Vertex: c2}}})
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: s1},
+				{Vertex: c2},
+			},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 6)
+
+	edges := l.CompletedEdges(g0)
+	require.Equal(t, 3, len(edges))
+	require.Equal(t, c2.Name(), edges[0].Vertex.Name())
+	require.Equal(t, s1.Name(), edges[1].Vertex.Name())
+	require.Equal(t, g0.Vertex.Name(), edges[2].Vertex.Name())
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestCacheExportingModeMin(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxSum(2, vtxOpt{
+					inputs: []Edge{
+						{Vertex: vtxConst(3, vtxOpt{})},
+					},
+				})},
+				{Vertex: vtxConst(5, vtxOpt{})},
+			},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+
+	expTarget := newTestExporterTarget()
+
+	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(false))
+	require.NoError(t, err)
+
+	expTarget.normalize()
+
+	require.Equal(t, len(expTarget.records), 4)
+	require.Equal(t, expTarget.records[0].results, 1)
+	require.Equal(t, expTarget.records[1].results, 0)
+	require.Equal(t, expTarget.records[2].results, 0)
+	require.Equal(t, expTarget.records[3].results, 0)
+	require.Equal(t, expTarget.records[0].links, 2)
+	require.Equal(t, expTarget.records[1].links, 1)
+	require.Equal(t, expTarget.records[2].links, 0)
+	require.Equal(t, expTarget.records[3].links, 0)
+
+	j1, err := l.NewJob("j1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	res, err = j1.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+
+	expTarget = newTestExporterTarget()
+
+	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(false))
+	require.NoError(t, err)
+
+	expTarget.normalize()
+	// the order of the records isn't really significant
+	require.Equal(t, len(expTarget.records), 4)
+	require.Equal(t, expTarget.records[0].results, 1)
+	require.Equal(t, expTarget.records[1].results, 0)
+	require.Equal(t, expTarget.records[2].results, 0)
+	require.Equal(t, expTarget.records[3].results, 0)
+	require.Equal(t, expTarget.records[0].links, 2)
+	require.Equal(t, expTarget.records[1].links, 1)
+	require.Equal(t, expTarget.records[2].links, 0)
+	require.Equal(t, expTarget.records[3].links, 0)
+
+	// one more check with all mode
+	j2, err := l.NewJob("j2")
+	require.NoError(t, err)
+
+	defer func() {
+		if j2 != nil {
+			j2.Discard()
+		}
+	}()
+
+	res, err = j2.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+
+	require.NoError(t, j2.Discard())
+	j2 = nil
+
+	expTarget = newTestExporterTarget()
+
+	_, err = res.CacheKeys()[0].Exporter.ExportTo(ctx, expTarget, testExporterOpts(true))
+	require.NoError(t, err)
+
+	expTarget.normalize()
+	// the order of the records isn't really significant
+	require.Equal(t, len(expTarget.records), 4)
+	require.Equal(t, expTarget.records[0].results, 1)
+	require.Equal(t, expTarget.records[1].results, 1)
+	require.Equal(t, expTarget.records[2].results, 0)
+	require.Equal(t, expTarget.records[3].results, 0)
+	require.Equal(t, expTarget.records[0].links, 2)
+	require.Equal(t, expTarget.records[1].links, 1)
+	require.Equal(t, expTarget.records[2].links, 0)
+	require.Equal(t, expTarget.records[3].links, 0)
+}
+
+func TestSlowCacheAvoidAccess(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			cachePreFunc: func(context.Context) error {
+				select {
+				case <-time.After(50 * time.Millisecond):
+				case <-ctx.Done():
+				}
+				return nil
 			},
 			value: "result0",
 			inputs: []Edge{{
@@ -3103,205 +3562,789 @@ func TestMergedEdgesLookup(t *testing.T) {
 	}
 }
 
-func TestCacheLoadError(t *testing.T) {
+func TestCacheMissHandler(t *testing.T) {
 	t.Parallel()
-
-	rand.Seed(time.Now().UnixNano())
-
 	ctx := context.TODO()
 
 	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
 
+	var mu sync.Mutex
+	var events []CacheMissEvent
 	l := NewSolver(SolverOpt{
 		ResolveOpFunc: testOpResolver,
 		DefaultCache:  cacheManager,
+		SchedulerOptions: []SchedulerOption{WithCacheMissHandler(func(ev CacheMissEvent) {
+			mu.Lock()
+			events = append(events, ev)
+			mu.Unlock()
+		})},
+	})
+	defer l.Close()
+
+	build := func(id string, opt vtxOpt) []CacheMissEvent {
+		mu.Lock()
+		events = nil
+		mu.Unlock()
+		j, err := l.NewJob(id)
+		require.NoError(t, err)
+		defer j.Discard()
+		res, err := j.Build(ctx, Edge{Vertex: vtx(opt)})
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+	opt := vtxOpt{name: "v0", cacheKeySeed: "seed0", value: "result0"}
+
+	evs := build("j0", opt)
+	require.Len(t, evs, 1)
+	require.Equal(t, "v0", evs[0].Edge.Vertex.Name())
+	require.Equal(t, CacheMissReasonNoMatch, evs[0].Reason)
+
+	// loaded from the cache
+	require.Len(t, build("j1", opt), 0)
+
+	cacheManager.forceFail = true
+	evs = build("j2", opt)
+	require.Len(t, evs, 1)
+	require.Equal(t, CacheMissReasonLoadFailed, evs[0].Reason)
+	cacheManager.forceFail = false
+
+	opt.ignoreCache = true
+	evs = build("j3", opt)
+	require.Len(t, evs, 1)
+	require.Equal(t, CacheMissReasonIgnoreCache, evs[0].Reason)
+}
+
+func TestWarnUncacheable(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithWarnUncacheable()},
 	})
 	defer l.Close()
 
 	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
+	defer j0.Discard()
 
-	defer func() {
-		if j0 != nil {
-			j0.Discard()
-		}
-	}()
-
-	g := Edge{
-		Vertex: vtxSum(3, vtxOpt{inputs: []Edge{
-			{Vertex: vtxSum(0, vtxOpt{inputs: []Edge{
-				{Vertex: vtxSum(2, vtxOpt{inputs: []Edge{
-					{Vertex: vtxConst(2, vtxOpt{})},
-				}})},
-				{Vertex: vtxConst(0, vtxOpt{})},
-			}})},
-			{Vertex: vtxSum(2, vtxOpt{inputs: []Edge{
-				{Vertex: vtxConst(2, vtxOpt{})},
-			}})},
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{})},
+			{Vertex: vtxConst(3, vtxOpt{ignoreCache: true})},
 		}}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+	require.Equal(t, 0, l.Stats().UncacheableEdges)
+
+	s := newScheduler(nil, WithWarnUncacheable())
+	s.Stop()
+
+	newCompleteEdge := func(opt vtxOpt) *edge {
+		opt.inputs = []Edge{{Vertex: vtx(vtxOpt{name: "v0"})}}
+		e := newEdge(Edge{Vertex: vtx(opt)}, nil, newEdgeIndex())
+		e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+		e.deps = []*dep{newDep(0)}
+		e.result = NewSharedCachedResult(NewCachedResult(&dummyResult{id: identity.NewID(), value: "result0"}, nil))
+		e.state = edgeStatusComplete
+		return e
 	}
-	g.Vertex.(*vertexSum).setupCallCounters()
 
-	res, err := j0.Build(ctx, g)
+	// input never provided a key
+	s.checkCacheable(newCompleteEdge(vtxOpt{name: "v1"}))
+	require.Equal(t, 1, s.Stats().UncacheableEdges)
+
+	s.checkCacheable(newCompleteEdge(vtxOpt{name: "v2", ignoreCache: true}))
+	s.checkCacheable(newCompleteEdge(vtxOpt{name: "v3", nonShareable: true}))
+	require.Equal(t, 1, s.Stats().UncacheableEdges)
+
+	e := newCompleteEdge(vtxOpt{name: "v4"})
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	e.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+	s.checkCacheable(e)
+	require.Equal(t, 1, s.Stats().UncacheableEdges)
+}
+
+func TestExecTimeout(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
-	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
-	require.Equal(t, int64(5), *g.Vertex.(*vertexSum).execCallCount)
-	require.Equal(t, int64(0), cacheManager.loadCounter)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{
+		name:        "fast",
+		value:       "result0",
+		execTimeout: time.Second,
+	})})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	_, err = j0.Build(ctx, Edge{Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+		{Vertex: vtxConst(2, vtxOpt{
+			name:        "slow",
+			execDelay:   time.Minute,
+			execTimeout: 20 * time.Millisecond,
+		})},
+	}})})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrExecTimeout))
+	require.Contains(t, err.Error(), "slow did not finish within 20ms")
+}
+
+func TestMaxEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithMaxEdges(2)},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	_, err = j0.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{})},
+			{Vertex: vtxConst(3, vtxOpt{})},
+		}}),
+	})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrTooManyEdges))
+	require.Equal(t, 2, l.Stats().LoadedEdges)
 
+	// discarding the job unloads its edges
 	require.NoError(t, j0.Discard())
-	j0 = nil
+	require.Equal(t, 0, l.Stats().LoadedEdges)
 
-	// repeat with cache
 	j1, err := l.NewJob("j1")
 	require.NoError(t, err)
+	defer j1.Discard()
 
-	defer func() {
-		if j1 != nil {
-			j1.Discard()
+	res, err := j1.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{})},
+		}}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, unwrapInt(res))
+}
+
+func TestTraceDispatches(t *testing.T) {
+	t.Parallel()
+
+	tracer := &recordingTracer{}
+	root := tracer.StartSpan("build").(*recordingSpan)
+	ctx := opentracing.ContextWithSpan(context.TODO(), root)
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithTraceDispatches()},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0"})})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	var queued, dispatched int
+	for _, sp := range tracer.finished {
+		switch sp.name {
+		case "scheduler: v0":
+			queued++
+			require.Equal(t, root, sp.parent)
+			require.NotNil(t, sp.tags[edgeIDField])
+			require.False(t, sp.end.Before(sp.start))
+		case "dispatch: v0":
+			dispatched++
+			require.NotNil(t, sp.parent)
+			require.Equal(t, "scheduler: v0", sp.parent.name)
+			require.False(t, sp.start.Before(sp.parent.start))
+			require.False(t, sp.end.After(sp.parent.end))
 		}
-	}()
+	}
+	require.Greater(t, dispatched, 0)
+	require.Equal(t, queued, dispatched)
+}
 
-	g1 := g
+func TestFuncRequestTTL(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-	g1.Vertex.(*vertexSum).setupCallCounters()
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithFuncRequestTTL(50 * time.Millisecond)},
+	})
+	defer l.Close()
 
-	res, err = j1.Build(ctx, g1)
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
-	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
-	require.Equal(t, int64(0), *g.Vertex.(*vertexSum).execCallCount)
-	require.Equal(t, int64(1), cacheManager.loadCounter)
+	defer j0.Discard()
 
-	require.NoError(t, j1.Discard())
-	j1 = nil
+	res, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0"})})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
 
-	// repeat with cache but loading will now fail
-	j2, err := l.NewJob("j2")
+	// operation that doesn't return on cancellation
+	release := make(chan struct{})
+	defer close(release)
+	_, err = j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{
+		name: "v1",
+		execPreFunc: func(context.Context) error {
+			<-release
+			return nil
+		},
+	})})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrRequestExpired))
+}
+
+func TestRunningFuncRequests(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
+	defer j0.Discard()
 
-	defer func() {
-		if j2 != nil {
-			j2.Discard()
+	cacheStarted := make(chan struct{})
+	cacheRelease := make(chan struct{})
+	execStarted := make(chan struct{})
+	execRelease := make(chan struct{})
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			cachePreFunc: func(context.Context) error {
+				close(cacheStarted)
+				<-cacheRelease
+				return nil
+			},
+			execPreFunc: func(context.Context) error {
+				close(execStarted)
+				<-execRelease
+				return nil
+			},
+		})})
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
 		}
-	}()
+		return err
+	})
 
-	g2 := g
+	<-cacheStarted
+	require.Equal(t, map[FuncRequestKind]int{FuncRequestCacheKey: 1}, l.Stats().RunningFuncRequests)
+	close(cacheRelease)
 
-	g2.Vertex.(*vertexSum).setupCallCounters()
+	<-execStarted
+	require.Equal(t, map[FuncRequestKind]int{FuncRequestExec: 1}, l.Stats().RunningFuncRequests)
+	close(execRelease)
 
-	cacheManager.forceFail = true
+	require.NoError(t, eg.Wait())
+	require.Empty(t, l.Stats().RunningFuncRequests)
+}
 
-	res, err = j2.Build(ctx, g2)
+func TestAbortEdge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
-	require.Equal(t, unwrapInt(res), 11)
-	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
-	require.Equal(t, int64(5), *g.Vertex.(*vertexSum).execCallCount)
-	require.Equal(t, int64(6), cacheManager.loadCounter)
+	defer j0.Discard()
 
-	require.NoError(t, j2.Discard())
-	j2 = nil
+	started := make(chan struct{})
+	v0 := vtx(vtxOpt{
+		name:  "v0",
+		value: "result0",
+		execPreFunc: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, Edge{Vertex: v0})
+		return err
+	})
+
+	<-started
+	require.True(t, l.AbortEdge(Edge{Vertex: v0}))
+
+	err = eg.Wait()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrEdgeAborted))
+
+	require.False(t, l.AbortEdge(Edge{Vertex: vtx(vtxOpt{name: "v1"})}))
 }
 
-func TestInputRequestDeadlock(t *testing.T) {
+func TestSnapshot(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
 
-	s := NewSolver(SolverOpt{
+	l := NewSolver(SolverOpt{
 		ResolveOpFunc: testOpResolver,
 	})
-	defer s.Close()
+	defer l.Close()
 
-	j0, err := s.NewJob("job0")
+	j0, err := l.NewJob("j0")
 	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	v1 := vtx(vtxOpt{
+		name:  "v1",
+		value: "result1",
+		execPreFunc: func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	v0 := vtx(vtxOpt{
+		name:   "v0",
+		value:  "result0",
+		inputs: []Edge{{Vertex: v1}},
+	})
 
-	defer func() {
-		if j0 != nil {
-			j0.Discard()
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(ctx, Edge{Vertex: v0})
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
 		}
-	}()
+		return err
+	})
 
-	g0 := Edge{
-		Vertex: vtx(vtxOpt{
-			name:         "v0",
-			cacheKeySeed: "seed0",
-			value:        "result0",
-			inputs: []Edge{
-				{
-					Vertex: vtx(vtxOpt{
-						name:         "v1",
-						cacheKeySeed: "seed1",
-						value:        "result1",
-					}),
-				},
-				{
-					Vertex: vtx(vtxOpt{
-						name:         "v2",
-						cacheKeySeed: "seed2",
-						value:        "result2",
-					}),
+	<-started
+	snap := l.Snapshot()
+	require.Len(t, snap.Builds, 1)
+	require.Equal(t, "j0", snap.Builds[0].JobID)
+	require.Equal(t, map[FuncRequestKind]int{FuncRequestExec: 1}, snap.Stats.RunningFuncRequests)
+	require.Len(t, snap.Edges, 2)
+
+	byName := map[string]SnapshotEdge{}
+	for _, se := range snap.Edges {
+		byName[se.Edge.Vertex.Name()] = se
+	}
+	require.Equal(t, []uint64{byName["v1"].ID}, byName["v0"].Inputs)
+	require.Equal(t, 1, byName["v1"].Requests)
+	require.Equal(t, "executing", byName["v1"].Blocked)
+	require.False(t, byName["v0"].Complete)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+func TestSerializedResult(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	graph := func() Edge {
+		return Edge{
+			Vertex: vtxSum(1, vtxOpt{
+				inputs: []Edge{
+					{Vertex: vtxConst(3, vtxOpt{})},
+					{Vertex: vtxConst(4, vtxOpt{})},
 				},
-			},
-		}),
+			}),
+		}
 	}
 
-	_, err = j0.Build(ctx, g0)
+	l0 := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithResultSerializer(testResultSerializer{})},
+	})
+	defer l0.Close()
+
+	j0, err := l0.NewJob("j0")
 	require.NoError(t, err)
-	require.NoError(t, j0.Discard())
-	j0 = nil
+	defer j0.Discard()
 
-	j1, err := s.NewJob("job1")
+	g0 := graph()
+	sr, err := j0.BuildSerialized(ctx, g0)
 	require.NoError(t, err)
+	require.Len(t, sr.CacheKeys, 1)
+	require.Len(t, sr.CacheKeys[0].Deps, 2)
 
-	defer func() {
-		if j1 != nil {
-			j1.Discard()
-		}
-	}()
+	// the serialized form is moved to another process
+	dt, err := json.Marshal(sr)
+	require.NoError(t, err)
+	var sr2 SerializedResult
+	require.NoError(t, json.Unmarshal(dt, &sr2))
 
-	g1 := Edge{
-		Vertex: vtx(vtxOpt{
-			name:         "v0",
-			cacheKeySeed: "seed0-1",
-			value:        "result0",
-			inputs: []Edge{
-				{
-					Vertex: vtx(vtxOpt{
-						name:         "v1",
-						cacheKeySeed: "seed1-1",
-						value:        "result1",
-					}),
-				},
-				{
-					Vertex: vtx(vtxOpt{
-						name:         "v2",
-						cacheKeySeed: "seed2-1",
-						value:        "result2",
-					}),
-				},
-			},
-		}),
-	}
+	l1 := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithResultSerializer(testResultSerializer{})},
+	})
+	defer l1.Close()
 
-	_, err = j1.Build(ctx, g1)
+	j1, err := l1.NewJob("j1")
 	require.NoError(t, err)
-	require.NoError(t, j1.Discard())
-	j1 = nil
+	defer j1.Discard()
 
-	j2, err := s.NewJob("job2")
+	g1 := graph()
+	g1.Vertex.(*vertexSum).setupCallCounters()
+	require.NoError(t, j1.InjectSerializedResult(ctx, g1, &sr2))
+
+	res, err := j1.Build(ctx, g1)
 	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
+	require.Equal(t, int64(0), *g1.Vertex.(*vertexSum).execCallCount)
 
-	defer func() {
-		if j2 != nil {
-			j2.Discard()
-		}
-	}()
+	keys := res.CacheKeys()
+	require.Len(t, keys, 1)
+	require.Equal(t, sr.CacheKeys[0], serializeCacheKey(keys[0].CacheKey))
 
-	g2 := Edge{
-		Vertex: vtx(vtxOpt{
-			name:         "v0",
-			cacheKeySeed: "seed0-1",
-			value:        "result0",
+	// results can't be serialized without a serializer
+	l2 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l2.Close()
+
+	j2, err := l2.NewJob("j2")
+	require.NoError(t, err)
+	defer j2.Discard()
+
+	_, err = j2.BuildSerialized(ctx, graph())
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrNotSerializable))
+}
+
+type testResultSerializer struct{}
+
+type testSerializedResult struct {
+	ID       string `json:"id"`
+	Value    string `json:"value"`
+	IntValue int    `json:"intValue"`
+}
+
+func (testResultSerializer) Serialize(_ context.Context, res Result) ([]byte, error) {
+	r, ok := res.Sys().(*dummyResult)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSerializable, "%T", res.Sys())
+	}
+	return json.Marshal(testSerializedResult{ID: r.id, Value: r.value, IntValue: r.intValue})
+}
+
+func (testResultSerializer) Deserialize(_ context.Context, dt []byte) (Result, error) {
+	var r testSerializedResult
+	if err := json.Unmarshal(dt, &r); err != nil {
+		return nil, err
+	}
+	return &dummyResult{id: r.ID, value: r.Value, intValue: r.IntValue}, nil
+}
+
+func TestCollectErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	gate := func(e Edge) error {
+		if e.Vertex.Name() == "v1" {
+			panic("gate failure")
+		}
+		return nil
+	}
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithCollectErrors(10), WithDispatchGate(gate)},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	v1 := vtx(vtxOpt{name: "v1", value: "result1"})
+	_, err = j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{
+		name:   "v0",
+		value:  "result0",
+		inputs: []Edge{{Vertex: v1}},
+	})})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "panic in dispatch of v1: gate failure")
+
+	select {
+	case se := <-l.SchedulerErrors():
+		require.Equal(t, SchedulerErrorPanic, se.Kind)
+		require.Equal(t, "v1", se.Edge.Vertex.Name())
+		require.NotZero(t, se.EdgeID)
+		// the stack includes the frames of the panic
+		require.Contains(t, string(se.Stack), "TestCollectErrors")
+	default:
+		t.Fatal("panic was not collected")
+	}
+
+	// the failed edge is not dispatched into the gate again
+	select {
+	case se := <-l.SchedulerErrors():
+		t.Fatalf("unexpected error %v", se)
+	default:
+	}
+
+	l2 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l2.Close()
+	require.Nil(t, l2.SchedulerErrors())
+}
+
+func TestAbortUnknownEdge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(ctx, g0)
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
+		}
+		return err
+	})
+
+	<-started
+	loaded := l.Stats().LoadedEdges
+
+	// the input of the blocked edge was never requested
+	require.False(t, l.AbortEdge(g0.Vertex.Inputs()[0]))
+	require.Equal(t, loaded, l.Stats().LoadedEdges)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+func TestBuildInfoMerged(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	j1, err := l.NewJob("j1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var info0, info1 BuildInfo
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(WithBuildInfo(ctx, &info0), Edge{Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0",
+			execPreFunc: func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			},
+		})})
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
+		}
+		return err
+	})
+
+	<-started
+	eg.Go(func() error {
+		// different vertex with the same cache key merges to the running edge
+		res, err := j1.Build(WithBuildInfo(ctx, &info1), Edge{Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed0",
+			value:        "result1",
+		})})
+		if err == nil {
+			require.Equal(t, "result0", unwrap(res))
+		}
+		return err
+	})
+
+	require.Eventually(t, func() bool {
+		return l.Stats().MergedEdges == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	require.NoError(t, eg.Wait())
+
+	require.False(t, info0.Merged)
+	require.True(t, info1.Merged)
+	require.Equal(t, 1, l.Stats().MergedBuilds)
+}
+
+func TestCacheLoadError(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	ctx := context.TODO()
+
+	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g := Edge{
+		Vertex: vtxSum(3, vtxOpt{inputs: []Edge{
+			{Vertex: vtxSum(0, vtxOpt{inputs: []Edge{
+				{Vertex: vtxSum(2, vtxOpt{inputs: []Edge{
+					{Vertex: vtxConst(2, vtxOpt{})},
+				}})},
+				{Vertex: vtxConst(0, vtxOpt{})},
+			}})},
+			{Vertex: vtxSum(2, vtxOpt{inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{})},
+			}})},
+		}}),
+	}
+	g.Vertex.(*vertexSum).setupCallCounters()
+
+	res, err := j0.Build(ctx, g)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
+	require.Equal(t, int64(5), *g.Vertex.(*vertexSum).execCallCount)
+	require.Equal(t, int64(0), cacheManager.loadCounter)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+
+	// repeat with cache
+	j1, err := l.NewJob("j1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	g1 := g
+
+	g1.Vertex.(*vertexSum).setupCallCounters()
+
+	res, err = j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
+	require.Equal(t, int64(0), *g.Vertex.(*vertexSum).execCallCount)
+	require.Equal(t, int64(1), cacheManager.loadCounter)
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+
+	// repeat with cache but loading will now fail
+	j2, err := l.NewJob("j2")
+	require.NoError(t, err)
+
+	defer func() {
+		if j2 != nil {
+			j2.Discard()
+		}
+	}()
+
+	g2 := g
+
+	g2.Vertex.(*vertexSum).setupCallCounters()
+
+	cacheManager.forceFail = true
+
+	res, err = j2.Build(ctx, g2)
+	require.NoError(t, err)
+	require.Equal(t, unwrapInt(res), 11)
+	require.Equal(t, int64(7), *g.Vertex.(*vertexSum).cacheCallCount)
+	require.Equal(t, int64(5), *g.Vertex.(*vertexSum).execCallCount)
+	require.Equal(t, int64(6), cacheManager.loadCounter)
+
+	require.NoError(t, j2.Discard())
+	j2 = nil
+}
+
+func TestInputRequestDeadlock(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0",
 			inputs: []Edge{
 				{
 					Vertex: vtx(vtxOpt{
@@ -3313,475 +4356,5872 @@ func TestInputRequestDeadlock(t *testing.T) {
 				{
 					Vertex: vtx(vtxOpt{
 						name:         "v2",
-						cacheKeySeed: "seed2-1",
+						cacheKeySeed: "seed2",
 						value:        "result2",
 					}),
 				},
 			},
-			slowCacheCompute: map[int]ResultBasedCacheFunc{
-				1: digestFromResult,
+		}),
+	}
+
+	_, err = j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.NoError(t, j0.Discard())
+	j0 = nil
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0-1",
+			value:        "result0",
+			inputs: []Edge{
+				{
+					Vertex: vtx(vtxOpt{
+						name:         "v1",
+						cacheKeySeed: "seed1-1",
+						value:        "result1",
+					}),
+				},
+				{
+					Vertex: vtx(vtxOpt{
+						name:         "v2",
+						cacheKeySeed: "seed2-1",
+						value:        "result2",
+					}),
+				},
+			},
+		}),
+	}
+
+	_, err = j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.NoError(t, j1.Discard())
+	j1 = nil
+
+	j2, err := s.NewJob("job2")
+	require.NoError(t, err)
+
+	defer func() {
+		if j2 != nil {
+			j2.Discard()
+		}
+	}()
+
+	g2 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0-1",
+			value:        "result0",
+			inputs: []Edge{
+				{
+					Vertex: vtx(vtxOpt{
+						name:         "v1",
+						cacheKeySeed: "seed1",
+						value:        "result1",
+					}),
+				},
+				{
+					Vertex: vtx(vtxOpt{
+						name:         "v2",
+						cacheKeySeed: "seed2-1",
+						value:        "result2",
+					}),
+				},
+			},
+			slowCacheCompute: map[int]ResultBasedCacheFunc{
+				1: digestFromResult,
+			},
+		}),
+	}
+
+	_, err = j2.Build(ctx, g2)
+	require.NoError(t, err)
+	require.NoError(t, j2.Discard())
+	j2 = nil
+}
+
+func TestAdmissionRate(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithAdmissionRate(2, 20*time.Millisecond),
+		},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	inputs := make([]Edge, 0, 6)
+	for i := 0; i < 6; i++ {
+		inputs = append(inputs, Edge{Vertex: vtxConst(i, vtxOpt{})})
+	}
+	g0 := Edge{Vertex: vtxSum(1, vtxOpt{inputs: inputs})}
+
+	start := time.Now()
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 16, unwrapInt(res))
+
+	// 7 new edges with 2 admitted per interval need at least 3 intervals
+	require.True(t, time.Since(start) >= 60*time.Millisecond)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestSchedulerOverloaded(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil, WithMaxQueueLength(1, false))
+	// stopped scheduler never drains the queue
+	s.Stop()
+
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex()))
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex()))
+
+	_, err := s.build(context.TODO(), Edge{Vertex: vtx(vtxOpt{})})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrSchedulerOverloaded))
+
+	s.opt.BlockWhenOverloaded = true
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	_, err = s.build(ctx, Edge{Vertex: vtx(vtxOpt{})})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestCompleteEdgeAtCapacity(t *testing.T) {
+	t.Parallel()
+
+	ef := testEdgeFactory{}
+	// the queue is never drained without dispatching manually
+	s := newScheduler(ef, WithMaxQueueLength(1, false), withManualDispatch())
+	defer s.Stop()
+
+	g := Edge{Vertex: vtx(vtxOpt{name: "v0"})}
+	e := newEdge(g, nil, newEdgeIndex())
+	e.result = NewSharedCachedResult(NewCachedResult(&dummyResult{id: "r0", value: "result0"}, nil))
+	e.state = edgeStatusComplete
+	ef[g] = e
+
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex()))
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex()))
+
+	_, err := s.build(context.TODO(), Edge{Vertex: vtx(vtxOpt{})})
+	require.True(t, errors.Is(err, ErrSchedulerOverloaded))
+
+	res, err := s.build(context.TODO(), g)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+}
+
+func TestMergeIncompatibleDeps(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil)
+	defer s.Stop()
+
+	v0 := vtx(vtxOpt{name: "v0"})
+	target := newEdge(Edge{Vertex: vtx(vtxOpt{
+		name:   "v1",
+		inputs: []Edge{{Vertex: v0}},
+	})}, nil, newEdgeIndex())
+	target.cacheMap = target.edge.Vertex.(*vertex).makeCacheMap()
+	target.deps = []*dep{newDep(0)}
+
+	src := newEdge(Edge{Vertex: vtx(vtxOpt{
+		name:   "v1",
+		inputs: []Edge{{Vertex: v0}, {Vertex: v0}},
+	})}, nil, newEdgeIndex())
+	src.cacheMap = src.edge.Vertex.(*vertex).makeCacheMap()
+	src.deps = []*dep{newDep(0), newDep(1)}
+	for _, d := range src.deps {
+		d.keys = []ExportableCacheKey{{CacheKey: NewCacheKey(digest.FromBytes([]byte("foo")), 0)}}
+	}
+
+	require.False(t, s.mergeTo(target, src))
+	require.Equal(t, 0, len(target.getSecondaryExporters()))
+
+	// a cache map that doesn't cover all dependencies is refused as well
+	src.deps = src.deps[:1]
+	require.False(t, s.mergeTo(target, src))
+	require.Equal(t, 0, len(target.getSecondaryExporters()))
+}
+
+func generateSubGraph(nodes int) (Edge, int) {
+	if nodes == 1 {
+		value := rand.Int() % 500
+		return Edge{Vertex: vtxConst(value, vtxOpt{})}, value
+	}
+	spread := rand.Int()%5 + 2
+	inc := int(math.Ceil(float64(nodes) / float64(spread)))
+	if inc > nodes {
+		inc = nodes
+	}
+	added := 1
+	value := 0
+	inputs := []Edge{}
+	i := 0
+	for {
+		i++
+		if added >= nodes {
+			break
+		}
+		if added+inc > nodes {
+			inc = nodes - added
+		}
+		e, v := generateSubGraph(inc)
+		inputs = append(inputs, e)
+		value += v
+		added += inc
+	}
+	extra := rand.Int() % 500
+	value += extra
+	return Edge{Vertex: vtxSum(extra, vtxOpt{inputs: inputs})}, value
+}
+
+type vtxOpt struct {
+	name             string
+	cacheKeySeed     string
+	cacheKeySeeds    []func() string
+	execDelay        time.Duration
+	cacheDelay       time.Duration
+	cachePreFunc     func(context.Context) error
+	execPreFunc      func(context.Context) error
+	inputs           []Edge
+	value            string
+	slowCacheCompute map[int]ResultBasedCacheFunc
+	selectors        map[int]digest.Digest
+	cacheSource      CacheManager
+	ignoreCache      bool
+	nonShareable     bool
+	cost             int
+	condition        *Condition
+	typ              string
+	exclusiveLocks   []string
+	resourceLimits   *ResourceLimits
+	execTimeout      time.Duration
+}
+
+func vtx(opt vtxOpt) *vertex {
+	if opt.name == "" {
+		opt.name = identity.NewID()
+	}
+	if opt.cacheKeySeed == "" {
+		opt.cacheKeySeed = identity.NewID()
+	}
+	return &vertex{opt: opt}
+}
+
+type vertex struct {
+	opt vtxOpt
+
+	cacheCallCount *int64
+	execCallCount  *int64
+}
+
+func (v *vertex) Digest() digest.Digest {
+	return digest.FromBytes([]byte(v.opt.name))
+}
+func (v *vertex) Sys() interface{} {
+	return v
+}
+func (v *vertex) Inputs() []Edge {
+	return v.opt.inputs
+}
+func (v *vertex) Name() string {
+	return v.opt.name
+}
+func (v *vertex) Options() VertexOptions {
+	var cache []CacheManager
+	if v.opt.cacheSource != nil {
+		cache = append(cache, v.opt.cacheSource)
+	}
+	return VertexOptions{
+		CacheSources:   cache,
+		IgnoreCache:    v.opt.ignoreCache,
+		NonShareable:   v.opt.nonShareable,
+		Cost:           v.opt.cost,
+		Condition:      v.opt.condition,
+		Type:           v.opt.typ,
+		ExclusiveLocks: v.opt.exclusiveLocks,
+		ResourceLimits: v.opt.resourceLimits,
+		ExecTimeout:    v.opt.execTimeout,
+	}
+}
+
+func (v *vertex) setupCallCounters() {
+	var cacheCount int64
+	var execCount int64
+
+	v.setCallCounters(&cacheCount, &execCount)
+}
+
+func (v *vertex) setCallCounters(cacheCount, execCount *int64) {
+	v.cacheCallCount = cacheCount
+	v.execCallCount = execCount
+
+	for _, inp := range v.opt.inputs {
+		var v *vertex
+		switch vv := inp.Vertex.(type) {
+		case *vertex:
+			v = vv
+		case *vertexSum:
+			v = vv.vertex
+		case *vertexConst:
+			v = vv.vertex
+		case *vertexSubBuild:
+			v = vv.vertex
+		}
+		v.setCallCounters(cacheCount, execCount)
+	}
+}
+
+func (v *vertex) cacheMap(ctx context.Context) error {
+	if f := v.opt.cachePreFunc; f != nil {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	if v.cacheCallCount != nil {
+		atomic.AddInt64(v.cacheCallCount, 1)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	select {
+	case <-time.After(v.opt.cacheDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (v *vertex) CacheMap(ctx context.Context, g session.Group, index int) (*CacheMap, bool, error) {
+	if index == 0 {
+		if err := v.cacheMap(ctx); err != nil {
+			return nil, false, err
+		}
+		return v.makeCacheMap(), len(v.opt.cacheKeySeeds) == index, nil
+	}
+	return &CacheMap{
+		Digest: digest.FromBytes([]byte(fmt.Sprintf("seed:%s", v.opt.cacheKeySeeds[index-1]()))),
+	}, len(v.opt.cacheKeySeeds) == index, nil
+}
+
+func (v *vertex) exec(ctx context.Context, inputs []Result) error {
+	if len(inputs) != len(v.Inputs()) {
+		return errors.Errorf("invalid number of inputs")
+	}
+	if f := v.opt.execPreFunc; f != nil {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	if v.execCallCount != nil {
+		atomic.AddInt64(v.execCallCount, 1)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	select {
+	case <-time.After(v.opt.execDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (v *vertex) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
+	if err := v.exec(ctx, inputs); err != nil {
+		return nil, err
+	}
+	return []Result{&dummyResult{id: identity.NewID(), value: v.opt.value}}, nil
+}
+
+func (v *vertex) makeCacheMap() *CacheMap {
+	m := &CacheMap{
+		Digest: digest.FromBytes([]byte(fmt.Sprintf("seed:%s", v.opt.cacheKeySeed))),
+		Deps: make([]struct {
+			Selector          digest.Digest
+			ComputeDigestFunc ResultBasedCacheFunc
+			PreprocessFunc    PreprocessFunc
+		}, len(v.Inputs())),
+	}
+	for i, f := range v.opt.slowCacheCompute {
+		m.Deps[i].ComputeDigestFunc = f
+	}
+	for i, dgst := range v.opt.selectors {
+		m.Deps[i].Selector = dgst
+	}
+	return m
+}
+
+// vtxConst returns a vertex that outputs a constant integer
+func vtxConst(v int, opt vtxOpt) *vertexConst {
+	if opt.cacheKeySeed == "" {
+		opt.cacheKeySeed = fmt.Sprintf("const-%d", v)
+	}
+	if opt.name == "" {
+		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+	}
+	return &vertexConst{vertex: vtx(opt), value: v}
+}
+
+type vertexConst struct {
+	*vertex
+	value int
+}
+
+func (v *vertexConst) Sys() interface{} {
+	return v
+}
+
+func (v *vertexConst) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
+	if err := v.exec(ctx, inputs); err != nil {
+		return nil, err
+	}
+	return []Result{&dummyResult{id: identity.NewID(), intValue: v.value}}, nil
+}
+
+// vtxSum returns a vertex that ourputs sum of its inputs plus a constant
+func vtxSum(v int, opt vtxOpt) *vertexSum {
+	if opt.cacheKeySeed == "" {
+		opt.cacheKeySeed = fmt.Sprintf("sum-%d-%d", v, len(opt.inputs))
+	}
+	if opt.name == "" {
+		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+	}
+	return &vertexSum{vertex: vtx(opt), value: v}
+}
+
+type vertexSum struct {
+	*vertex
+	value int
+}
+
+func (v *vertexSum) Sys() interface{} {
+	return v
+}
+
+func (v *vertexSum) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
+	if err := v.exec(ctx, inputs); err != nil {
+		return nil, err
+	}
+	s := v.value
+	for _, inp := range inputs {
+		if IsSkipped(inp) {
+			continue
+		}
+		r, ok := inp.Sys().(*dummyResult)
+		if !ok {
+			return nil, errors.Errorf("invalid input type: %T", inp.Sys())
+		}
+		s += r.intValue
+	}
+	return []Result{&dummyResult{id: identity.NewID(), intValue: s}}, nil
+}
+
+func vtxSubBuild(g Edge, opt vtxOpt) *vertexSubBuild {
+	if opt.cacheKeySeed == "" {
+		opt.cacheKeySeed = fmt.Sprintf("sum-%s", identity.NewID())
+	}
+	if opt.name == "" {
+		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+	}
+	return &vertexSubBuild{vertex: vtx(opt), g: g}
+}
+
+type vertexSubBuild struct {
+	*vertex
+	g Edge
+	b Builder
+}
+
+func (v *vertexSubBuild) Sys() interface{} {
+	return v
+}
+
+func (v *vertexSubBuild) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
+	if err := v.exec(ctx, inputs); err != nil {
+		return nil, err
+	}
+	res, err := v.b.Build(ctx, v.g)
+	if err != nil {
+		return nil, err
+	}
+	return []Result{res}, nil
+}
+
+//nolint:unused
+func printGraph(e Edge, pfx string) {
+	name := e.Vertex.Name()
+	fmt.Printf("%s %d %s\n", pfx, e.Index, name)
+	for _, inp := range e.Vertex.Inputs() {
+		printGraph(inp, pfx+"-->")
+	}
+}
+
+type dummyResult struct {
+	id       string
+	value    string
+	intValue int
+}
+
+func (r *dummyResult) ID() string                    { return r.id }
+func (r *dummyResult) Release(context.Context) error { return nil }
+func (r *dummyResult) Sys() interface{}              { return r }
+func (r *dummyResult) Clone() Result                 { return r }
+
+func testOpResolver(v Vertex, b Builder) (Op, error) {
+	if op, ok := v.Sys().(Op); ok {
+		if vtx, ok := op.(*vertexSubBuild); ok {
+			vtx.b = b
+		}
+		return op, nil
+	}
+
+	return nil, errors.Errorf("invalid vertex")
+}
+
+func unwrap(res Result) string {
+	r, ok := res.Sys().(*dummyResult)
+	if !ok {
+		return "unwrap-error"
+	}
+	return r.value
+}
+
+func unwrapInt(res Result) int {
+	r, ok := res.Sys().(*dummyResult)
+	if !ok {
+		return -1e6
+	}
+	return r.intValue
+}
+
+func blockingFuncion(i int) func(context.Context) error {
+	limit := int64(i)
+	block := make(chan struct{})
+	return func(context.Context) error {
+		if atomic.AddInt64(&limit, -1) == 0 {
+			close(block)
+		}
+		<-block
+		return nil
+	}
+}
+
+func newTrackingCacheManager(cm CacheManager) *trackingCacheManager {
+	return &trackingCacheManager{CacheManager: cm}
+}
+
+type trackingCacheManager struct {
+	CacheManager
+	loadCounter int64
+	forceFail   bool
+}
+
+func (cm *trackingCacheManager) Load(ctx context.Context, rec *CacheRecord) (Result, error) {
+	atomic.AddInt64(&cm.loadCounter, 1)
+	if cm.forceFail {
+		return nil, errors.Errorf("force fail")
+	}
+	return cm.CacheManager.Load(ctx, rec)
+}
+
+func digestFromResult(ctx context.Context, res Result, _ session.Group) (digest.Digest, error) {
+	return digest.FromBytes([]byte(unwrap(res))), nil
+}
+
+func testExporterOpts(all bool) CacheExportOpt {
+	mode := CacheExportModeMin
+	if all {
+		mode = CacheExportModeMax
+	}
+	return CacheExportOpt{
+		Convert: func(ctx context.Context, res Result) (*Remote, error) {
+			if dr, ok := res.Sys().(*dummyResult); ok {
+				return &Remote{Descriptors: []ocispec.Descriptor{{
+					Annotations: map[string]string{"value": fmt.Sprintf("%d", dr.intValue)},
+				}}}, nil
+			}
+			return nil, nil
+		},
+		Mode: mode,
+	}
+}
+
+func newTestExporterTarget() *testExporterTarget {
+	return &testExporterTarget{
+		visited: map[interface{}]struct{}{},
+	}
+}
+
+type testExporterTarget struct {
+	visited map[interface{}]struct{}
+	records []*testExporterRecord
+}
+
+func (t *testExporterTarget) Add(dgst digest.Digest) CacheExporterRecord {
+	r := &testExporterRecord{dgst: dgst}
+	t.records = append(t.records, r)
+	return r
+}
+func (t *testExporterTarget) Visit(v interface{}) {
+	t.visited[v] = struct{}{}
+
+}
+func (t *testExporterTarget) Visited(v interface{}) bool {
+	_, ok := t.visited[v]
+	return ok
+}
+
+func (t *testExporterTarget) normalize() {
+	m := map[digest.Digest]struct{}{}
+	rec := make([]*testExporterRecord, 0, len(t.records))
+	for _, r := range t.records {
+		if _, ok := m[r.dgst]; ok {
+			for _, r2 := range t.records {
+				delete(r2.linkMap, r.dgst)
+				r2.links = len(r2.linkMap)
+			}
+			continue
+		}
+		m[r.dgst] = struct{}{}
+		rec = append(rec, r)
+	}
+	t.records = rec
+}
+
+type testExporterRecord struct {
+	dgst    digest.Digest
+	results int
+	links   int
+	linkMap map[digest.Digest]struct{}
+}
+
+func (r *testExporterRecord) AddResult(createdAt time.Time, result *Remote) {
+	r.results++
+}
+
+func (r *testExporterRecord) LinkFrom(src CacheExporterRecord, index int, selector string) {
+	if s, ok := src.(*testExporterRecord); ok {
+		if r.linkMap == nil {
+			r.linkMap = map[digest.Digest]struct{}{}
+		}
+		if _, ok := r.linkMap[s.dgst]; !ok {
+			r.linkMap[s.dgst] = struct{}{}
+			r.links++
+		}
+	}
+}
+
+func TestRedispatchDelay(t *testing.T) {
+	t.Parallel()
+
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex())
+	now := time.Now()
+	e.lastDispatch = now
+	require.Equal(t, time.Duration(0), redispatchDelay(e, now))
+
+	e.dispatchInterval = 50 * time.Millisecond
+	require.Equal(t, 50*time.Millisecond, redispatchDelay(e, now))
+	require.Equal(t, 20*time.Millisecond, redispatchDelay(e, now.Add(30*time.Millisecond)))
+	require.True(t, redispatchDelay(e, now.Add(60*time.Millisecond)) <= 0)
+
+	// completed edges are never delayed
+	e.err = errors.Errorf("failed")
+	require.Equal(t, time.Duration(0), redispatchDelay(e, now))
+}
+
+func TestBuildDoubleSendCompletion(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			execPreFunc: func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			},
+		}),
+	}
+
+	type buildResult struct {
+		res CachedResult
+		err error
+	}
+	done := make(chan buildResult, 1)
+	go func() {
+		res, err := j0.Build(ctx, g0)
+		done <- buildResult{res, err}
+	}()
+
+	<-started
+	var p *pipe.Pipe
+	s.s.mu.Lock()
+	for b := range s.s.builds {
+		p = b.pipe
+	}
+	s.s.mu.Unlock()
+	require.NotNil(t, p)
+
+	close(release)
+	br := <-done
+	require.NoError(t, br.err)
+	require.Equal(t, "result0", unwrap(br.res))
+
+	// completing the pipe again must not panic
+	require.NotPanics(t, func() {
+		p.Sender.Finalize(nil, nil)
+	})
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestDesiredState(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	v1 := vtx(vtxOpt{
+		name:  "v1",
+		value: "result1",
+		cachePreFunc: func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: v1}},
+		}),
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	require.Equal(t, EdgeStateComplete, s.DesiredState(g0))
+	// dependency is only needed for the cache key until that is resolved
+	require.Equal(t, EdgeStateCacheFast, s.DesiredState(Edge{Vertex: v1}))
+	require.Equal(t, "cache-fast", s.DesiredState(Edge{Vertex: v1}).String())
+
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.Equal(t, EdgeStateComplete, s.DesiredState(g0))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestMaxEdgeDepth(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithMaxEdgeDepth(3)},
+	})
+	defer s.Close()
+
+	chain := func(prefix string, n int) Edge {
+		var inputs []Edge
+		for i := n - 1; i >= 0; i-- {
+			e := Edge{Vertex: vtx(vtxOpt{
+				name:   fmt.Sprintf("%s%d", prefix, i),
+				value:  fmt.Sprintf("%s-result%d", prefix, i),
+				inputs: inputs,
+			})}
+			inputs = []Edge{e}
+		}
+		return inputs[0]
+	}
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	res, err := j0.Build(ctx, chain("a", 4))
+	require.NoError(t, err)
+	require.Equal(t, "a-result0", unwrap(res))
+
+	_, err = j0.Build(ctx, chain("b", 5))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrGraphTooDeep))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestMaxEdgeDepthSharedDependency(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithMaxEdgeDepth(2)},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	j1, err := l.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	started := make(chan struct{})
+	v4 := vtx(vtxOpt{
+		name:  "v4",
+		value: "result4",
+		execPreFunc: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	v3 := vtx(vtxOpt{
+		name:   "v3",
+		value:  "result3",
+		inputs: []Edge{{Vertex: v4}},
+	})
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, Edge{Vertex: v3})
+		return err
+	})
+	<-started
+
+	// v4 is at depth 1 of the first build, requesting v3 from a deeper edge
+	// moves it to depth 3
+	_, err = j1.Build(ctx, Edge{Vertex: vtx(vtxOpt{
+		name:  "v0",
+		value: "result0",
+		inputs: []Edge{{Vertex: vtx(vtxOpt{
+			name:   "v1",
+			value:  "result1",
+			inputs: []Edge{{Vertex: v3}},
+		})}},
+	})})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrGraphTooDeep))
+
+	err = eg.Wait()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrGraphTooDeep))
+}
+
+func TestStatsCacheHitRatio(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	require.Equal(t, float64(0), s.Stats().CacheHitRatio(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				cacheKeySeed: "seed0",
+				value:        "result0",
+			}),
+		}
+		res, err := j.Build(ctx, g)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		require.NoError(t, j.Discard())
+	}
+
+	st := s.Stats()
+	require.Equal(t, 1, st.ExecutedEdges)
+	require.Equal(t, 1, st.CachedEdges)
+	require.Equal(t, 0.5, st.CacheHitRatio(time.Minute))
+	require.Equal(t, float64(0), st.CacheHitRatio(0))
+}
+
+func TestResumeOnNewSolver(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	cacheManager := NewInMemoryCacheManager()
+
+	s0 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer s0.Close()
+
+	started := make(chan struct{})
+	var execCount int64
+
+	v1 := vtx(vtxOpt{
+		name:  "v1",
+		value: "result1",
+	})
+	v1.setupCallCounters()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: v1}},
+			execPreFunc: func(ctx context.Context) error {
+				// only the first exec blocks until the build is canceled
+				if atomic.AddInt64(&execCount, 1) == 1 {
+					close(started)
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			},
+		}),
+	}
+
+	j0, err := s0.NewJob("job0")
+	require.NoError(t, err)
+
+	buildCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := j0.Build(WithBuildLabels(buildCtx, map[string]string{"tenant": "a"}), g0)
+		errCh <- err
+	}()
+
+	<-started
+	reqs := s0.ActiveBuilds()
+	require.Equal(t, 1, len(reqs))
+	require.Equal(t, "job0", reqs[0].JobID)
+	require.Equal(t, "a", reqs[0].Labels["tenant"])
+
+	cancel()
+	require.True(t, errors.Is(<-errCh, context.Canceled))
+	require.NoError(t, j0.Discard())
+	require.Equal(t, 0, len(s0.ActiveBuilds()))
+
+	s1 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer s1.Close()
+
+	j1, err := s1.NewJob(reqs[0].JobID)
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	res, err := j1.Resume(ctx, reqs[0])
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	// completed dependency is loaded from the cache
+	require.Equal(t, int64(1), *v1.execCallCount)
+	require.Equal(t, int64(2), atomic.LoadInt64(&execCount))
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
+func TestFairQueuing(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil, WithQueuePolicy(QueuePolicyFair))
+	// stopped scheduler never drains the queue
+	s.Stop()
+
+	b0 := &activeBuild{}
+	b1 := &activeBuild{}
+
+	newOwnedEdge := func(name string, b *activeBuild, cost int) *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{name: name, cost: cost})}, nil, newEdgeIndex())
+		e.owner = b
+		return e
+	}
+
+	// b0 has many cheap edges, b1 a single expensive one
+	e0 := newOwnedEdge("e0", b0, 1)
+	e1 := newOwnedEdge("e1", b0, 1)
+	e2 := newOwnedEdge("e2", b0, 1)
+	e3 := newOwnedEdge("e3", b1, 2)
+	e4 := newEdge(Edge{Vertex: vtx(vtxOpt{name: "e4"})}, nil, newEdgeIndex())
+
+	for _, e := range []*edge{e0, e1, e2, e3, e4} {
+		s.signal(e)
+	}
+
+	var order []string
+	for {
+		s.muQ.Lock()
+		l := s.pop()
+		s.muQ.Unlock()
+		if l == nil {
+			break
+		}
+		s.charge(l.e)
+		order = append(order, l.e.edge.Vertex.Name())
+	}
+	// edges without a build are not accounted and skip ahead
+	require.Equal(t, []string{"e4", "e0", "e3", "e1", "e2"}, order)
+	require.Nil(t, s.last)
+	require.Equal(t, int64(3), b0.cost)
+	require.Equal(t, int64(2), b1.cost)
+}
+
+func TestLeastBuildCost(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil)
+	s.Stop()
+
+	require.Equal(t, int64(0), s.leastBuildCost())
+
+	// a zero cost is a valid minimum and must not restart the search
+	s.builds[&activeBuild{cost: 0}] = struct{}{}
+	s.builds[&activeBuild{cost: 5}] = struct{}{}
+	for i := 0; i < 20; i++ {
+		require.Equal(t, int64(0), s.leastBuildCost())
+	}
+
+	s.builds = map[*activeBuild]struct{}{
+		{cost: 7}: {},
+		{cost: 3}: {},
+	}
+	require.Equal(t, int64(3), s.leastBuildCost())
+}
+
+func TestSchedulerConcurrency(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithConcurrency(1)},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	var running, maxRunning int64
+	track := func(context.Context) error {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{execPreFunc: track, cachePreFunc: track})},
+				{Vertex: vtxConst(3, vtxOpt{execPreFunc: track, cachePreFunc: track})},
+				{Vertex: vtxConst(4, vtxOpt{execPreFunc: track, cachePreFunc: track})},
+			},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 10, unwrapInt(res))
+	require.Equal(t, int64(1), atomic.LoadInt64(&maxRunning))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestResolveCacheKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{
+				name:         "v1",
+				cacheKeySeed: "seed1",
+				value:        "result1",
+			})}},
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	keys, err := j0.ResolveCacheKeys(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), *g0.Vertex.(*vertex).execCallCount)
+	require.Equal(t, int64(2), *g0.Vertex.(*vertex).cacheCallCount)
+
+	require.Len(t, keys, 1)
+	require.Equal(t, digest.FromBytes([]byte("seed:seed0")), keys[0].Digest())
+	deps := keys[0].Deps()
+	require.Len(t, deps, 1)
+	require.Len(t, deps[0], 1)
+	require.Equal(t, digest.FromBytes([]byte("seed:seed1")), deps[0][0].CacheKey.Digest())
+
+	// the edge can still be built
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+	require.Equal(t, int64(2), *g0.Vertex.(*vertex).execCallCount)
+
+	keys, err = j0.ResolveCacheKeys(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, res.CacheKeys(), keys)
+}
+
+func TestResolveCacheKeysSlowCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	newGraph := func() Edge {
+		return Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				cacheKeySeed: "seed0",
+				value:        "result0",
+				inputs: []Edge{{Vertex: vtx(vtxOpt{
+					name:         "v1",
+					cacheKeySeed: "seed1",
+					value:        "result1",
+				})}},
+				slowCacheCompute: map[int]ResultBasedCacheFunc{
+					0: digestFromResult,
+				},
+			}),
+		}
+	}
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	keys, err := j0.ResolveCacheKeys(ctx, newGraph())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	res, err := j1.Build(ctx, newGraph())
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	// the resolved key includes the content based key of the dependency
+	// like the key recorded by the execution
+	deps := keys[0].Deps()
+	require.Len(t, deps, 1)
+	require.Len(t, deps[0], 2)
+	require.Equal(t, digest.FromBytes([]byte("result1")), deps[0][1].CacheKey.Digest())
+	require.Equal(t, res.CacheKeys()[0].Digest(), keys[0].Digest())
+	require.Equal(t, len(res.CacheKeys()[0].Deps()[0]), len(deps[0]))
+}
+
+func TestWaitForState(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	loaded := make(chan struct{})
+	release := make(chan struct{})
+
+	v1 := vtx(vtxOpt{
+		name:  "v1",
+		value: "result1",
+		cachePreFunc: func(context.Context) error {
+			close(loaded)
+			return nil
+		},
+	})
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: v1}},
+			execPreFunc: func(context.Context) error {
+				<-release
+				return nil
+			},
+		}),
+	}
+
+	eg, egctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(egctx, g0)
+		return err
+	})
+
+	<-loaded
+	// dependency completes while the root is still blocked
+	require.NoError(t, j0.WaitForState(ctx, Edge{Vertex: v1}, EdgeStateComplete))
+
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	err = j0.WaitForState(waitCtx, g0, EdgeStateComplete)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.Canceled))
+
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.NoError(t, j0.WaitForState(ctx, g0, EdgeStateComplete))
+	require.Error(t, j0.WaitForState(ctx, g0, EdgeState(10)))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestBuildResultClone(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	newResult := func() *SharedCachedResult {
+		return NewSharedCachedResult(NewCachedResult(&dummyResult{id: "r0", value: "result0"}, nil))
+	}
+
+	s := newScheduler(nil, withManualDispatch())
+	res := newResult()
+	cr, _, err := s.buildResult(e, &edgeState{result: res}, buildOpt{})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(cr))
+	require.NoError(t, cr.Release(ctx))
+
+	// released results can't be cloned
+	require.NoError(t, res.Release(ctx))
+	_, _, err = s.buildResult(e, &edgeState{result: res}, buildOpt{})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrResultReleased))
+
+	_, _, err = s.buildResult(e, &edgeState{}, buildOpt{})
+	require.Error(t, err)
+
+	// the unsafe fallback returns the shared result
+	s = newScheduler(nil, withManualDispatch(), WithUnsafeCloneFallback())
+	res = newResult()
+	require.NoError(t, res.Release(ctx))
+	cr, _, err = s.buildResult(e, &edgeState{result: res}, buildOpt{})
+	require.NoError(t, err)
+	require.Equal(t, res, cr)
+}
+
+type wrappedResult struct {
+	CachedResult
+}
+
+func TestResultExtractor(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithResultExtractor(func(v interface{}) (CachedResult, error) {
+			res := v.(*edgeState).result
+			if res == nil {
+				return nil, nil
+			}
+			return &wrappedResult{CachedResult: res.CloneCachedResult()}, nil
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0"})})
+	require.NoError(t, err)
+	require.IsType(t, &wrappedResult{}, res)
+	require.Equal(t, "result0", unwrap(res))
+	require.NoError(t, res.Release(ctx))
+}
+
+func TestPendingMerges(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil, withManualDispatch())
+	require.Empty(t, s.PendingMerges())
+
+	// queue without the merge loop so the edges stay pending
+	s.mergesQueued = map[*edge]struct{}{}
+	e0 := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	e1 := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v1"})}, nil, newEdgeIndex())
+	e1.keys = []ExportableCacheKey{{CacheKey: NewCacheKey(digest.FromBytes([]byte("foo")), 0)}}
+	s.mu.Lock()
+	s.deferMerge(e0)
+	s.deferMerge(e1)
+	s.deferMerge(e0)
+	s.mu.Unlock()
+
+	merges := s.PendingMerges()
+	require.Len(t, merges, 2)
+	require.Equal(t, "v0", merges[0].Edge.Vertex.Name())
+	require.Equal(t, 0, merges[0].Keys)
+	require.True(t, merges[0].Deferred)
+	require.Equal(t, "v1", merges[1].Edge.Vertex.Name())
+	require.Equal(t, 1, merges[1].Keys)
+}
+
+func TestBuildAfterStop(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0"})}
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	s.Close()
+
+	// completed and new edges are both rejected
+	_, err = j0.Build(ctx, g0)
+	require.True(t, errors.Is(err, ErrSchedulerStopped))
+	_, err = j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})})
+	require.True(t, errors.Is(err, ErrSchedulerStopped))
+	require.True(t, errors.Is(j0.WaitForState(ctx, g0, EdgeStateComplete), ErrSchedulerStopped))
+}
+
+func TestMergeSelector(t *testing.T) {
+	t.Parallel()
+
+	normalized := digest.FromBytes([]byte("normalized"))
+	var calls []Index
+	s := newScheduler(nil, WithMergeSelector(func(target, src Edge, index Index, sel digest.Digest) digest.Digest {
+		calls = append(calls, index)
+		return normalized
+	}))
+	// stopped scheduler doesn't dispatch the merged edge
+	s.Stop()
+
+	v0 := vtx(vtxOpt{name: "v0"})
+	newMergeEdge := func() *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{
+			name:   "v1",
+			inputs: []Edge{{Vertex: v0}},
+		})}, nil, newEdgeIndex())
+		e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+		e.deps = []*dep{newDep(0)}
+		return e
+	}
+	target := newMergeEdge()
+	src := newMergeEdge()
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	src.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+
+	s.mu.Lock()
+	require.True(t, s.mergeTo(target, src))
+	s.mu.Unlock()
+
+	require.Equal(t, []Index{0}, calls)
+	exps := target.getSecondaryExporters()
+	require.Len(t, exps, 1)
+	require.Equal(t, normalized, exps[0].cacheKey.Selector)
+}
+
+func TestRefusedMergeNotRetried(t *testing.T) {
+	t.Parallel()
+
+	// every definition is different so all merges are refused
+	var digests int
+	s := newScheduler(nil, WithDefinitionDigest(func(context.Context, Vertex) (digest.Digest, error) {
+		digests++
+		return digest.FromBytes([]byte(fmt.Sprint(digests))), nil
+	}))
+	s.Stop()
+
+	index := newEdgeIndex()
+	v0 := vtx(vtxOpt{name: "v0"})
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	newMergeEdge := func() *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed1",
+			inputs:       []Edge{{Vertex: v0}},
+		})}, nil, index)
+		e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+		e.deps = []*dep{newDep(0)}
+		e.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+		return e
+	}
+	target := newMergeEdge()
+	src := newMergeEdge()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tryMerge(target)
+	require.Equal(t, 0, digests)
+
+	s.tryMerge(src)
+	require.Equal(t, 2, digests)
+
+	// same index key is not merged again
+	s.tryMerge(src)
+	require.Equal(t, 2, digests)
+
+	dk2 := NewCacheKey(digest.FromBytes([]byte("bar")), 0)
+	src.deps[0].keys = append(src.deps[0].keys, ExportableCacheKey{CacheKey: dk2, Exporter: &exporter{k: dk2}})
+	s.tryMerge(src)
+	require.Equal(t, 4, digests)
+	require.Equal(t, 0, s.stats.merges)
+}
+
+func TestIndexKeyPolicy(t *testing.T) {
+	t.Parallel()
+
+	dk1 := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	dk2 := NewCacheKey(digest.FromBytes([]byte("bar")), 0)
+
+	for _, tc := range []struct {
+		policy IndexKeyPolicy
+		merges int
+	}{
+		{IndexKeyPolicyAll, 1},
+		{IndexKeyPolicyFirst, 0},
+	} {
+		s := newScheduler(testEdgeFactory{}, WithIndexKeyPolicy(tc.policy))
+		s.Stop()
+
+		index := newEdgeIndex()
+		v0 := vtx(vtxOpt{name: "v0"})
+		newMergeEdge := func(name string, keys ...*CacheKey) *edge {
+			e := newEdge(Edge{Vertex: vtx(vtxOpt{
+				name:         name,
+				cacheKeySeed: "seed1",
+				inputs:       []Edge{{Vertex: v0}},
+			})}, nil, index)
+			e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+			e.deps = []*dep{newDep(0)}
+			for _, k := range keys {
+				e.deps[0].keys = append(e.deps[0].keys, ExportableCacheKey{CacheKey: k, Exporter: &exporter{k: k}})
+			}
+			return e
+		}
+		// dependencies only share their second key
+		target := newMergeEdge("v1", dk1, dk2)
+		src := newMergeEdge("v2", dk2)
+
+		s.mu.Lock()
+		s.tryMerge(target)
+		s.tryMerge(src)
+		require.Equal(t, tc.merges, s.stats.merges, "policy %d", tc.policy)
+		s.mu.Unlock()
+	}
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{name: "sum", inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{name: "c2"})},
+			{Vertex: vtxConst(3, vtxOpt{name: "c3"})},
+		}}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+
+	snap := l.IndexSnapshot()
+	require.Len(t, snap.Entries, l.Stats().IndexEntries)
+	names := map[string]string{}
+	var links int
+	for _, ent := range snap.Entries {
+		if ent.Edge != nil {
+			names[ent.Edge.Name] = ent.Edge.ResultID
+		}
+		links += len(ent.Links)
+	}
+	require.Contains(t, names, "sum")
+	require.NotEmpty(t, names["sum"])
+	require.Equal(t, 2, links)
+
+	dt, err := json.Marshal(snap)
+	require.NoError(t, err)
+	var loaded IndexSnapshot
+	require.NoError(t, json.Unmarshal(dt, &loaded))
+
+	l2 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l2.Close()
+	require.NoError(t, l2.RestoreIndex(&loaded))
+	require.Equal(t, snap, l2.IndexSnapshot())
+
+	require.Error(t, l.RestoreIndex(&loaded))
+}
+
+func TestIndexSnapshotStableIDs(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	snapshot := func() *IndexSnapshot {
+		l := NewSolver(SolverOpt{
+			ResolveOpFunc: testOpResolver,
+		})
+		defer l.Close()
+
+		j0, err := l.NewJob("j0")
+		require.NoError(t, err)
+		defer j0.Discard()
+
+		_, err = j0.Build(ctx, Edge{
+			Vertex: vtxSum(1, vtxOpt{name: "sum", inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{name: "c2"})},
+				{Vertex: vtxConst(3, vtxOpt{name: "c3"})},
+			}}),
+		})
+		require.NoError(t, err)
+		snap := l.IndexSnapshot()
+		// result IDs are random in the test worker
+		for i := range snap.Entries {
+			snap.Entries[i].Edge = nil
+		}
+		return snap
+	}
+
+	snap := snapshot()
+	require.NotEmpty(t, snap.Entries)
+	require.Equal(t, snap, snapshot())
+}
+
+func TestPreferMergeTarget(t *testing.T) {
+	t.Parallel()
+
+	ef := testEdgeFactory{}
+	s := newScheduler(ef, WithPreferMergeTarget(func(existing, incoming Edge) bool {
+		return incoming.Vertex.Name() == "local"
+	}))
+	s.Stop()
+
+	index := newEdgeIndex()
+	v0 := vtx(vtxOpt{name: "v0"})
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	newMergeEdge := func(name string) *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{
+			name:         name,
+			cacheKeySeed: "seed1",
+			inputs:       []Edge{{Vertex: v0}},
+		})}, nil, index)
+		e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+		e.deps = []*dep{newDep(0)}
+		e.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+		return e
+	}
+	remote := newMergeEdge("remote")
+	local := newMergeEdge("local")
+	other := newMergeEdge("other")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tryMerge(remote)
+	s.tryMerge(local)
+	require.Equal(t, 1, s.stats.merges)
+	require.Equal(t, local, ef[remote.edge])
+	_, ok := ef[local.edge]
+	require.False(t, ok)
+
+	// the index points to the new target
+	s.tryMerge(other)
+	require.Equal(t, 2, s.stats.merges)
+	require.Equal(t, local, ef[other.edge])
+	require.Equal(t, 2, local.mergedCount)
+}
+
+func TestKeepFinishedWorkOnMerge(t *testing.T) {
+	t.Parallel()
+
+	for _, keep := range []bool{false, true} {
+		var opts []SchedulerOption
+		if keep {
+			opts = append(opts, WithKeepFinishedWorkOnMerge())
+		}
+		s := newScheduler(nil, opts...)
+		// stopped scheduler doesn't dispatch the merged edge
+		s.Stop()
+
+		v0 := vtx(vtxOpt{name: "v0"})
+		newMergeEdge := func() *edge {
+			e := newEdge(Edge{Vertex: vtx(vtxOpt{
+				name:   "v1",
+				inputs: []Edge{{Vertex: v0}},
+			})}, nil, newEdgeIndex())
+			e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+			e.deps = []*dep{newDep(0)}
+			return e
+		}
+		target := newMergeEdge()
+		src := newMergeEdge()
+
+		s.mu.Lock()
+		done := make(chan struct{})
+		src.execReq = s.newRequestWithFunc(src, func(context.Context) (interface{}, error) {
+			defer close(done)
+			return NewCachedResult(&dummyResult{id: "r0", value: "result0"}, nil), nil
+		})
+		s.mu.Unlock()
+		<-done
+		out := s.outgoing[src][0]
+		if keep {
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&out.finished) == 1
+			}, time.Second, time.Millisecond)
+		}
+
+		s.mu.Lock()
+		require.True(t, s.mergeTo(target, src))
+		if keep {
+			require.Equal(t, out.Receiver, target.execReq)
+			require.False(t, out.Sender.Request().Canceled)
+		} else {
+			require.Nil(t, target.execReq)
+			require.True(t, out.Sender.Request().Canceled)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestMergeWhileExporting(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := newScheduler(nil)
+	// stopped scheduler doesn't dispatch the merged edge
+	s.Stop()
+
+	v0 := vtx(vtxOpt{name: "v0"})
+	target := newEdge(Edge{Vertex: vtx(vtxOpt{
+		name:   "v1",
+		inputs: []Edge{{Vertex: v0}},
+	})}, nil, newEdgeIndex())
+	target.cacheMap = target.edge.Vertex.(*vertex).makeCacheMap()
+	target.deps = []*dep{newDep(0)}
+
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	src := newEdge(Edge{Vertex: vtx(vtxOpt{
+		name:   "v1",
+		inputs: []Edge{{Vertex: v0}},
+	})}, nil, newEdgeIndex())
+	src.cacheMap = src.edge.Vertex.(*vertex).makeCacheMap()
+	src.deps = []*dep{newDep(0)}
+	src.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+
+	k := NewCacheKey(digest.FromBytes([]byte("bar")), 0)
+	k.deps = [][]CacheKeyWithSelector{{{CacheKey: ExportableCacheKey{CacheKey: dk, Exporter: &exporter{k: dk}}}}}
+	exp := &exporter{k: k, edge: target}
+
+	const merges = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < merges; i++ {
+			s.mu.Lock()
+			s.mergeTo(target, src)
+			s.mu.Unlock()
+		}
+	}()
+
+	for exporting := true; exporting; {
+		select {
+		case <-done:
+			exporting = false
+		default:
+		}
+		_, err := exp.ExportTo(ctx, newTestExporterTarget(), testExporterOpts(true))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, merges, len(target.getSecondaryExporters()))
+}
+
+func TestBuildNoClone(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+		}),
+	}
+
+	res0, err := j0.BuildNoClone(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res0))
+
+	res1, err := j0.BuildNoClone(ctx, g0)
+	require.NoError(t, err)
+	// both builds return the result held by the solver
+	require.True(t, res0 == res1)
+
+	res2, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res2))
+	require.False(t, res0 == res2)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestStatsLoopWaiting(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil)
+
+	// idle loop parks waiting for signals
+	require.Eventually(t, func() bool {
+		return s.Stats().LoopWaiting
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, 0, s.Stats().QueueLength)
+
+	// stopped loop doesn't process the queue
+	s.Stop()
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex()))
+
+	st := s.Stats()
+	require.False(t, st.LoopWaiting)
+	require.Equal(t, 1, st.QueueLength)
+}
+
+func TestStatsSignals(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{})},
+			{Vertex: vtxConst(3, vtxOpt{})},
+		}}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+
+	// every dispatch was signaled once
+	st := s.Stats()
+	require.Equal(t, st.Dispatch.Dispatches, st.Signals)
+	require.Greater(t, st.Wakeups, 0)
+	require.LessOrEqual(t, st.Wakeups, st.Signals)
+
+	// edges that are already queued are not signaled again
+	sch := newScheduler(nil)
+	sch.Stop()
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{})}, nil, newEdgeIndex())
+	sch.signal(e)
+	sch.signal(e)
+	require.Equal(t, 1, sch.Stats().Signals)
+}
+
+func TestInputResolver(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithInputResolver(func(e Edge) (CachedResult, bool) {
+			switch e.Vertex.Name() {
+			case "resolved":
+				k := NewCacheKey(digest.FromString("resolved"), 0)
+				return NewCachedResult(&dummyResult{id: "r0", intValue: 5}, []ExportableCacheKey{
+					{CacheKey: k, Exporter: &exporter{k: k}},
+				}), true
+			case "nokeys":
+				return NewCachedResult(&dummyResult{id: "r1", intValue: 7}, nil), true
+			}
+			return nil, false
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	var execs int64
+	count := func(context.Context) error {
+		atomic.AddInt64(&execs, 1)
+		return nil
+	}
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: vtxConst(2, vtxOpt{name: "resolved", execPreFunc: count})},
+			{Vertex: vtxConst(3, vtxOpt{name: "unresolved", execPreFunc: count})},
+			{Vertex: vtxConst(4, vtxOpt{name: "nokeys", execPreFunc: count})},
+		}}),
+	})
+	require.NoError(t, err)
+	// the resolved input is replaced, the others are evaluated
+	require.Equal(t, 13, unwrapInt(res))
+	require.Equal(t, int64(2), atomic.LoadInt64(&execs))
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	s.Pause()
+	s.Pause()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	type result struct {
+		res CachedResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := j0.Build(ctx, Edge{
+			Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{})},
+			}}),
+		})
+		done <- result{res, err}
+	}()
+
+	require.Eventually(t, func() bool {
+		st := s.Stats()
+		return st.Paused && st.QueueLength > 0
+	}, time.Second, time.Millisecond)
+	require.True(t, s.IsHealthy(time.Nanosecond))
+
+	select {
+	case <-done:
+		t.Fatal("build completed while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Equal(t, 0, s.Stats().Dispatch.Dispatches)
+
+	s.Resume()
+	s.Resume()
+
+	r := <-done
+	require.NoError(t, r.err)
+	require.Equal(t, 3, unwrapInt(r.res))
+	require.False(t, s.Stats().Paused)
+}
+
+func TestResultValidator(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var reject int64 = 1
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithResultValidator(func(e Edge, res CachedResult) error {
+			if atomic.LoadInt64(&reject) == 1 && unwrap(res) == "result0" {
+				return errors.Errorf("corrupt result")
+			}
+			return nil
+		})},
+	})
+	defer s.Close()
+
+	newGraph := func() Edge {
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				cacheKeySeed: "seed0",
+				value:        "result0",
+			}),
+		}
+		g.Vertex.(*vertex).setupCallCounters()
+		return g
+	}
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	_, err = j0.Build(ctx, newGraph())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupt result")
+	require.NoError(t, j0.Discard())
+
+	atomic.StoreInt64(&reject, 0)
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	// rejected result was not saved to the cache
+	g1 := newGraph()
+	res, err := j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+	require.Equal(t, int64(1), *g1.Vertex.(*vertex).execCallCount)
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
+func TestNonShareableNoMerge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	wait2Ready := blockingFuncion(2)
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			cachePreFunc: wait2Ready,
+			execDelay:    50 * time.Millisecond,
+			value:        "result0",
+			nonShareable: true,
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed0", // same as g0
+			cachePreFunc: wait2Ready,
+			execDelay:    50 * time.Millisecond,
+			value:        "result0",
+			nonShareable: true,
+		}),
+	}
+	g1.Vertex.(*vertex).setupCallCounters()
+
+	eg, _ := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		res, err := j0.Build(ctx, g0)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		return err
+	})
+
+	eg.Go(func() error {
+		res, err := j1.Build(ctx, g1)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		return err
+	})
+
+	require.NoError(t, eg.Wait())
+
+	// edges with matching keys were not merged
+	require.Equal(t, int64(1), *g0.Vertex.(*vertex).execCallCount)
+	require.Equal(t, int64(1), *g1.Vertex.(*vertex).execCallCount)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
+func TestNonShareableBuild(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	wait2Ready := blockingFuncion(2)
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			cachePreFunc: wait2Ready,
+			execDelay:    50 * time.Millisecond,
+			value:        "result0",
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed0", // same as g0
+			cachePreFunc: wait2Ready,
+			execDelay:    50 * time.Millisecond,
+			value:        "result0",
+		}),
+	}
+	g1.Vertex.(*vertex).setupCallCounters()
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		res, err := j0.Build(WithNonShareableBuild(ctx), g0)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		return err
+	})
+	eg.Go(func() error {
+		res, err := j1.Build(WithNonShareableBuild(ctx), g1)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		return err
+	})
+	require.NoError(t, eg.Wait())
+
+	// edges of the builds were not merged or indexed
+	require.Equal(t, int64(1), *g0.Vertex.(*vertex).execCallCount)
+	require.Equal(t, int64(1), *g1.Vertex.(*vertex).execCallCount)
+	require.Equal(t, 0, s.Stats().IndexEntries)
+}
+
+func TestCancelEvents(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var mu sync.Mutex
+	var events []CancelEvent
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithCancelHandler(func(ev CancelEvent) {
+			mu.Lock()
+			events = append(events, ev)
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	hasEvent := func(reason CancelReason, dgst digest.Digest) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ev := range events {
+			if ev.Reason == reason && ev.Edge.Vertex.Digest() == dgst {
+				return true
+			}
+		}
+		return false
+	}
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			execPreFunc: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}),
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = j0.Build(timeoutCtx, g0)
+	require.Error(t, err)
+	require.True(t, hasEvent(CancelReasonTimeout, g0.Vertex.Digest()))
+
+	mu.Lock()
+	require.Equal(t, "job0", events[0].Build.JobID)
+	mu.Unlock()
+
+	// failing dependency cancels the request to its sibling
+	v2 := vtx(vtxOpt{
+		name:  "v2",
+		value: "result2",
+		execPreFunc: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v1",
+			value: "result1",
+			inputs: []Edge{
+				{Vertex: vtx(vtxOpt{
+					name:  "v3",
+					value: "result3",
+					execPreFunc: func(context.Context) error {
+						return errors.Errorf("failed")
+					},
+				})},
+				{Vertex: v2},
+			},
+		}),
+	}
+
+	_, err = j0.Build(ctx, g1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed")
+	require.True(t, hasEvent(CancelReasonFailure, v2.Digest()))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestMaxRetainedResults(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithMaxRetainedResults(1)},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	v1 := vtx(vtxOpt{
+		name:  "v1",
+		value: "result1",
+	})
+	v1.setupCallCounters()
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: v1}},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	// result of the dependency was released when the root completed
+	st := s.getState(Edge{Vertex: v1})
+	require.NotNil(t, st)
+	st.mu.Lock()
+	require.Equal(t, 0, len(st.edges))
+	st.mu.Unlock()
+
+	// evicted edge is loaded from the cache on the next request
+	res, err = j0.Build(ctx, Edge{Vertex: v1})
+	require.NoError(t, err)
+	require.Equal(t, "result1", unwrap(res))
+	require.Equal(t, int64(1), *v1.execCallCount)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+// releasingEdgeFactory is a testEdgeFactory that lets every edge be released
+type releasingEdgeFactory struct {
+	testEdgeFactory
+}
+
+func (ef releasingEdgeFactory) releaseEdge(*edge) bool { return true }
+
+func TestTouchResultKeepsTouchedEdge(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(releasingEdgeFactory{testEdgeFactory{}}, withManualDispatch(), WithMaxRetainedResults(1))
+	defer s.Stop()
+
+	newCompletedEdge := func(name string) *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{name: name})}, nil, newEdgeIndex())
+		e.result = NewSharedCachedResult(NewCachedResult(&dummyResult{id: name}, nil))
+		e.state = edgeStatusComplete
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// e0 is in use so only the touched edge could be evicted
+	e0 := newCompletedEdge("e0")
+	s.incoming[e0] = []*edgePipe{{}}
+	s.touchResult(e0)
+	e1 := newCompletedEdge("e1")
+	s.touchResult(e1)
+
+	require.Contains(t, s.retention.items, e0)
+	require.Contains(t, s.retention.items, e1)
+}
+
+func TestManualDispatch(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{withManualDispatch()},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}},
+		}),
+	}
+
+	done := make(chan struct{})
+	var res CachedResult
+	go func() {
+		defer close(done)
+		res, err = j0.Build(ctx, g0)
+	}()
+
+	// nothing is dispatched without stepping
+	select {
+	case <-done:
+		t.Fatal("build completed without dispatch")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	names := stepScheduler(s.s, done)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	require.Equal(t, "v0", names[0])
+	require.Equal(t, "v0", names[len(names)-1])
+	require.Contains(t, names, "v1")
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+// stepScheduler drives a scheduler created with withManualDispatch until done
+// is closed and returns the names of the dispatched edges in order
+func stepScheduler(s *scheduler, done <-chan struct{}) []string {
+	var names []string
+	for {
+		if e := s.step(); e != nil {
+			names = append(names, e.edge.Vertex.Name())
+			continue
+		}
+		select {
+		case <-done:
+			return names
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestEdgeInfoMerged(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	wait2Ready := blockingFuncion(2)
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			cachePreFunc: wait2Ready,
+			value:        "result0",
+		}),
+	}
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed0", // same as g0
+			cachePreFunc: wait2Ready,
+			value:        "result0",
+		}),
+	}
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+	eg.Go(func() error {
+		_, err := j1.Build(ctx, g1)
+		return err
+	})
+	require.NoError(t, eg.Wait())
+
+	info0 := s.EdgeInfo(g0)
+	info1 := s.EdgeInfo(g1)
+	require.NotNil(t, info0)
+	require.NotNil(t, info1)
+	require.True(t, info0.Complete)
+	require.True(t, info1.Complete)
+
+	// one edge was merged to the other
+	require.Equal(t, 1, info0.MergedCount+info1.MergedCount)
+	target, src := g0, info1
+	if info0.MergedCount == 0 {
+		target, src = g1, info0
+	}
+	require.NotNil(t, src.MergedTo)
+	require.Equal(t, target.Vertex.Digest(), src.MergedTo.Vertex.Digest())
+	require.Nil(t, s.EdgeInfo(target).MergedTo)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
+func TestAdmissionRateClock(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	clock := newFakeClock()
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithAdmissionRate(1, time.Hour),
+			WithClock(clock),
+		},
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+		{Vertex: vtxConst(2, vtxOpt{})},
+		{Vertex: vtxConst(3, vtxOpt{})},
+	}})}
+
+	done := make(chan error, 1)
+	var res CachedResult
+	go func() {
+		var err error
+		res, err = j0.Build(ctx, g0)
+		done <- err
+	}()
+
+	// 3 new edges with 1 admitted per interval need 2 more intervals
+	advanced := 0
+loop:
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			break loop
+		case <-clock.added:
+			advanced++
+			clock.Advance(time.Hour)
+		}
+	}
+	require.Equal(t, 6, unwrapInt(res))
+	require.Equal(t, 2, advanced)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+// fakeClock is a Clock that only moves forward with Advance
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+	added  chan struct{}
+}
+
+type fakeTimer struct {
+	c    *fakeClock
+	when time.Time
+	f    func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Now(),
+		timers: map[*fakeTimer]struct{}{},
+		added:  make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), f: f}
+	c.timers[t] = struct{}{}
+	c.added <- struct{}{}
+	return t
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for t := range c.timers {
+		if !t.when.After(c.now) {
+			due = append(due, t)
+			delete(c.timers, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	_, ok := t.c.timers[t]
+	delete(t.c.timers, t)
+	return ok
+}
+
+func TestBuildStatusMinInterval(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	clock := newFakeClock()
+	s := newScheduler(testEdgeFactory{}, withManualDispatch(), WithClock(clock))
+	defer s.Stop()
+	for len(clock.added) > 0 {
+		<-clock.added
+	}
+
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	req := BuildRequest{JobID: "j0", Edge: e.edge}
+	s.builds[&activeBuild{edge: e, request: &req, done: make(chan struct{})}] = struct{}{}
+
+	// a zero interval doesn't poll continuously
+	ch := s.BuildStatus(ctx, req, 0)
+	<-clock.added
+	clock.Advance(minBuildStatusInterval / 2)
+	select {
+	case <-ch:
+		t.Fatal("status sent before the minimum interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(minBuildStatusInterval / 2)
+	<-ch
+}
+
+func TestConditionalEdge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	isNonZero := func(ctx context.Context, res Result) (bool, error) {
+		return res.Sys().(*dummyResult).intValue != 0, nil
+	}
+
+	for _, tc := range []struct {
+		predicate int
+		result    int
+		execs     int64
+	}{
+		{predicate: 0, result: 5, execs: 0},
+		{predicate: 1, result: 8, execs: 1},
+	} {
+		j0, err := s.NewJob(fmt.Sprintf("job%d", tc.predicate))
+		require.NoError(t, err)
+
+		var execs int64
+		cond := vtxConst(3, vtxOpt{
+			execPreFunc: func(context.Context) error {
+				atomic.AddInt64(&execs, 1)
+				return nil
+			},
+			condition: &Condition{
+				Edge:  Edge{Vertex: vtxConst(tc.predicate, vtxOpt{})},
+				Check: isNonZero,
+			},
+		})
+		g0 := Edge{Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+			{Vertex: cond},
+			{Vertex: vtxConst(4, vtxOpt{})},
+		}})}
+
+		res, err := j0.Build(ctx, g0)
+		require.NoError(t, err)
+		require.Equal(t, tc.result, unwrapInt(res))
+		require.Equal(t, tc.execs, atomic.LoadInt64(&execs))
+
+		require.NoError(t, j0.Discard())
+	}
+}
+
+func TestConditionalEdgeNotShared(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	isNonZero := func(ctx context.Context, res Result) (bool, error) {
+		return res.Sys().(*dummyResult).intValue != 0, nil
+	}
+
+	// the same vertex is built by both jobs with a different condition
+	for i, predicate := range []int{1, 0} {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{Vertex: vtxConst(3, vtxOpt{
+			name: "cond",
+			condition: &Condition{
+				Edge:  Edge{Vertex: vtxConst(predicate, vtxOpt{})},
+				Check: isNonZero,
+			},
+		})}
+
+		res, err := j.Build(ctx, g)
+		require.NoError(t, err)
+		if predicate == 0 {
+			require.True(t, IsSkipped(res))
+		} else {
+			require.Equal(t, 3, unwrapInt(res))
+		}
+	}
+}
+
+func TestWhyBlocked(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	dep := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v1",
+			value: "result1",
+			execPreFunc: func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			},
+		}),
+	}
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{dep},
+		}),
+	}
+
+	require.Equal(t, "unknown edge", s.WhyBlocked(g0))
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	// the edges may still be queued for processing their last updates
+	require.Eventually(t, func() bool {
+		return s.WhyBlocked(g0) == "waiting on dep 0 (vertex v1)"
+	}, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return s.WhyBlocked(dep) == "executing"
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.Equal(t, "complete", s.WhyBlocked(g0))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestResultProcessorSharedOpt(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, e Edge, res Result) (Result, error) { return res, nil }
+	base := WithResultProcessor("base", noop)
+
+	s0 := newScheduler(nil, base, WithResultProcessor("s0", noop))
+	s0.Stop()
+	s1 := newScheduler(nil, base, WithResultProcessor("s1", noop))
+	s1.Stop()
+
+	// registrations don't leak into the other scheduler
+	require.Contains(t, s0.opt.ResultProcessors, "base")
+	require.Contains(t, s0.opt.ResultProcessors, "s0")
+	require.NotContains(t, s0.opt.ResultProcessors, "s1")
+	require.Contains(t, s1.opt.ResultProcessors, "s1")
+	require.NotContains(t, s1.opt.ResultProcessors, "s0")
+}
+
+func TestResultProcessor(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var processed int64
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithResultProcessor("upper", func(ctx context.Context, e Edge, res Result) (Result, error) {
+				atomic.AddInt64(&processed, 1)
+				return &dummyResult{id: res.ID(), value: strings.ToUpper(unwrap(res))}, nil
+			}),
+			WithResultProcessor("fail", func(ctx context.Context, e Edge, res Result) (Result, error) {
+				return nil, errors.Errorf("processor failed")
+			}),
+		},
+	})
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+
+		g0 := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				cacheKeySeed: "seed0",
+				value:        "result0",
+				typ:          "upper",
+			}),
+		}
+		g0.Vertex.(*vertex).setupCallCounters()
+
+		res, err := j.Build(ctx, g0)
+		require.NoError(t, err)
+		require.Equal(t, "RESULT0", unwrap(res))
+
+		require.NoError(t, j.Discard())
+	}
+	// cached result was already processed
+	require.Equal(t, int64(1), atomic.LoadInt64(&processed))
+
+	j, err := s.NewJob("job2")
+	require.NoError(t, err)
+	defer j.Discard()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v1",
+			value: "result1",
+			typ:   "fail",
+		}),
+	}
+	_, err = j.Build(ctx, g1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "processor failed")
+}
+
+func TestDiffTraces(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	rec := NewTraceRecorder()
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithTraceRecorder(rec)},
+	})
+	defer s.Close()
+
+	var traces []*BuildTrace
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+
+		g0 := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         "v0",
+				cacheKeySeed: "seed0",
+				value:        "result0",
+				inputs: []Edge{{
+					Vertex: vtx(vtxOpt{
+						name:         "v1",
+						cacheKeySeed: "seed1",
+						value:        "result1",
+					}),
+				}},
+			}),
+		}
+
+		rec.Reset()
+		res, err := j.Build(ctx, g0)
+		require.NoError(t, err)
+		require.Equal(t, "result0", unwrap(res))
+		traces = append(traces, rec.Snapshot())
+
+		require.NoError(t, j.Discard())
+	}
+
+	require.Len(t, traces[0].Vertexes, 2)
+	require.Equal(t, "v0", traces[0].Vertexes[0].Name)
+	require.False(t, traces[0].Vertexes[0].Cached)
+	require.Empty(t, DiffTraces(traces[0], traces[0]))
+
+	diff := DiffTraces(traces[0], traces[1])
+	byName := map[string]VertexTraceDiff{}
+	for _, d := range diff {
+		byName[d.Name] = d
+	}
+	require.True(t, byName["v0"].CacheChanged)
+	require.True(t, byName["v0"].B.Cached)
+
+	// the input doesn't need to be completed for the cached result
+	require.True(t, byName["v1"].CacheChanged)
+	require.False(t, byName["v1"].B.Completed)
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	cacheManager := newTrackingCacheManager(NewInMemoryCacheManager())
+	build := func(opts ...SchedulerOption) (*BuildTrace, int64) {
+		rec := NewTraceRecorder()
+		s := NewSolver(SolverOpt{
+			ResolveOpFunc:    testOpResolver,
+			DefaultCache:     cacheManager,
+			SchedulerOptions: append([]SchedulerOption{WithTraceRecorder(rec)}, opts...),
+		})
+		defer s.Close()
+
+		j, err := s.NewJob("job0")
+		require.NoError(t, err)
+		defer j.Discard()
+
+		// vertexes are aligned by digest so they need the same names in
+		// every build
+		g0 := Edge{
+			Vertex: vtxSum(1, vtxOpt{
+				name: "sum",
+				inputs: []Edge{
+					{Vertex: vtxConst(3, vtxOpt{name: "const3"})},
+					{Vertex: vtxConst(4, vtxOpt{name: "const4"})},
+				},
+			}),
+		}
+		g0.Vertex.(*vertexSum).setupCallCounters()
+
+		res, err := j.Build(ctx, g0)
+		require.NoError(t, err)
+		require.Equal(t, 8, unwrapInt(res))
+		return rec.Snapshot(), *g0.Vertex.(*vertexSum).execCallCount
+	}
+
+	trace0, execs := build()
+	require.Equal(t, int64(3), execs)
+
+	// without replay the result is loaded from the cache
+	trace1, execs := build()
+	require.Equal(t, int64(0), execs)
+	require.NotEmpty(t, DiffTraces(trace0, trace1))
+
+	// replay executes the vertexes again in the same order
+	trace2, execs := build(WithReplay(trace0))
+	require.Equal(t, int64(3), execs)
+	require.Empty(t, DiffTraces(trace0, trace2))
+}
+
+func TestCancelGroup(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var events []CancelEvent
+	var mu sync.Mutex
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithCancelHandler(func(ev CancelEvent) {
+			mu.Lock()
+			events = append(events, ev)
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blocking := func(ctx context.Context) error {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	}
+	shared := Edge{Vertex: vtx(vtxOpt{name: "shared", value: "shared", execPreFunc: blocking})}
+
+	g := NewCancelGroup()
+	groupCtx := WithCancelGroup(ctx, g)
+	errFailed := errors.Errorf("sibling failed")
+
+	var err0, err1, err2 error
+	var eg errgroup.Group
+	for i, c := range []struct {
+		ctx context.Context
+		g   Edge
+		err *error
+	}{
+		{ctx: groupCtx, g: Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0", execPreFunc: blocking})}, err: &err0},
+		{ctx: groupCtx, g: Edge{Vertex: vtx(vtxOpt{name: "v1", value: "result1", inputs: []Edge{shared}})}, err: &err1},
+		{ctx: ctx, g: Edge{Vertex: vtx(vtxOpt{name: "v2", value: "result2", inputs: []Edge{shared}})}, err: &err2},
+	} {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+		c := c
+		eg.Go(func() error {
+			_, *c.err = j.Build(c.ctx, c.g)
+			return nil
+		})
+	}
+
+	<-started
+	<-started
+	require.Eventually(t, func() bool {
+		return len(s.ActiveBuilds()) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 2, g.Cancel(errFailed))
+	require.Eventually(t, func() bool {
+		return len(s.ActiveBuilds()) == 1
+	}, time.Second, time.Millisecond)
+
+	// the edge shared with the build outside of the group keeps running
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.True(t, errors.Is(err0, errFailed))
+	require.True(t, errors.Is(err1, errFailed))
+	require.NoError(t, err2)
+
+	mu.Lock()
+	n := 0
+	for _, ev := range events {
+		if ev.Reason == CancelReasonGroup {
+			n++
+		}
+	}
+	mu.Unlock()
+	require.Equal(t, 2, n)
+
+	// builds started after the group was canceled fail immediately
+	j3, err := s.NewJob("job3")
+	require.NoError(t, err)
+	defer j3.Discard()
+	_, err = j3.Build(groupCtx, Edge{Vertex: vtx(vtxOpt{name: "v3", value: "result3"})})
+	require.True(t, errors.Is(err, errFailed))
+	require.Equal(t, errFailed, g.Err())
+}
+
+func TestOrphanedEdge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var mu sync.Mutex
+	var orphaned []string
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithOrphanHandler(func(e Edge) {
+			mu.Lock()
+			orphaned = append(orphaned, e.Vertex.Name())
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			execPreFunc: func(ctx context.Context) error {
+				close(started)
+				<-ctx.Done()
+				close(stopped)
+				return ctx.Err()
+			},
+		}),
+	}
+
+	buildCtx, cancel := context.WithCancel(ctx)
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(buildCtx, g0)
+		return err
+	})
+
+	<-started
+	mu.Lock()
+	require.Empty(t, orphaned)
+	mu.Unlock()
+
+	cancel()
+	require.Error(t, eg.Wait())
+
+	// the orphaned operation is canceled
+	<-stopped
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"v0"}, orphaned)
+}
+
+func TestMemoryPressure(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	signal := make(chan struct{})
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithMemoryPressure(signal, func(res Result) int64 {
+				return int64(len(unwrap(res)))
+			}, nil),
+		},
+	})
+	defer s.Close()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	build := func(name, depValue string) (*Job, Edge) {
+		j, err := s.NewJob(name)
+		require.NoError(t, err)
+		return j, Edge{
+			Vertex: vtx(vtxOpt{
+				name:  name + "-v0",
+				value: "result0",
+				inputs: []Edge{{Vertex: vtx(vtxOpt{
+					name:  name + "-v1",
+					value: depValue,
+				})}},
+				execPreFunc: func(ctx context.Context) error {
+					started <- struct{}{}
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-release:
+						return nil
+					}
+				},
+			}),
+		}
+	}
+
+	j0, g0 := build("job0", "large-result")
+	defer j0.Discard()
+	j1, g1 := build("job1", "small")
+	defer j1.Discard()
+
+	var err0 error
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err0 = j0.Build(ctx, g0)
+		return nil
+	})
+	eg.Go(func() error {
+		_, err := j1.Build(ctx, g1)
+		return err
+	})
+
+	<-started
+	<-started
+	signal <- struct{}{}
+
+	// the build retaining the most memory is canceled
+	require.Eventually(t, func() bool {
+		return len(s.ActiveBuilds()) == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	require.NoError(t, eg.Wait())
+
+	require.Error(t, err0)
+	require.True(t, errors.Is(err0, ErrMemoryPressure))
+}
+
+func TestMemoryPressureSteps(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	signal := make(chan struct{})
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithMemoryPressure(signal, func(res Result) int64 {
+				return int64(len(unwrap(res)))
+			}, nil),
+			WithMemoryPressureSteps(ReclaimPruneIndex, ReclaimRetainedResults, ReclaimCancelBuilds),
+		},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}},
+		}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+	require.True(t, s.Stats().IndexEntries > 0)
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	started := make(chan struct{})
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j1.Build(ctx, Edge{
+			Vertex: vtx(vtxOpt{
+				name:   "v2",
+				value:  "result2",
+				inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v3", value: "result3"})}},
+				execPreFunc: func(ctx context.Context) error {
+					close(started)
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			}),
+		})
+		return err
+	})
+	<-started
+	n := s.Stats().IndexEntries
+
+	// the index is pruned before any builds are canceled
+	signal <- struct{}{}
+	require.Eventually(t, func() bool {
+		return s.Stats().IndexEntries < n
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1, len(s.ActiveBuilds()))
+
+	// nothing is left to prune so the build is canceled
+	signal <- struct{}{}
+	err = eg.Wait()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrMemoryPressure))
+}
+
+func TestMemoryPressureReleasedResults(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	signal := make(chan struct{})
+	var mu sync.Mutex
+	var sizes []int64
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithMemoryPressure(signal, func(res Result) int64 {
+				return int64(len(unwrap(res)))
+			}, func(usage []BuildUsage) []BuildUsage {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, u := range usage {
+					sizes = append(sizes, u.RetainedSize)
+				}
+				return nil
+			}),
+			WithMemoryPressureSteps(ReclaimRetainedResults, ReclaimCancelBuilds),
+			WithMaxRetainedResults(10),
+		},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	eg, ctx := errgroup.WithContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, Edge{
+			Vertex: vtx(vtxOpt{
+				name:  "v0",
+				value: "result0",
+				inputs: []Edge{{Vertex: vtx(vtxOpt{
+					name:   "v1",
+					value:  "small",
+					inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v2", value: "large-result"})}},
+				})}},
+				execPreFunc: func(ctx context.Context) error {
+					close(started)
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			}),
+		})
+		return err
+	})
+	<-started
+
+	// the first signal releases the result of v2, the second one finds
+	// nothing to release and asks the selector
+	signal <- struct{}{}
+	signal <- struct{}{}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sizes) > 0
+	}, time.Second, time.Millisecond)
+
+	mu.Lock()
+	require.Equal(t, []int64{int64(len("small"))}, sizes)
+	mu.Unlock()
+
+	cancel()
+	require.Error(t, eg.Wait())
+}
+
+func TestPipeTracer(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var mu sync.Mutex
+	var events []PipeEvent
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithPipeTracer(func(e Edge) bool {
+				return e.Vertex.Name() == "v1"
+			}, func(ev PipeEvent) {
+				mu.Lock()
+				events = append(events, ev)
+				mu.Unlock()
+			}),
+		},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{
+				name:  "v1",
+				value: "result1",
+			})}},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.NotEmpty(t, events)
+	// build request of v0 is not traced
+	for _, ev := range events {
+		require.Equal(t, "v1", ev.Target.Vertex.Name())
+		require.NotNil(t, ev.From)
+		require.Equal(t, "v0", ev.From.Vertex.Name())
+	}
+	require.Equal(t, PipeEventRequest, events[0].Type)
+	require.Equal(t, edgeStatusCacheFast.String(), events[0].DesiredState)
+
+	last := events[len(events)-1]
+	require.Equal(t, PipeEventResponse, last.Type)
+	require.True(t, last.Completed)
+	require.Equal(t, edgeStatusComplete.String(), last.State)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestCancelAll(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	started := make(chan struct{}, 2)
+	blocking := func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	errReset := errors.Errorf("reset")
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:        fmt.Sprintf("v%d", i),
+				value:       "result",
+				execPreFunc: blocking,
+			}),
+		}
+		eg.Go(func() error {
+			_, err := j.Build(ctx, g)
+			if !errors.Is(err, errReset) {
+				return errors.Errorf("unexpected error %v", err)
+			}
+			return nil
+		})
+	}
+
+	<-started
+	<-started
+	require.Equal(t, 2, s.CancelAll(errReset))
+	require.NoError(t, eg.Wait())
+
+	// solver accepts new builds
+	j, err := s.NewJob("job2")
+	require.NoError(t, err)
+	defer j.Discard()
+
+	res, err := j.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})})
+	require.NoError(t, err)
+	require.Equal(t, "result2", unwrap(res))
+}
+
+func TestMergeTimeout(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var logs lockedBuffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	var s *Solver
+	var canceled int64
+	s = NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithLogger(logger),
+			WithMergeTimeout(10 * time.Millisecond),
+			WithDefinitionDigest(func(ctx context.Context, v Vertex) (digest.Digest, error) {
+				// called without the scheduler lock
+				s.Stats()
+				<-ctx.Done()
+				atomic.AddInt64(&canceled, 1)
+				return "", ctx.Err()
+			}),
+		},
+	})
+	defer s.Close()
+
+	wait2Ready := blockingFuncion(2)
+
+	var edges []Edge
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         fmt.Sprintf("v%d", i),
+				cacheKeySeed: "seed0",
+				cachePreFunc: wait2Ready,
+				value:        "result0",
+			}),
+		}
+		edges = append(edges, g)
+		eg.Go(func() error {
+			res, err := j.Build(ctx, g)
+			if err != nil {
+				return err
+			}
+			require.Equal(t, "result0", unwrap(res))
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	require.Contains(t, logs.String(), ErrMergeTimeout.Error())
+	// the abandoned verification is canceled
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&canceled) > 0
+	}, time.Second, time.Millisecond)
+	for _, e := range edges {
+		require.Nil(t, s.EdgeInfo(e).MergedTo)
+	}
+}
+
+func TestMergeRecheckedAfterVerification(t *testing.T) {
+	t.Parallel()
+
+	ef := testEdgeFactory{}
+	var s *scheduler
+	var release bool
+	s = newScheduler(ef, WithDefinitionDigest(func(ctx context.Context, v Vertex) (digest.Digest, error) {
+		if release {
+			// the edges can change while the scheduler is unlocked
+			s.mu.Lock()
+			for e := range ef {
+				delete(ef, e)
+			}
+			s.mu.Unlock()
+		}
+		return digest.FromBytes([]byte("def")), nil
+	}))
+	s.Stop()
+
+	index := newEdgeIndex()
+	dk := NewCacheKey(digest.FromBytes([]byte("foo")), 0)
+	newMergeEdge := func() *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cacheKeySeed: "seed1",
+			inputs:       []Edge{{Vertex: vtx(vtxOpt{name: "v0"})}},
+		})}, nil, index)
+		e.cacheMap = e.edge.Vertex.(*vertex).makeCacheMap()
+		e.deps = []*dep{newDep(0)}
+		e.deps[0].keys = []ExportableCacheKey{{CacheKey: dk, Exporter: &exporter{k: dk}}}
+		ef[e.edge] = e
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	require.True(t, s.mergeTo(newMergeEdge(), newMergeEdge()))
+
+	release = true
+	require.False(t, s.mergeTo(newMergeEdge(), newMergeEdge()))
+}
+
+func TestDefinitionDigestCollision(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var logs lockedBuffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	var verified int64
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithLogger(logger),
+			WithDefinitionDigest(func(_ context.Context, v Vertex) (digest.Digest, error) {
+				atomic.AddInt64(&verified, 1)
+				return digest.FromBytes([]byte(v.Sys().(*vertex).opt.value)), nil
+			}),
+		},
+	})
+	defer s.Close()
+
+	wait2Ready := blockingFuncion(2)
+
+	var edges []Edge
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         fmt.Sprintf("v%d", i),
+				cacheKeySeed: "seed0", // colliding cache keys
+				cachePreFunc: wait2Ready,
+				value:        fmt.Sprintf("result%d", i),
+			}),
+		}
+		edges = append(edges, g)
+		eg.Go(func() error {
+			_, err := j.Build(ctx, g)
+			return err
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	require.Equal(t, int64(2), atomic.LoadInt64(&verified))
+	require.Contains(t, logs.String(), ErrCacheKeyCollision.Error())
+	for _, e := range edges {
+		require.Nil(t, s.EdgeInfo(e).MergedTo)
+	}
+}
+
+func TestSkippedDispatchWarning(t *testing.T) {
+	t.Parallel()
+
+	var logs lockedBuffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	s := newScheduler(nil, withManualDispatch(), WithLogger(logger), WithMaxSkippedDispatches(3))
+	defer s.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// delayed by the polling interval
+	e0 := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	e0.dispatchInterval = time.Hour
+	e0.lastDispatch = s.opt.Clock.Now()
+	for i := 0; i < 3; i++ {
+		require.False(t, s.process(e0))
+	}
+	e0.redispatchTimer.Stop()
+	require.Equal(t, 3, e0.skippedDispatches)
+	require.Contains(t, logs.String(), "edge v0")
+	require.Contains(t, logs.String(), "has been queued 3 times without dispatch")
+
+	// held for a pending merge
+	s.opt.HoldPendingMerges = true
+	s.mergesQueued = map[*edge]struct{}{}
+	s.mergesHeld = map[*edge]struct{}{}
+	e1 := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v1"})}, nil, newEdgeIndex())
+	s.mergesQueued[e1] = struct{}{}
+	for i := 0; i < 3; i++ {
+		require.False(t, s.process(e1))
+	}
+	require.Equal(t, 3, e1.skippedDispatches)
+	require.Contains(t, logs.String(), "edge v1")
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestIsHealthy(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	s := newScheduler(nil, withManualDispatch(), WithClock(clock))
+
+	// idle loop is healthy
+	clock.Advance(time.Minute)
+	require.True(t, s.IsHealthy(time.Second))
+
+	// idle time before the edge was queued doesn't count
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex()))
+	require.True(t, s.IsHealthy(time.Second))
+	clock.Advance(2 * time.Second)
+	require.False(t, s.IsHealthy(time.Second))
+
+	s.signal(newEdge(Edge{Vertex: vtx(vtxOpt{name: "v1"})}, nil, newEdgeIndex()))
+	s.mu.Lock()
+	require.NotNil(t, s.dequeue())
+	s.mu.Unlock()
+	require.True(t, s.IsHealthy(time.Second))
+
+	clock.Advance(2 * time.Second)
+	require.False(t, s.IsHealthy(time.Second))
+	require.True(t, s.IsHealthy(3*time.Second))
+
+	s.Stop()
+	require.False(t, s.IsHealthy(time.Hour))
+}
+
+func TestPriorityAging(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	s := newScheduler(nil, WithQueuePolicy(QueuePolicyPriority), WithPriorityAging(time.Second), WithClock(clock))
+	// stopped scheduler never drains the queue
+	s.Stop()
+
+	low := &activeBuild{}
+	high := &activeBuild{priority: 5}
+	s.builds[low] = struct{}{}
+	s.builds[high] = struct{}{}
+
+	signal := func(name string, b *activeBuild) {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{name: name})}, nil, newEdgeIndex())
+		e.owner = b
+		s.signal(e)
+	}
+	pop := func() string {
+		s.muQ.Lock()
+		defer s.muQ.Unlock()
+		l := s.pop()
+		if l == nil {
+			return ""
+		}
+		return l.e.edge.Vertex.Name()
+	}
+
+	signal("low0", low)
+	signal("high0", high)
+	require.Equal(t, "high0", pop())
+
+	// low priority edge has waited long enough to get ahead of new high
+	// priority edges
+	clock.Advance(6 * time.Second)
+	signal("high1", high)
+	require.Equal(t, "low0", pop())
+	require.Equal(t, "high1", pop())
+	require.Equal(t, "", pop())
+}
+
+func TestPriorityQueuing(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil, WithQueuePolicy(QueuePolicyPriority))
+	// stopped scheduler never drains the queue
+	s.Stop()
+
+	req := &BuildRequest{JobID: "job1", Edge: Edge{Vertex: vtx(vtxOpt{name: "root1"})}}
+	b0 := &activeBuild{}
+	b1 := &activeBuild{request: req}
+	s.builds[b0] = struct{}{}
+	s.builds[b1] = struct{}{}
+
+	newOwnedEdge := func(name string, b *activeBuild) *edge {
+		e := newEdge(Edge{Vertex: vtx(vtxOpt{name: name})}, nil, newEdgeIndex())
+		e.owner = b
+		return e
+	}
+
+	for _, e := range []*edge{
+		newOwnedEdge("e0", b0),
+		newOwnedEdge("e1", b1),
+		newOwnedEdge("e2", b0),
+		newOwnedEdge("e3", b1),
+	} {
+		s.signal(e)
+	}
+
+	pop := func() string {
+		s.muQ.Lock()
+		defer s.muQ.Unlock()
+		l := s.pop()
+		if l == nil {
+			return ""
+		}
+		return l.e.edge.Vertex.Name()
+	}
+
+	// equal priorities are dispatched in order
+	require.Equal(t, "e0", pop())
+
+	// boosted build skips ahead
+	require.Equal(t, 1, s.SetPriority(*req, 10))
+	require.Equal(t, "e1", pop())
+	require.Equal(t, "e3", pop())
+	require.Equal(t, "e2", pop())
+	require.Equal(t, "", pop())
+	require.Nil(t, s.last)
+
+	require.Equal(t, 0, s.SetPriority(BuildRequest{JobID: "job2", Edge: req.Edge}, 10))
+}
+
+func TestStatsDispatchTimings(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{Vertex: vtxSum(1, vtxOpt{inputs: []Edge{
+		{Vertex: vtxConst(2, vtxOpt{})},
+		{Vertex: vtxConst(3, vtxOpt{})},
+	}})}
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+
+	d := s.Stats().Dispatch
+	require.True(t, d.Dispatches >= 3)
+	require.True(t, d.Unpark > 0)
+	total := d.Collect + d.Receive + d.Unpark + d.Filter + d.Merge
+	require.True(t, total >= d.Unpark)
+}
+
+func TestExclusiveLocks(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	var running, maxRunning int64
+	track := func(context.Context) error {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	locked := func(v int, locks ...string) Edge {
+		return Edge{Vertex: vtxConst(v, vtxOpt{
+			execPreFunc:    track,
+			cachePreFunc:   track,
+			exclusiveLocks: locks,
+		})}
+	}
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				locked(2, "dev0"),
+				locked(3, "dev1", "dev0"),
+				locked(4, "dev0", "dev0"),
+			},
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 10, unwrapInt(res))
+	require.Equal(t, int64(1), atomic.LoadInt64(&maxRunning))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestEstimatedRemaining(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			inputs: []Edge{
+				{Vertex: vtx(vtxOpt{
+					name:  "v1",
+					value: "result1",
+					execPreFunc: func(context.Context) error {
+						close(started)
+						<-release
+						return nil
+					},
+				})},
+				{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})},
+			},
+		}),
+	}
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	builds := s.ActiveBuilds()
+	require.Len(t, builds, 1)
+
+	require.Eventually(t, func() bool {
+		completed, total := s.EstimatedRemaining(builds[0])
+		return completed == 1 && total == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+
+	completed, total := s.EstimatedRemaining(builds[0])
+	require.Equal(t, 0, completed)
+	require.Equal(t, 0, total)
+}
+
+func TestEstimatedRemainingLoadedEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	builds := s.ActiveBuilds()
+	require.Len(t, builds, 1)
+
+	// the inputs are not requested before the condition passed, so they are
+	// not counted and the estimate doesn't load them
+	require.Equal(t, 2, s.Stats().LoadedEdges)
+	completed, total := s.EstimatedRemaining(builds[0])
+	require.Equal(t, 0, completed)
+	require.Equal(t, 1, total)
+	require.Equal(t, 2, s.Stats().LoadedEdges)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+func TestBuildStatusLoadedEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	builds := s.ActiveBuilds()
+	require.Len(t, builds, 1)
+
+	before := s.Stats()
+	ctx2, cancel := context.WithCancel(ctx)
+	ch := s.BuildStatus(ctx2, builds[0], time.Millisecond)
+	for i := 0; i < 5; i++ {
+		st := <-ch
+		require.Equal(t, 1, st.Total)
+	}
+	cancel()
+	for range ch {
+	}
+
+	// polling doesn't load the inputs that weren't requested yet
+	after := s.Stats()
+	require.Equal(t, before.LoadedEdges, after.LoadedEdges)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+// conditionBlockedGraph returns an edge with two inputs whose condition waits
+// for release. The inputs are not requested before the condition passed, so
+// they aren't loaded while the build is blocked.
+func conditionBlockedGraph(started, release chan struct{}) Edge {
+	return Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			condition: &Condition{
+				Edge: Edge{Vertex: vtx(vtxOpt{
+					name:  "cond",
+					value: "yes",
+					execPreFunc: func(context.Context) error {
+						close(started)
+						<-release
+						return nil
+					},
+				})},
+				Check: func(context.Context, Result) (bool, error) {
+					return true, nil
+				},
+			},
+			inputs: []Edge{
+				{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})},
+				{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})},
+			},
+		}),
+	}
+}
+
+func TestCompletedEdgesLoadedEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	loaded := s.Stats().LoadedEdges
+	require.Empty(t, s.CompletedEdges(g0))
+	require.Equal(t, loaded, s.Stats().LoadedEdges)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.Len(t, s.CompletedEdges(g0), 3)
+}
+
+func TestEdgeQueriesIgnoreCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	dep := Edge{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}
+	g0 := Edge{Vertex: vtx(vtxOpt{name: "v0", value: "result0", inputs: []Edge{dep}})}
+	_, err = j0.Build(ctx, g0)
+	require.NoError(t, err)
+	cachedID := l.EdgeInfo(g0).ID
+
+	j1, err := l.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	// the same vertex without cache gets a state of its own while the
+	// cached one is loaded
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g1 := Edge{Vertex: vtx(vtxOpt{
+		name:        "v0",
+		value:       "result0",
+		inputs:      []Edge{dep},
+		ignoreCache: true,
+		execPreFunc: func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})}
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j1.Build(ctx, g1)
+		return err
+	})
+
+	<-started
+	info := l.EdgeInfo(g1)
+	require.NotNil(t, info)
+	require.False(t, info.Complete)
+	require.Nil(t, info.MergedTo)
+	require.NotEqual(t, cachedID, info.ID)
+	require.Eventually(t, func() bool {
+		return l.WhyBlocked(g1) == "executing"
+	}, time.Second, time.Millisecond)
+	require.Equal(t, EdgeStateComplete, l.DesiredState(g1))
+
+	require.True(t, l.AbortEdge(g1))
+	close(release)
+	require.True(t, errors.Is(eg.Wait(), ErrEdgeAborted))
+	require.Len(t, l.DependencyReport(g1), 1)
+}
+
+func TestEdgeQueriesLoadedEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	loaded := l.Stats().LoadedEdges
+
+	// the inputs of the blocked edge are known vertexes without edges
+	v1 := g0.Vertex.Inputs()[0]
+	require.Nil(t, l.EdgeInfo(v1))
+	require.Equal(t, "unknown edge", l.WhyBlocked(v1))
+	require.Nil(t, l.DependencyReport(v1))
+	require.Equal(t, EdgeStateInitial, l.DesiredState(v1))
+	require.Equal(t, loaded, l.Stats().LoadedEdges)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.NotNil(t, l.EdgeInfo(v1))
+}
+
+func TestEdgeMetaLoadedEdges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g0 := conditionBlockedGraph(started, release)
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	loaded := l.Stats().LoadedEdges
+
+	v1 := g0.Vertex.Inputs()[0]
+	require.Error(t, l.SetEdgeMeta(v1, "span", "span1"))
+	v, ok := l.EdgeMeta(v1, "span")
+	require.False(t, ok)
+	require.Nil(t, v)
+	require.Equal(t, loaded, l.Stats().LoadedEdges)
+
+	require.NoError(t, l.SetEdgeMeta(g0, "span", "span0"))
+	v, ok = l.EdgeMeta(g0, "span")
+	require.True(t, ok)
+	require.Equal(t, "span0", v)
+
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+func TestBuildStatus(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			inputs: []Edge{
+				{Vertex: vtx(vtxOpt{
+					name:  "v1",
+					value: "result1",
+					execPreFunc: func(context.Context) error {
+						close(started)
+						<-release
+						return nil
+					},
+				})},
+				{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})},
+			},
+		}),
+	}
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, g0)
+		return err
+	})
+
+	<-started
+	builds := s.ActiveBuilds()
+	require.Len(t, builds, 1)
+
+	ch := s.BuildStatus(ctx, builds[0], time.Millisecond)
+	var last BuildStatusUpdate
+	released := false
+	for st := range ch {
+		require.Equal(t, 3, st.Total)
+		if st.Running > 0 && !released {
+			close(release)
+			released = true
+		}
+		last = st
+	}
+	require.NoError(t, eg.Wait())
+	require.Equal(t, BuildStatusUpdate{Total: 3, Complete: 3}, last)
+
+	_, ok := <-s.BuildStatus(ctx, builds[0], time.Millisecond)
+	require.False(t, ok)
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+}
+
+func TestDeferredMerges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithDeferredMerges(1)},
+	})
+	defer s.Close()
+
+	wait2Ready := blockingFuncion(2)
+	release := make(chan struct{})
+
+	var edges []Edge
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         fmt.Sprintf("v%d", i),
+				cacheKeySeed: "seed0",
+				cachePreFunc: wait2Ready,
+				execPreFunc: func(context.Context) error {
+					<-release
+					return nil
+				},
+				value: "result0",
+			}),
+		}
+		edges = append(edges, g)
+		eg.Go(func() error {
+			res, err := j.Build(ctx, g)
+			if err != nil {
+				return err
+			}
+			if v := unwrap(res); v != "result0" {
+				return errors.Errorf("invalid result %s", v)
+			}
+			return nil
+		})
+	}
+
+	// merge completes while the edges are running
+	require.Eventually(t, func() bool {
+		return s.EdgeInfo(edges[0]).MergedCount+s.EdgeInfo(edges[1]).MergedCount == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	require.NoError(t, eg.Wait())
+}
+
+func TestHoldPendingMerges(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithDeferredMerges(1), WithHoldPendingMerges()},
+	})
+	defer s.Close()
+
+	wait2Ready := blockingFuncion(2)
+	var execs int64
+
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		j, err := s.NewJob(fmt.Sprintf("job%d", i))
+		require.NoError(t, err)
+		defer j.Discard()
+
+		g := Edge{
+			Vertex: vtx(vtxOpt{
+				name:         fmt.Sprintf("v%d", i),
+				cacheKeySeed: "seed0",
+				execPreFunc: func(context.Context) error {
+					atomic.AddInt64(&execs, 1)
+					return nil
+				},
+				value: "result0",
+				inputs: []Edge{{Vertex: vtx(vtxOpt{
+					name:         fmt.Sprintf("v%d-dep", i),
+					cacheKeySeed: "seed-dep",
+					cachePreFunc: wait2Ready,
+					value:        "dep",
+				})}},
+			}),
+		}
+		eg.Go(func() error {
+			res, err := j.Build(ctx, g)
+			if err != nil {
+				return err
+			}
+			if v := unwrap(res); v != "result0" {
+				return errors.Errorf("invalid result %s", v)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	// the edges are merged before either of them executes
+	require.Equal(t, int64(1), atomic.LoadInt64(&execs))
+}
+
+// recordingTracer records the spans that were finished
+type recordingTracer struct {
+	opentracing.NoopTracer
+	mu       sync.Mutex
+	finished []*recordingSpan
+}
+
+type recordingSpan struct {
+	opentracing.Span
+	tracer *recordingTracer
+	name   string
+	parent *recordingSpan
+	start  time.Time
+	end    time.Time
+	tags   map[string]interface{}
+}
+
+type recordingSpanContext struct {
+	opentracing.SpanContext
+	span *recordingSpan
+}
+
+func (t *recordingTracer) StartSpan(name string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var sso opentracing.StartSpanOptions
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	sp := &recordingSpan{Span: t.NoopTracer.StartSpan(name), tracer: t, name: name, start: sso.StartTime, tags: map[string]interface{}{}}
+	for _, ref := range sso.References {
+		if c, ok := ref.ReferencedContext.(recordingSpanContext); ok {
+			sp.parent = c.span
+		}
+	}
+	return sp
+}
+
+func (sp *recordingSpan) Context() opentracing.SpanContext {
+	return recordingSpanContext{SpanContext: sp.Span.Context(), span: sp}
+}
+
+func (sp *recordingSpan) Tracer() opentracing.Tracer {
+	return sp.tracer
+}
+
+func (sp *recordingSpan) SetTag(key string, value interface{}) opentracing.Span {
+	sp.tags[key] = value
+	return sp
+}
+
+func (sp *recordingSpan) Finish() {
+	sp.FinishWithOptions(opentracing.FinishOptions{FinishTime: time.Now()})
+}
+
+func (sp *recordingSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	sp.end = opts.FinishTime
+	sp.tracer.mu.Lock()
+	sp.tracer.finished = append(sp.tracer.finished, sp)
+	sp.tracer.mu.Unlock()
+}
+
+type testEdgeFactory map[Edge]*edge
+
+func (ef testEdgeFactory) getEdge(e Edge) *edge                   { return ef[e] }
+func (ef testEdgeFactory) lookupEdge(e Edge) *edge                { return ef[e] }
+func (ef testEdgeFactory) setEdge(e Edge, target *edge)           { ef[e] = target }
+func (ef testEdgeFactory) releaseEdge(*edge) bool                 { return false }
+func (ef testEdgeFactory) pruneIndex(remove func(*edge) bool) int { return 0 }
+func (ef testEdgeFactory) mergeIndex() *edgeIndex                 { return nil }
+
+func TestHoldForMerge(t *testing.T) {
+	t.Parallel()
+
+	ef := testEdgeFactory{}
+	s := newScheduler(ef, withManualDispatch(), WithHoldPendingMerges())
+	s.mergesQueued = map[*edge]struct{}{}
+	s.mergesHeld = map[*edge]struct{}{}
+	s.opt.DeferredMerges = 1
+
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	ef[e.edge] = e
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deferMerge(e)
+	require.False(t, s.process(e))
+	require.Contains(t, s.mergesHeld, e)
+	require.Empty(t, s.waitq)
+
+	// edge is dispatched again after the merge check
+	e.result = NewSharedCachedResult(NewCachedResult(&dummyResult{id: "r0"}, nil))
+	s.mu.Unlock()
+	require.False(t, s.mergeBatch())
+	s.mu.Lock()
+	require.Empty(t, s.mergesHeld)
+	require.Contains(t, s.waitq, e)
+}
+
+// queryEdgeFactory fails the test if an edge is loaded through getEdge
+type queryEdgeFactory struct {
+	testEdgeFactory
+	t *testing.T
+}
+
+func (ef queryEdgeFactory) getEdge(e Edge) *edge {
+	ef.t.Errorf("unexpected load of edge %s", e.Vertex.Name())
+	return ef.testEdgeFactory.getEdge(e)
+}
+
+func TestMergeBatchReleasedEdge(t *testing.T) {
+	t.Parallel()
+
+	ef := queryEdgeFactory{testEdgeFactory: testEdgeFactory{}, t: t}
+	s := newScheduler(ef, withManualDispatch(), WithHoldPendingMerges())
+	s.mergesQueued = map[*edge]struct{}{}
+	s.mergesHeld = map[*edge]struct{}{}
+	s.opt.DeferredMerges = 1
+
+	// the edge was released while it was queued and held
+	e := newEdge(Edge{Vertex: vtx(vtxOpt{name: "v0"})}, nil, newEdgeIndex())
+	s.mu.Lock()
+	s.deferMerge(e)
+	require.False(t, s.process(e))
+	s.mu.Unlock()
+
+	require.False(t, s.mergeBatch())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Empty(t, s.mergesHeld)
+	require.Empty(t, s.waitq)
+	require.Empty(t, ef.testEdgeFactory)
+}
+
+func TestSpeculativeInputs(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithSpeculativeInputs()},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	// the input executes while the cache key of v0 is computed
+	executed := make(chan struct{})
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			cachePreFunc: func(ctx context.Context) error {
+				select {
+				case <-executed:
+					return nil
+				case <-time.After(5 * time.Second):
+					return errors.Errorf("input was not executed")
+				}
+			},
+			inputs: []Edge{{Vertex: vtx(vtxOpt{
+				name:  "v1",
+				value: "result1",
+				execPreFunc: func(context.Context) error {
+					close(executed)
+					return nil
+				},
+			})}},
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+	// counters are shared by the vertexes of the graph
+	require.Equal(t, int64(2), *g0.Vertex.(*vertex).execCallCount)
+
+	// cache hit cancels the speculative requests without executing again
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: g0.Vertex.(*vertex).opt.cacheKeySeed,
+			value:        "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{
+				name:         "v1",
+				cacheKeySeed: g0.Vertex.Inputs()[0].Vertex.(*vertex).opt.cacheKeySeed,
+				value:        "result1",
+			})}},
+		}),
+	}
+	g1.Vertex.(*vertex).setupCallCounters()
+
+	res, err = j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+	require.Equal(t, int64(0), *g1.Vertex.(*vertex).execCallCount)
+}
+
+func BenchmarkSpeculativeInputs(b *testing.B) {
+	for _, speculative := range []bool{false, true} {
+		b.Run(fmt.Sprintf("speculative=%v", speculative), func(b *testing.B) {
+			ctx := context.TODO()
+			var opts []SchedulerOption
+			if speculative {
+				opts = append(opts, WithSpeculativeInputs())
+			}
+			s := NewSolver(SolverOpt{
+				ResolveOpFunc:    testOpResolver,
+				SchedulerOptions: opts,
+			})
+			defer s.Close()
+
+			sleep := func(context.Context) error {
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			}
+			for i := 0; i < b.N; i++ {
+				j, err := s.NewJob(fmt.Sprintf("job%d", i))
+				require.NoError(b, err)
+
+				// every vertex is a cache miss. the inputs can execute while
+				// the cache key of the root is computed.
+				inputs := make([]Edge, 0, 8)
+				for k := 0; k < 8; k++ {
+					inputs = append(inputs, Edge{Vertex: vtxConst(1, vtxOpt{
+						cacheKeySeed: fmt.Sprintf("const-%d-%d", i, k),
+						execPreFunc:  sleep,
+					})})
+				}
+				res, err := j.Build(ctx, Edge{Vertex: vtxSum(0, vtxOpt{
+					cacheKeySeed: fmt.Sprintf("sum-%d", i),
+					cachePreFunc: sleep,
+					inputs:       inputs,
+				})})
+				require.NoError(b, err)
+				require.Equal(b, 8, unwrapInt(res))
+				require.NoError(b, j.Discard())
+			}
+		})
+	}
+}
+
+func BenchmarkMergeIdenticalSubtrees(b *testing.B) {
+	for _, n := range []int{0, 8} {
+		b.Run(fmt.Sprintf("deferred=%d", n), func(b *testing.B) {
+			ctx := context.TODO()
+			s := NewSolver(SolverOpt{
+				ResolveOpFunc:    testOpResolver,
+				SchedulerOptions: []SchedulerOption{WithDeferredMerges(n)},
+			})
+			defer s.Close()
+
+			for i := 0; i < b.N; i++ {
+				j, err := s.NewJob(fmt.Sprintf("job%d", i))
+				require.NoError(b, err)
+
+				// identical subtrees with unique digests merge on their cache keys
+				subtree := func() Edge {
+					leaf := Edge{Vertex: vtxConst(1, vtxOpt{name: identity.NewID()})}
+					return Edge{Vertex: vtxSum(1, vtxOpt{
+						name:         identity.NewID(),
+						cacheKeySeed: fmt.Sprintf("sum-%d", i),
+						inputs:       []Edge{leaf},
+					})}
+				}
+				inputs := make([]Edge, 0, 32)
+				for k := 0; k < 32; k++ {
+					inputs = append(inputs, subtree())
+				}
+				res, err := j.Build(ctx, Edge{Vertex: vtxSum(0, vtxOpt{inputs: inputs})})
+				require.NoError(b, err)
+				require.Equal(b, 32*2, unwrapInt(res))
+				require.NoError(b, j.Discard())
+			}
+			b.ReportMetric(float64(s.Stats().Dispatch.Dispatches)/float64(b.N), "dispatches/op")
+			d := s.Stats().Dispatch
+			b.ReportMetric(float64((d.Collect+d.Receive+d.Unpark+d.Filter+d.Merge).Nanoseconds())/float64(d.Dispatches), "ns/dispatch")
+		})
+	}
+}
+
+func TestEdgeKey(t *testing.T) {
+	t.Parallel()
+
+	v0 := vtx(vtxOpt{name: "v0"})
+	v1 := vtx(vtxOpt{name: "v1"})
+
+	// a new value for the same vertex identifies the same edge
+	require.True(t, EdgeEqual(Edge{Vertex: v0}, Edge{Vertex: v0}))
+	require.Equal(t, EdgeKey(Edge{Vertex: v0}), EdgeKey(Edge{Vertex: v0}))
+
+	require.False(t, EdgeEqual(Edge{Vertex: v0}, Edge{Vertex: v0, Index: 1}))
+	require.NotEqual(t, EdgeKey(Edge{Vertex: v0}), EdgeKey(Edge{Vertex: v0, Index: 1}))
+	require.False(t, EdgeEqual(Edge{Vertex: v0}, Edge{Vertex: v1}))
+	require.NotEqual(t, EdgeKey(Edge{Vertex: v0}), EdgeKey(Edge{Vertex: v1}))
+
+	// the key matches the edge the solver resolves
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})}
+	_, err = j0.Build(context.TODO(), g0)
+	require.NoError(t, err)
+
+	e := s.getEdge(g0)
+	require.NotNil(t, e)
+	require.True(t, EdgeEqual(e.edge, g0))
+	require.Equal(t, EdgeKey(g0), EdgeKey(e.edge))
+}
+
+func TestVerifyUpdates(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithVerifyUpdates(true)},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: vtxSum(2, vtxOpt{
+					inputs: []Edge{
+						{Vertex: vtxConst(4, vtxOpt{})},
+					},
+					slowCacheCompute: map[int]ResultBasedCacheFunc{
+						0: digestFromResult,
+					},
+				})},
 			},
 		}),
 	}
 
-	_, err = j2.Build(ctx, g2)
+	res, err := j0.Build(ctx, g0)
 	require.NoError(t, err)
-	require.NoError(t, j2.Discard())
-	j2 = nil
+	require.Equal(t, 10, unwrapInt(res))
+
+	// an open request the edge doesn't know about is reported
+	e := &edge{edge: Edge{Vertex: vtx(vtxOpt{name: "v0"})}}
+	p := pipe.New(pipe.Request{})
+	err = verifyUpdates(e, e.ownedRequests(), []pipe.Receiver{p.Receiver})
+	require.Error(t, err)
+
+	// as is an open request the edge stopped tracking
+	e.execReq = p.Receiver
+	owned := e.ownedRequests()
+	e.execReq = nil
+	err = verifyUpdates(e, owned, []pipe.Receiver{p.Receiver})
+	require.Error(t, err)
+
+	e.execReq = p.Receiver
+	require.NoError(t, verifyUpdates(e, e.ownedRequests(), []pipe.Receiver{p.Receiver}))
 }
 
-func generateSubGraph(nodes int) (Edge, int) {
-	if nodes == 1 {
-		value := rand.Int() % 500
-		return Edge{Vertex: vtxConst(value, vtxOpt{})}, value
-	}
-	spread := rand.Int()%5 + 2
-	inc := int(math.Ceil(float64(nodes) / float64(spread)))
-	if inc > nodes {
-		inc = nodes
+func TestWriteMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithName(`sch"0`), WithConcurrency(2)},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: vtxConst(4, vtxOpt{})},
+			},
+		}),
 	}
-	added := 1
-	value := 0
-	inputs := []Edge{}
-	i := 0
-	for {
-		i++
-		if added >= nodes {
-			break
-		}
-		if added+inc > nodes {
-			inc = nodes - added
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.WriteMetrics(buf))
+	out := buf.String()
+
+	require.True(t, strings.HasSuffix(out, "# EOF\n"))
+	require.Contains(t, out, "# TYPE buildkit_scheduler_completed_edges counter\n")
+	require.Contains(t, out, `buildkit_scheduler_completed_edges_total{scheduler="sch\"0",result="executed"} 3`+"\n")
+	require.Contains(t, out, `buildkit_scheduler_completed_edges_total{scheduler="sch\"0",result="cached"} 0`+"\n")
+	require.Contains(t, out, `buildkit_scheduler_dispatch_seconds_total{scheduler="sch\"0",phase="unpark"} `)
+	require.Contains(t, out, `buildkit_scheduler_queue_length{scheduler="sch\"0"} `)
+
+	// every sample is labeled with the name of the scheduler
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(l, "#") {
+			require.Contains(t, l, `{scheduler="sch\"0"`)
 		}
-		e, v := generateSubGraph(inc)
-		inputs = append(inputs, e)
-		value += v
-		added += inc
 	}
-	extra := rand.Int() % 500
-	value += extra
-	return Edge{Vertex: vtxSum(extra, vtxOpt{inputs: inputs})}, value
 }
 
-type vtxOpt struct {
-	name             string
-	cacheKeySeed     string
-	cacheKeySeeds    []func() string
-	execDelay        time.Duration
-	cacheDelay       time.Duration
-	cachePreFunc     func(context.Context) error
-	execPreFunc      func(context.Context) error
-	inputs           []Edge
-	value            string
-	slowCacheCompute map[int]ResultBasedCacheFunc
-	selectors        map[int]digest.Digest
-	cacheSource      CacheManager
-	ignoreCache      bool
-}
+func TestInjectResult(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func vtx(opt vtxOpt) *vertex {
-	if opt.name == "" {
-		opt.name = identity.NewID()
-	}
-	if opt.cacheKeySeed == "" {
-		opt.cacheKeySeed = identity.NewID()
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	v1 := vtxConst(4, vtxOpt{})
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: v1},
+			},
+		}),
 	}
-	return &vertex{opt: opt}
-}
 
-type vertex struct {
-	opt vtxOpt
+	g0.Vertex.(*vertexSum).setupCallCounters()
 
-	cacheCallCount *int64
-	execCallCount  *int64
-}
+	k := NewCacheKey(digest.FromBytes([]byte("injected")), 0)
+	res := NewCachedResult(&dummyResult{id: identity.NewID(), intValue: 10}, []ExportableCacheKey{{CacheKey: k, Exporter: &exporter{k: k}}})
+	require.NoError(t, j0.InjectResult(Edge{Vertex: v1}, res))
 
-func (v *vertex) Digest() digest.Digest {
-	return digest.FromBytes([]byte(v.opt.name))
-}
-func (v *vertex) Sys() interface{} {
-	return v
-}
-func (v *vertex) Inputs() []Edge {
-	return v.opt.inputs
-}
-func (v *vertex) Name() string {
-	return v.opt.name
-}
-func (v *vertex) Options() VertexOptions {
-	var cache []CacheManager
-	if v.opt.cacheSource != nil {
-		cache = append(cache, v.opt.cacheSource)
-	}
-	return VertexOptions{
-		CacheSources: cache,
-		IgnoreCache:  v.opt.ignoreCache,
-	}
-}
+	res0, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 14, unwrapInt(res0))
 
-func (v *vertex) setupCallCounters() {
-	var cacheCount int64
-	var execCount int64
+	// the counters are shared by the graph, the injected vertex didn't run
+	require.Equal(t, int64(2), *v1.cacheCallCount)
+	require.Equal(t, int64(2), *v1.execCallCount)
 
-	v.setCallCounters(&cacheCount, &execCount)
+	err = j0.InjectResult(Edge{Vertex: v1}, res)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrEdgeComplete))
 }
 
-func (v *vertex) setCallCounters(cacheCount, execCount *int64) {
-	v.cacheCallCount = cacheCount
-	v.execCallCount = execCount
+func TestMaxPendingResults(t *testing.T) {
+	t.Parallel()
 
-	for _, inp := range v.opt.inputs {
-		var v *vertex
-		switch vv := inp.Vertex.(type) {
-		case *vertex:
-			v = vv
-		case *vertexSum:
-			v = vv.vertex
-		case *vertexConst:
-			v = vv.vertex
-		case *vertexSubBuild:
-			v = vv.vertex
-		}
-		v.setCallCounters(cacheCount, execCount)
-	}
-}
+	s := newScheduler(nil, withManualDispatch(), WithMaxPendingResults(1))
+	defer s.Stop()
 
-func (v *vertex) cacheMap(ctx context.Context) error {
-	if f := v.opt.cachePreFunc; f != nil {
-		if err := f(ctx); err != nil {
-			return err
+	e := &edge{edge: Edge{Vertex: vtx(vtxOpt{name: "v0"})}}
+
+	started := make(chan int, 3)
+	fn := func(i int) func(context.Context) (interface{}, error) {
+		return func(context.Context) (interface{}, error) {
+			started <- i
+			return i, nil
 		}
 	}
-	if v.cacheCallCount != nil {
-		atomic.AddInt64(v.cacheCallCount, 1)
-	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
-	}
+
+	s.mu.Lock()
+	r0 := s.newRequestWithFunc(e, fn(0))
+	s.mu.Unlock()
+
+	require.Equal(t, 0, <-started)
+	require.Eventually(t, func() bool {
+		return r0.Receive() && r0.Status().Completed
+	}, time.Second, time.Millisecond)
+
+	// the result of the first request is not received by the scheduler yet
+	s.mu.Lock()
+	r1 := s.newRequestWithFunc(e, fn(1))
+	s.mu.Unlock()
 	select {
-	case <-time.After(v.opt.cacheDelay):
-	case <-ctx.Done():
-		return ctx.Err()
+	case <-started:
+		t.Fatal("request started while the pending results are full")
+	case <-time.After(20 * time.Millisecond):
 	}
-	return nil
+	require.Equal(t, waitingOnReceivers, atomic.LoadInt32(&s.outgoing[e][1].waiting))
+
+	s.pending.done(s.outgoing[e][0])
+	require.Equal(t, 1, <-started)
+	require.Eventually(t, func() bool {
+		return r1.Receive() && r1.Status().Completed
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1, r1.Status().Value)
+
+	// a waiting request can be canceled
+	s.mu.Lock()
+	r2 := s.newRequestWithFunc(e, fn(2))
+	s.mu.Unlock()
+	r2.Cancel()
+	require.Eventually(t, func() bool {
+		return r2.Receive() && r2.Status().Completed
+	}, time.Second, time.Millisecond)
+	require.True(t, r2.Status().Canceled)
+	require.Len(t, started, 0)
 }
 
-func (v *vertex) CacheMap(ctx context.Context, g session.Group, index int) (*CacheMap, bool, error) {
-	if index == 0 {
-		if err := v.cacheMap(ctx); err != nil {
-			return nil, false, err
-		}
-		return v.makeCacheMap(), len(v.opt.cacheKeySeeds) == index, nil
-	}
-	return &CacheMap{
-		Digest: digest.FromBytes([]byte(fmt.Sprintf("seed:%s", v.opt.cacheKeySeeds[index-1]()))),
-	}, len(v.opt.cacheKeySeeds) == index, nil
-}
+func TestEdgeCleanup(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func (v *vertex) exec(ctx context.Context, inputs []Result) error {
-	if len(inputs) != len(v.Inputs()) {
-		return errors.Errorf("invalid number of inputs")
-	}
-	if f := v.opt.execPreFunc; f != nil {
-		if err := f(ctx); err != nil {
-			return err
-		}
-	}
-	if v.execCallCount != nil {
-		atomic.AddInt64(v.execCallCount, 1)
-	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	var mu sync.Mutex
+	cleaned := map[string]int{}
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithEdgeCleanupHandler(func(e Edge) {
+			mu.Lock()
+			cleaned[EdgeKey(e)]++
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: vtxConst(4, vtxOpt{})},
+			},
+		}),
 	}
-	select {
-	case <-time.After(v.opt.execDelay):
-	case <-ctx.Done():
-		return ctx.Err()
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
+
+	mu.Lock()
+	require.Len(t, cleaned, 0)
+	mu.Unlock()
+
+	require.NoError(t, j0.Discard())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, cleaned, 3)
+	require.Equal(t, 1, cleaned[EdgeKey(g0)])
+	for _, inp := range g0.Vertex.Inputs() {
+		require.Equal(t, 1, cleaned[EdgeKey(inp)])
 	}
-	return nil
 }
 
-func (v *vertex) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
-	if err := v.exec(ctx, inputs); err != nil {
-		return nil, err
-	}
-	return []Result{&dummyResult{id: identity.NewID(), value: v.opt.value}}, nil
+type testSpanKey struct{}
+
+func TestResultHandler(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var mu sync.Mutex
+	results := map[string]interface{}{}
+
+	var s *Solver
+	s = NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithResultHandler(func(e Edge, res CachedResult) {
+			// scheduler is not locked
+			s.Stats()
+			mu.Lock()
+			results[e.Vertex.Name()] = unwrap(res)
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}},
+		}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	_, err = j1.Build(ctx, Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v2",
+			value: "result2",
+			execPreFunc: func(context.Context) error {
+				return errors.Errorf("exec failed")
+			},
+		}),
+	})
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[string]interface{}{"v0": "result0", "v1": "result1"}, results)
 }
 
-func (v *vertex) makeCacheMap() *CacheMap {
-	m := &CacheMap{
-		Digest: digest.FromBytes([]byte(fmt.Sprintf("seed:%s", v.opt.cacheKeySeed))),
-		Deps: make([]struct {
-			Selector          digest.Digest
-			ComputeDigestFunc ResultBasedCacheFunc
-			PreprocessFunc    PreprocessFunc
-		}, len(v.Inputs())),
-	}
-	for i, f := range v.opt.slowCacheCompute {
-		m.Deps[i].ComputeDigestFunc = f
-	}
-	for i, dgst := range v.opt.selectors {
-		m.Deps[i].Selector = dgst
+func TestEdgeMeta(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	var mu sync.Mutex
+	meta := map[string]interface{}{}
+
+	var s *Solver
+	s = NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithEdgeCompletionHandler(func(ctx context.Context, ev CompletionEvent) {
+			mu.Lock()
+			meta[ev.Edge.Vertex.Name()] = ev.Meta["span"]
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	var g0 Edge
+	g0 = Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v0",
+			value: "result0",
+			execPreFunc: func(context.Context) error {
+				return s.SetEdgeMeta(g0, "span", "span0")
+			},
+			inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}},
+		}),
 	}
-	return m
+	require.Error(t, s.SetEdgeMeta(g0, "span", "span0"))
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	mu.Lock()
+	require.Equal(t, map[string]interface{}{"v0": "span0", "v1": nil}, meta)
+	mu.Unlock()
+
+	v, ok := s.EdgeMeta(g0, "span")
+	require.True(t, ok)
+	require.Equal(t, "span0", v)
+
+	require.NoError(t, j0.Discard())
+	_, ok = s.EdgeMeta(g0, "span")
+	require.False(t, ok)
 }
 
-// vtxConst returns a vertex that outputs a constant integer
-func vtxConst(v int, opt vtxOpt) *vertexConst {
-	if opt.cacheKeySeed == "" {
-		opt.cacheKeySeed = fmt.Sprintf("const-%d", v)
-	}
-	if opt.name == "" {
-		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+func TestEdgeIDs(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		var mu sync.Mutex
+		ids := map[string]uint64{}
+
+		s := NewSolver(SolverOpt{
+			ResolveOpFunc: testOpResolver,
+			SchedulerOptions: []SchedulerOption{WithEdgeCompletionHandler(func(ctx context.Context, ev CompletionEvent) {
+				mu.Lock()
+				ids[ev.Edge.Vertex.Name()] = ev.EdgeID
+				mu.Unlock()
+			})},
+		})
+
+		j0, err := s.NewJob("job0")
+		require.NoError(t, err)
+
+		g0 := Edge{
+			Vertex: vtx(vtxOpt{
+				name:  "v0",
+				value: "result0",
+				inputs: []Edge{
+					{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})},
+					{Vertex: vtx(vtxOpt{name: "v2", value: "result2"})},
+				},
+			}),
+		}
+		_, err = j0.Build(ctx, g0)
+		require.NoError(t, err)
+
+		// every scheduler numbers its edges from 1
+		mu.Lock()
+		require.Equal(t, uint64(1), ids["v0"])
+		require.ElementsMatch(t, []uint64{2, 3}, []uint64{ids["v1"], ids["v2"]})
+		mu.Unlock()
+
+		info := s.EdgeInfo(g0)
+		require.NotNil(t, info)
+		require.Equal(t, uint64(1), info.ID)
+
+		deps := s.DependencyReport(g0)
+		require.Len(t, deps, 2)
+		require.Equal(t, ids["v1"], deps[0].EdgeID)
+		require.Equal(t, ids["v2"], deps[1].EdgeID)
+
+		require.NoError(t, j0.Discard())
+		s.Close()
 	}
-	return &vertexConst{vertex: vtx(opt), value: v}
 }
 
-type vertexConst struct {
-	*vertex
-	value int
-}
+func TestEdgeCompletion(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func (v *vertexConst) Sys() interface{} {
-	return v
-}
+	var mu sync.Mutex
+	spans := map[string]interface{}{}
+	events := map[string]CompletionEvent{}
 
-func (v *vertexConst) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
-	if err := v.exec(ctx, inputs); err != nil {
-		return nil, err
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithEdgeCompletionHandler(func(ctx context.Context, ev CompletionEvent) {
+			mu.Lock()
+			spans[ev.Edge.Vertex.Name()] = ctx.Value(testSpanKey{})
+			events[ev.Edge.Vertex.Name()] = ev
+			mu.Unlock()
+		})},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	buildCtx := WithBuildLabels(context.WithValue(ctx, testSpanKey{}, "span0"), map[string]string{"tenant": "a"})
+	res, err := j0.Build(buildCtx, Edge{
+		Vertex: vtx(vtxOpt{
+			name:   "v0",
+			value:  "result0",
+			inputs: []Edge{{Vertex: vtx(vtxOpt{name: "v1", value: "result1"})}},
+		}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "result0", unwrap(res))
+
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	_, err = j1.Build(context.WithValue(ctx, testSpanKey{}, "span1"), Edge{
+		Vertex: vtx(vtxOpt{
+			name:  "v2",
+			value: "result2",
+			execPreFunc: func(context.Context) error {
+				return errors.Errorf("exec failed")
+			},
+		}),
+	})
+	require.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[string]interface{}{"v0": "span0", "v1": "span0", "v2": "span1"}, spans)
+	for _, name := range []string{"v0", "v1"} {
+		require.NoError(t, events[name].Err)
+		require.Equal(t, "a", events[name].Labels["tenant"])
+		require.NotNil(t, events[name].Build)
+		require.Equal(t, "job0", events[name].Build.JobID)
 	}
-	return []Result{&dummyResult{id: identity.NewID(), intValue: v.value}}, nil
+	require.Error(t, events["v2"].Err)
+	require.Contains(t, events["v2"].Err.Error(), "exec failed")
 }
 
-// vtxSum returns a vertex that ourputs sum of its inputs plus a constant
-func vtxSum(v int, opt vtxOpt) *vertexSum {
-	if opt.cacheKeySeed == "" {
-		opt.cacheKeySeed = fmt.Sprintf("sum-%d-%d", v, len(opt.inputs))
-	}
-	if opt.name == "" {
-		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+func TestCacheOnCancel(t *testing.T) {
+	t.Parallel()
+
+	for _, drain := range []bool{true, false} {
+		drain := drain
+		t.Run(fmt.Sprintf("drain=%v", drain), func(t *testing.T) {
+			t.Parallel()
+
+			s := NewSolver(SolverOpt{
+				ResolveOpFunc: testOpResolver,
+			})
+			defer s.Close()
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var execs int64
+			v1 := vtxConst(4, vtxOpt{
+				execPreFunc: func(ctx context.Context) error {
+					if atomic.AddInt64(&execs, 1) > 1 {
+						return nil
+					}
+					close(started)
+					select {
+					case <-release:
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				},
+			})
+			g0 := Edge{
+				Vertex: vtxSum(1, vtxOpt{
+					inputs: []Edge{{Vertex: v1}},
+				}),
+			}
+
+			j0, err := s.NewJob("job0")
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			if drain {
+				ctx = WithCacheOnCancel(ctx)
+			}
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := j0.Build(ctx, g0)
+				errCh <- err
+			}()
+
+			<-started
+			cancel()
+
+			if drain {
+				// the running operation is waited for
+				select {
+				case err := <-errCh:
+					t.Fatalf("build returned before the operation finished: %v", err)
+				case <-time.After(20 * time.Millisecond):
+				}
+				close(release)
+			}
+			err = <-errCh
+			require.Error(t, err)
+			require.True(t, errors.Is(err, context.Canceled))
+			require.NoError(t, j0.Discard())
+
+			j1, err := s.NewJob("job1")
+			require.NoError(t, err)
+			defer j1.Discard()
+
+			res, err := j1.Build(context.TODO(), Edge{Vertex: v1})
+			require.NoError(t, err)
+			require.Equal(t, 4, unwrapInt(res))
+
+			if drain {
+				// the result was saved to the cache by the canceled build
+				require.Equal(t, int64(1), atomic.LoadInt64(&execs))
+			} else {
+				require.Equal(t, int64(2), atomic.LoadInt64(&execs))
+			}
+		})
 	}
-	return &vertexSum{vertex: vtx(opt), value: v}
 }
 
-type vertexSum struct {
-	*vertex
-	value int
-}
+type testRequestIDKey struct{}
 
-func (v *vertexSum) Sys() interface{} {
-	return v
-}
+func TestRequestIDLogging(t *testing.T) {
+	t.Parallel()
 
-func (v *vertexSum) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
-	if err := v.exec(ctx, inputs); err != nil {
-		return nil, err
+	var logs lockedBuffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+
+	var mu sync.Mutex
+	var events []CancelEvent
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithLogger(logger),
+			WithTrace(true),
+			WithAdmissionRate(1, 10*time.Millisecond),
+			WithRequestID(testRequestIDKey{}, "req"),
+			WithCancelHandler(func(ev CancelEvent) {
+				mu.Lock()
+				events = append(events, ev)
+				mu.Unlock()
+			}),
+		},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	ctx := context.WithValue(context.TODO(), testRequestIDKey{}, "client-0")
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: vtxConst(4, vtxOpt{})},
+			},
+		}),
 	}
-	s := v.value
-	for _, inp := range inputs {
-		r, ok := inp.Sys().(*dummyResult)
-		if !ok {
-			return nil, errors.Errorf("invalid input type: %T", inp.Sys())
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
+
+	held := 0
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "for admission") {
+			require.Contains(t, l, "req=client-0")
+			held++
 		}
-		s += r.intValue
 	}
-	return []Result{&dummyResult{id: identity.NewID(), intValue: s}}, nil
-}
+	require.True(t, held > 0)
 
-func vtxSubBuild(g Edge, opt vtxOpt) *vertexSubBuild {
-	if opt.cacheKeySeed == "" {
-		opt.cacheKeySeed = fmt.Sprintf("sum-%s", identity.NewID())
+	// cancel events carry the request ID
+	ctx, cancel := context.WithCancel(ctx)
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v1",
+			cachePreFunc: func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+		}),
 	}
-	if opt.name == "" {
-		opt.name = opt.cacheKeySeed + "-" + identity.NewID()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = j0.Build(ctx, g1)
+	require.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, len(events) > 0)
+	for _, ev := range events {
+		require.Equal(t, "client-0", ev.RequestID)
 	}
-	return &vertexSubBuild{vertex: vtx(opt), g: g}
 }
 
-type vertexSubBuild struct {
-	*vertex
-	g Edge
-	b Builder
-}
+func TestMaxEdgePipes(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func (v *vertexSubBuild) Sys() interface{} {
-	return v
-}
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc:    testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithMaxEdgePipes(4)},
+	})
+	defer s.Close()
 
-func (v *vertexSubBuild) Exec(ctx context.Context, g session.Group, inputs []Result) (outputs []Result, err error) {
-	if err := v.exec(ctx, inputs); err != nil {
-		return nil, err
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	sum := func(n int) Edge {
+		inputs := make([]Edge, 0, n)
+		for i := 0; i < n; i++ {
+			inputs = append(inputs, Edge{Vertex: vtxConst(i, vtxOpt{})})
+		}
+		return Edge{Vertex: vtxSum(0, vtxOpt{inputs: inputs})}
 	}
-	res, err := v.b.Build(ctx, v.g)
-	if err != nil {
-		return nil, err
+
+	res, err := j0.Build(ctx, sum(2))
+	require.NoError(t, err)
+	require.Equal(t, 1, unwrapInt(res))
+
+	_, err = j0.Build(ctx, sum(8))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrTooManyPipes))
+
+	// too many builds waiting for the same edge
+	wait := make(chan struct{})
+	g0 := Edge{Vertex: vtx(vtxOpt{
+		name:         "v0",
+		cachePreFunc: func(context.Context) error { <-wait; return nil },
+	})}
+	eg, _ := errgroup.WithContext(ctx)
+	for i := 0; i < 4; i++ {
+		eg.Go(func() error {
+			_, err := j0.Build(ctx, g0)
+			return err
+		})
 	}
-	return []Result{res}, nil
+	require.Eventually(t, func() bool {
+		_, err := j0.Build(ctx, g0)
+		return errors.Is(err, ErrTooManyPipes)
+	}, time.Second, 5*time.Millisecond)
+	close(wait)
+	require.NoError(t, eg.Wait())
 }
 
-//nolint:unused
-func printGraph(e Edge, pfx string) {
-	name := e.Vertex.Name()
-	fmt.Printf("%s %d %s\n", pfx, e.Index, name)
-	for _, inp := range e.Vertex.Inputs() {
-		printGraph(inp, pfx+"-->")
+func TestPruneIndex(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+				{Vertex: vtxConst(4, vtxOpt{})},
+			},
+		}),
 	}
-}
 
-type dummyResult struct {
-	id       string
-	value    string
-	intValue int
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
+
+	n := s.Stats().IndexEntries
+	require.True(t, n > 0)
+
+	require.Equal(t, n, s.PruneIndex())
+	require.Equal(t, 0, s.Stats().IndexEntries)
+	require.Equal(t, 0, s.PruneIndex())
+
+	res, err = j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 8, unwrapInt(res))
 }
 
-func (r *dummyResult) ID() string                    { return r.id }
-func (r *dummyResult) Release(context.Context) error { return nil }
-func (r *dummyResult) Sys() interface{}              { return r }
-func (r *dummyResult) Clone() Result                 { return r }
+func TestResourceLimits(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func testOpResolver(v Vertex, b Builder) (Op, error) {
-	if op, ok := v.Sys().(Op); ok {
-		if vtx, ok := op.(*vertexSubBuild); ok {
-			vtx.b = b
-		}
-		return op, nil
-	}
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
 
-	return nil, errors.Errorf("invalid vertex")
-}
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
 
-func unwrap(res Result) string {
-	r, ok := res.Sys().(*dummyResult)
-	if !ok {
-		return "unwrap-error"
+	var mu sync.Mutex
+	limits := map[string]*ResourceLimits{}
+	record := func(name string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			limits[name] = ResourceLimitsFromContext(ctx)
+			mu.Unlock()
+			return nil
+		}
 	}
-	return r.value
-}
 
-func unwrapInt(res Result) int {
-	r, ok := res.Sys().(*dummyResult)
-	if !ok {
-		return -1e6
+	l := &ResourceLimits{CPUs: 0.5, Memory: 64 << 20}
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			name:           "v0",
+			resourceLimits: l,
+			execPreFunc:    record("v0"),
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{name: "v1", execPreFunc: record("v1")})},
+			},
+		}),
 	}
-	return r.intValue
-}
 
-func blockingFuncion(i int) func(context.Context) error {
-	limit := int64(i)
-	block := make(chan struct{})
-	return func(context.Context) error {
-		if atomic.AddInt64(&limit, -1) == 0 {
-			close(block)
-		}
-		<-block
-		return nil
-	}
-}
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 4, unwrapInt(res))
 
-func newTrackingCacheManager(cm CacheManager) *trackingCacheManager {
-	return &trackingCacheManager{CacheManager: cm}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, l, limits["v0"])
+	require.Nil(t, limits["v1"])
 }
 
-type trackingCacheManager struct {
-	CacheManager
-	loadCounter int64
-	forceFail   bool
-}
+func TestBuildCompleteEdge(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
 
-func (cm *trackingCacheManager) Load(ctx context.Context, rec *CacheRecord) (Result, error) {
-	atomic.AddInt64(&cm.loadCounter, 1)
-	if cm.forceFail {
-		return nil, errors.Errorf("force fail")
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{})},
+			},
+		}),
 	}
-	return cm.CacheManager.Load(ctx, rec)
-}
 
-func digestFromResult(ctx context.Context, res Result, _ session.Group) (digest.Digest, error) {
-	return digest.FromBytes([]byte(unwrap(res))), nil
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 4, unwrapInt(res))
+
+	// the complete edge returns its result without being dispatched again
+	dispatches := s.Stats().Dispatch.Dispatches
+	res, key, err := j0.BuildWithCacheKey(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, 4, unwrapInt(res))
+	require.NotNil(t, key.CacheKey)
+	require.Equal(t, dispatches, s.Stats().Dispatch.Dispatches)
 }
 
-func testExporterOpts(all bool) CacheExportOpt {
-	mode := CacheExportModeMin
-	if all {
-		mode = CacheExportModeMax
-	}
-	return CacheExportOpt{
-		Convert: func(ctx context.Context, res Result) (*Remote, error) {
-			if dr, ok := res.Sys().(*dummyResult); ok {
-				return &Remote{Descriptors: []ocispec.Descriptor{{
-					Annotations: map[string]string{"value": fmt.Sprintf("%d", dr.intValue)},
-				}}}, nil
-			}
-			return nil, nil
+func TestSaturation(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	events := make(chan SaturationEvent, 10)
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{
+			WithConcurrency(1),
+			WithSaturationHandler(10*time.Millisecond, func(ev SaturationEvent) {
+				events <- ev
+			}),
 		},
-		Mode: mode,
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	release := make(chan struct{})
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{
+					name:         "v1",
+					cachePreFunc: func(context.Context) error { <-release; return nil },
+				})},
+				{Vertex: vtxConst(4, vtxOpt{
+					name:         "v2",
+					cachePreFunc: func(context.Context) error { <-release; return nil },
+				})},
+			},
+		}),
 	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := j0.Build(ctx, g0)
+		errCh <- err
+	}()
+
+	ev := <-events
+	require.NotNil(t, ev.Edge.Vertex)
+	require.True(t, ev.Waiting >= 10*time.Millisecond)
+	require.True(t, s.Stats().FuncRequestsWaiting > 0)
+
+	close(release)
+	require.NoError(t, <-errCh)
+	require.Equal(t, 0, s.Stats().FuncRequestsWaiting)
 }
 
-func newTestExporterTarget() *testExporterTarget {
-	return &testExporterTarget{
-		visited: map[interface{}]struct{}{},
+func TestStopGracefully(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g0 := Edge{
+		Vertex: vtxSum(1, vtxOpt{
+			name: "v0",
+			inputs: []Edge{
+				{Vertex: vtxConst(3, vtxOpt{
+					name: "v1",
+					execPreFunc: func(context.Context) error {
+						close(started)
+						<-release
+						return nil
+					},
+				})},
+			},
+		}),
 	}
-}
 
-type testExporterTarget struct {
-	visited map[interface{}]struct{}
-	records []*testExporterRecord
-}
+	errCh := make(chan error, 1)
+	go func() {
+		res, err := j0.Build(ctx, g0)
+		if err == nil && unwrapInt(res) != 4 {
+			err = errors.Errorf("invalid result %d", unwrapInt(res))
+		}
+		errCh <- err
+	}()
+	<-started
+
+	var exported []string
+	stopCh := make(chan error, 1)
+	go func() {
+		stopCh <- s.StopGracefully(ctx, func(ctx context.Context, e Edge, res CachedResult) error {
+			exported = append(exported, e.Vertex.Name())
+			require.Len(t, res.CacheKeys(), 1)
+			return nil
+		})
+	}()
 
-func (t *testExporterTarget) Add(dgst digest.Digest) CacheExporterRecord {
-	r := &testExporterRecord{dgst: dgst}
-	t.records = append(t.records, r)
-	return r
-}
-func (t *testExporterTarget) Visit(v interface{}) {
-	t.visited[v] = struct{}{}
+	require.Eventually(t, func() bool {
+		_, err := j0.Build(ctx, Edge{Vertex: vtxConst(5, vtxOpt{})})
+		return errors.Is(err, ErrStopping)
+	}, time.Second, time.Millisecond)
 
-}
-func (t *testExporterTarget) Visited(v interface{}) bool {
-	_, ok := t.visited[v]
-	return ok
+	close(release)
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-stopCh)
+	require.Equal(t, []string{"v1", "v0"}, exported)
 }
 
-func (t *testExporterTarget) normalize() {
-	m := map[digest.Digest]struct{}{}
-	rec := make([]*testExporterRecord, 0, len(t.records))
-	for _, r := range t.records {
-		if _, ok := m[r.dgst]; ok {
-			for _, r2 := range t.records {
-				delete(r2.linkMap, r.dgst)
-				r2.links = len(r2.linkMap)
+func TestStopGracefullySharedDependency(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+
+	j0, err := l.NewJob("job0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	j1, err := l.NewJob("job1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	v3 := vtx(vtxOpt{
+		name:  "v3",
+		value: "result3",
+		inputs: []Edge{{Vertex: vtx(vtxOpt{
+			name:  "v4",
+			value: "result4",
+			execPreFunc: func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			},
+		})}},
+	})
+	// v3 is first requested as the root of a build and later as a deep
+	// dependency of another build
+	g1 := Edge{Vertex: vtx(vtxOpt{
+		name:  "v0",
+		value: "result0",
+		inputs: []Edge{
+			{Vertex: vtx(vtxOpt{
+				name:   "v1",
+				value:  "result1",
+				inputs: []Edge{{Vertex: v3}},
+			})},
+			{Vertex: vtx(vtxOpt{
+				name:   "v2",
+				value:  "result2",
+				inputs: []Edge{{Vertex: v3}},
+			})},
+		},
+	})}
+
+	eg, _ := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := j0.Build(ctx, Edge{Vertex: v3})
+		return err
+	})
+	<-started
+	eg.Go(func() error {
+		_, err := j1.Build(ctx, g1)
+		return err
+	})
+	require.Eventually(t, func() bool {
+		for _, se := range l.Snapshot().Edges {
+			if se.Edge.Vertex.Name() == "v3" && se.Requests == 3 {
+				return true
 			}
-			continue
 		}
-		m[r.dgst] = struct{}{}
-		rec = append(rec, r)
-	}
-	t.records = rec
-}
+		return false
+	}, 5*time.Second, time.Millisecond)
+
+	var exported []string
+	stopCh := make(chan error, 1)
+	go func() {
+		stopCh <- l.StopGracefully(ctx, func(ctx context.Context, e Edge, res CachedResult) error {
+			exported = append(exported, e.Vertex.Name())
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		_, err := j0.Build(ctx, Edge{Vertex: vtx(vtxOpt{name: "v5"})})
+		return errors.Is(err, ErrStopping)
+	}, time.Second, time.Millisecond)
 
-type testExporterRecord struct {
-	dgst    digest.Digest
-	results int
-	links   int
-	linkMap map[digest.Digest]struct{}
-}
+	close(release)
+	require.NoError(t, eg.Wait())
+	require.NoError(t, <-stopCh)
 
-func (r *testExporterRecord) AddResult(createdAt time.Time, result *Remote) {
-	r.results++
+	require.Len(t, exported, 5)
+	pos := map[string]int{}
+	for i, name := range exported {
+		pos[name] = i
+	}
+	require.Less(t, pos["v4"], pos["v3"])
+	require.Less(t, pos["v3"], pos["v1"])
+	require.Less(t, pos["v3"], pos["v2"])
+	require.Less(t, pos["v1"], pos["v0"])
+	require.Less(t, pos["v2"], pos["v0"])
 }
 
-func (r *testExporterRecord) LinkFrom(src CacheExporterRecord, index int, selector string) {
-	if s, ok := src.(*testExporterRecord); ok {
-		if r.linkMap == nil {
-			r.linkMap = map[digest.Digest]struct{}{}
-		}
-		if _, ok := r.linkMap[s.dgst]; !ok {
-			r.linkMap[s.dgst] = struct{}{}
-			r.links++
+func TestIndexSnapshotPrewarm(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	newGraph := func() Edge {
+		return Edge{
+			Vertex: vtxSum(1, vtxOpt{name: "sum", inputs: []Edge{
+				{Vertex: vtxConst(2, vtxOpt{name: "c2"})},
+				{Vertex: vtxConst(3, vtxOpt{name: "c3"})},
+			}}),
 		}
 	}
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+	defer j0.Discard()
+
+	res, err := j0.Build(ctx, newGraph())
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+	resultID := res.Sys().(*dummyResult).id
+
+	dt, err := json.Marshal(l.IndexSnapshot())
+	require.NoError(t, err)
+	var snap IndexSnapshot
+	require.NoError(t, json.Unmarshal(dt, &snap))
+
+	// the restarted solver doesn't share the cache of the first one
+	var loaded []string
+	l2 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		SchedulerOptions: []SchedulerOption{WithIndexSnapshot(&snap, func(ie IndexedEdge) (Result, bool) {
+			loaded = append(loaded, ie.Name)
+			if ie.ResultID != resultID {
+				return nil, false
+			}
+			return &dummyResult{id: ie.ResultID, intValue: 6}, true
+		})},
+	})
+	defer l2.Close()
+
+	j1, err := l2.NewJob("j1")
+	require.NoError(t, err)
+	defer j1.Discard()
+
+	g := newGraph()
+	g.Vertex.(*vertexSum).setupCallCounters()
+	res, err = j1.Build(ctx, g)
+	require.NoError(t, err)
+	require.Equal(t, 6, unwrapInt(res))
+	require.Equal(t, resultID, res.ID())
+	// the results of the inputs are not provided by the loader, so they are
+	// evaluated. The restored result of sum is used without executing it.
+	require.ElementsMatch(t, []string{"c2", "c3", "sum"}, loaded)
+	require.Equal(t, int64(2), *g.Vertex.(*vertexSum).execCallCount)
+	require.Equal(t, int64(3), *g.Vertex.(*vertexSum).cacheCallCount)
+
+	// a snapshot can only be restored into an empty index
+	require.Error(t, l.index.Restore(&snap))
 }
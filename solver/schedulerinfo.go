@@ -0,0 +1,327 @@
+package solver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/moby/buildkit/solver/internal/pipe"
+)
+
+// DepResult describes how a dependency of a completed edge was resolved
+type DepResult struct {
+	// Index is the input index of the dependency
+	Index Index
+	// EdgeID is the ID of the edge of the dependency, zero if the edge is not
+	// loaded anymore
+	EdgeID uint64
+	// CacheKeys are the cache keys the dependency was resolved to. If the
+	// dependency was evaluated these are the keys of its result.
+	CacheKeys []ExportableCacheKey
+	// SlowCacheKey is the content based cache key of the dependency if one was
+	// computed
+	SlowCacheKey *ExportableCacheKey
+	// HasResult is true if the dependency was evaluated into a result. It is
+	// false if the dependent edge did not need the result, for example because
+	// it was itself loaded from the cache.
+	HasResult bool
+	// Cached is true if the result of the dependency was loaded from the cache
+	// instead of executing the dependency
+	Cached bool
+	// Wait is the total time the edge waited for its requests to the
+	// dependency to complete. The dependency with the longest wait is on the
+	// critical path of the edge.
+	Wait time.Duration
+}
+
+// EdgeInfo describes how the scheduler processed an edge
+type EdgeInfo struct {
+	// ID is the ID the scheduler assigned to the edge. For merged edges it
+	// is the ID of the edge in MergedTo.
+	ID uint64
+	// Complete is true if the edge has completed
+	Complete bool
+	// MergedCount is the number of edges that were merged into this edge
+	// because they had matching cache keys
+	MergedCount int
+	// MergedTo is the edge that took over if this edge was merged into
+	// another edge. MergedCount of a merged edge is always zero.
+	MergedTo *Edge
+}
+
+// EdgeInfo returns the merge state of an edge. Nil is returned for edges the
+// scheduler doesn't know about.
+func (s *scheduler) EdgeInfo(edge Edge) *EdgeInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil {
+		return nil
+	}
+	info := &EdgeInfo{
+		ID:       e.id,
+		Complete: e.isComplete(),
+	}
+	if e.edge.Index != edge.Index || e.edge.Vertex.Digest() != edge.Vertex.Digest() {
+		target := e.edge
+		info.MergedTo = &target
+	} else {
+		info.MergedCount = e.mergedCount
+	}
+	return info
+}
+
+// WhyBlocked returns a human-readable reason why an edge has not completed yet
+func (s *scheduler) WhyBlocked(edge Edge) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil {
+		return "unknown edge"
+	}
+	return s.whyBlocked(e)
+}
+
+// whyBlocked returns the reason why e has not completed yet. Called with s.mu
+// held.
+func (s *scheduler) whyBlocked(e *edge) string {
+	if e.isComplete() {
+		return "complete"
+	}
+	if len(s.incoming[e]) == 0 {
+		return "no incoming requests"
+	}
+	if _, ok := s.held[e]; ok {
+		return "held for admission"
+	}
+	if e.redispatchTimer != nil {
+		return "dispatch delayed by polling interval"
+	}
+
+	s.muQ.Lock()
+	_, queued := s.waitq[e]
+	s.muQ.Unlock()
+	if queued {
+		return "queued, loop busy"
+	}
+
+	for _, p := range s.outgoing[e] {
+		switch atomic.LoadInt32(&p.waiting) {
+		case waitingOnConcurrency:
+			return "over concurrency limit"
+		case waitingOnLock:
+			return "waiting for exclusive lock"
+		case waitingOnReceivers:
+			return "waiting for results to be received"
+		}
+	}
+	if isOpen(e.condReq) {
+		return fmt.Sprintf("waiting on condition (vertex %s)", e.edge.Vertex.Options().Condition.Edge.Vertex.Name())
+	}
+	if isOpen(e.condCheckReq) {
+		return "evaluating condition"
+	}
+	for _, d := range e.deps {
+		if isOpen(d.req) {
+			return fmt.Sprintf("waiting on dep %d (vertex %s)", d.index, e.edge.Vertex.Inputs()[d.index].Vertex.Name())
+		}
+		if isOpen(d.slowCacheReq) {
+			return fmt.Sprintf("computing content cache key for dep %d", d.index)
+		}
+	}
+	if isOpen(e.cacheMapReq) {
+		return "computing cache key"
+	}
+	if isOpen(e.execReq) {
+		if e.execCacheLoad {
+			return "loading cache"
+		}
+		return "executing"
+	}
+	return "waiting for updates"
+}
+
+func isOpen(r pipe.Receiver) bool {
+	return r != nil && !r.Status().Completed
+}
+
+// DependencyReport returns the resolved state of the dependencies of an edge.
+// The report is only available once the edge has completed, nil is returned
+// otherwise.
+func (s *scheduler) DependencyReport(edge Edge) []DepResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil || !e.isComplete() {
+		return nil
+	}
+
+	out := make([]DepResult, 0, len(e.deps))
+	for i, d := range e.deps {
+		dr := DepResult{
+			Index:        d.index,
+			SlowCacheKey: d.slowCacheKey,
+			Wait:         d.wait,
+		}
+		de := s.ef.lookupEdge(e.edge.Vertex.Inputs()[i])
+		if de != nil {
+			dr.EdgeID = de.id
+		}
+		if d.result != nil {
+			dr.HasResult = true
+			dr.CacheKeys = d.result.CacheKeys()
+			if de != nil {
+				dr.Cached = de.execCacheLoad
+			}
+		} else {
+			dr.CacheKeys = append([]ExportableCacheKey(nil), d.keys...)
+		}
+		out = append(out, dr)
+	}
+	return out
+}
+
+// EdgeState is the progress of an edge toward its result
+type EdgeState int
+
+const (
+	// EdgeStateInitial is the state of an edge that has no cache keys yet
+	EdgeStateInitial EdgeState = iota
+	// EdgeStateCacheFast is reached when the definition based cache keys of
+	// the edge are known
+	EdgeStateCacheFast
+	// EdgeStateCacheSlow is reached when the content based cache keys of the
+	// edge are known
+	EdgeStateCacheSlow
+	// EdgeStateComplete is reached when the edge has a result
+	EdgeStateComplete
+)
+
+func (s EdgeState) String() string {
+	if !s.valid() {
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+	return edgeStatusType(s).String()
+}
+
+func (s EdgeState) valid() bool {
+	return s >= EdgeStateInitial && s <= EdgeStateComplete
+}
+
+// DesiredState returns the state the scheduler is currently driving the edge
+// toward. This is the highest desired state of the open requests to the edge or
+// the current state of the edge if nothing is requesting more.
+func (s *scheduler) DesiredState(edge Edge) EdgeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.ef.lookupEdge(edge)
+	if e == nil {
+		return EdgeStateInitial
+	}
+
+	desired := e.state
+	for _, p := range s.incoming[e] {
+		req := p.Sender.Request()
+		if req.Canceled || p.Sender.Status().Completed {
+			continue
+		}
+		if r := req.Payload.(*edgeRequest); r.desiredState > desired {
+			desired = r.desiredState
+		}
+	}
+	return EdgeState(desired)
+}
+
+// ActiveBuilds returns the requests of the builds started from jobs that have
+// not completed yet
+func (s *scheduler) ActiveBuilds() []BuildRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeBuilds()
+}
+
+// activeBuilds returns the requests of the running builds. Called with s.mu
+// held.
+func (s *scheduler) activeBuilds() []BuildRequest {
+	var out []BuildRequest
+	for b := range s.builds {
+		if b.request != nil {
+			out = append(out, *b.request)
+		}
+	}
+	return out
+}
+
+// CompletedEdges returns the edges of the graph of root that have completed
+// with a result. The edges are ordered so that dependencies always come before
+// the edges that depend on them. Edges that were merged are returned once.
+// Inputs that have not been loaded are skipped, they can't have completed.
+func (s *scheduler) CompletedEdges(root Edge) []Edge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Edge
+	visited := map[*edge]struct{}{}
+	var walk func(Edge)
+	walk = func(ee Edge) {
+		e := s.ef.lookupEdge(ee)
+		if e == nil {
+			return
+		}
+		if _, ok := visited[e]; ok {
+			return
+		}
+		visited[e] = struct{}{}
+		for _, inp := range ee.Vertex.Inputs() {
+			walk(inp)
+		}
+		if e.result != nil {
+			out = append(out, e.edge)
+		}
+	}
+	walk(root)
+	return out
+}
+
+// MergeInfo describes an edge whose keys changed and that has not been checked
+// for merging with an edge with a matching cache key yet
+type MergeInfo struct {
+	Edge Edge
+	// EdgeID is the ID the scheduler assigned to the edge
+	EdgeID uint64
+	// Keys is the number of cache keys of the edge
+	Keys int
+	// Deferred is true if the edge is queued for SchedulerOpt.DeferredMerges
+	Deferred bool
+}
+
+// PendingMerges returns the edges waiting to be checked for a merge. Without
+// DeferredMerges edges are checked in the same dispatch their keys change in,
+// so only edges that are being dispatched can be pending.
+func (s *scheduler) PendingMerges() []MergeInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pendingMerges()
+}
+
+// pendingMerges returns the edges waiting to be checked for a merge. Called
+// with s.mu held.
+func (s *scheduler) pendingMerges() []MergeInfo {
+	var out []MergeInfo
+	seen := map[*edge]struct{}{}
+	for _, e := range s.merges {
+		seen[e] = struct{}{}
+		out = append(out, MergeInfo{Edge: e.edge, EdgeID: e.id, Keys: len(e.keys), Deferred: true})
+	}
+	for e := range s.incoming {
+		if _, ok := seen[e]; ok || !e.keysDidChange {
+			continue
+		}
+		out = append(out, MergeInfo{Edge: e.edge, EdgeID: e.id, Keys: len(e.keys)})
+	}
+	return out
+}
@@ -0,0 +1,462 @@
+package solver
+
+import (
+	"context"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// QueuePolicy defines the order the scheduler dispatches queued edges in
+type QueuePolicy int
+
+const (
+	// QueuePolicyFIFO dispatches edges in the order they were queued
+	QueuePolicyFIFO QueuePolicy = iota
+	// QueuePolicyFair dispatches the queued edge of the build that has used
+	// the least cost so far. Cost of an edge is taken from VertexOptions.Cost.
+	QueuePolicyFair
+	// QueuePolicyPriority dispatches the queued edges of the build with the
+	// highest priority first. Priorities are set with WithBuildPriority and
+	// can be changed while the build runs with SetPriority.
+	QueuePolicyPriority
+)
+
+// IndexKeyPolicy defines which cache keys of its dependencies an edge is added
+// to the merge index with
+type IndexKeyPolicy int
+
+const (
+	// IndexKeyPolicyAll indexes edges under all known cache keys of their
+	// dependencies, including the keys of dependency results and content
+	// based keys. Edges merge if any of the keys match, at the cost of an
+	// index entry for every key.
+	IndexKeyPolicyAll IndexKeyPolicy = iota
+	// IndexKeyPolicyFirst indexes edges only under the first cache key of
+	// each dependency. The index stays smaller but edges whose dependencies
+	// match only by later keys, like the keys of a result loaded from the
+	// cache or content based keys, are not merged.
+	IndexKeyPolicyFirst
+)
+
+// SchedulerOption configures the scheduler
+type SchedulerOption func(*SchedulerOpt)
+
+// WithAdmissionRate limits the number of new edges entering dispatch per
+// interval
+func WithAdmissionRate(rate int, interval time.Duration) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.AdmissionRate = rate
+		o.AdmissionInterval = interval
+	}
+}
+
+// WithMaxQueueLength sets the high-water mark for the dispatch queue. If block
+// is set new builds wait for the queue to drain instead of failing.
+func WithMaxQueueLength(n int, block bool) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxQueueLength = n
+		o.BlockWhenOverloaded = block
+	}
+}
+
+// WithMaxSkippedDispatches sets the number of skipped dispatches before an edge
+// is reported as starving
+func WithMaxSkippedDispatches(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxSkippedDispatches = n
+	}
+}
+
+// WithDispatchGate sets the function that can veto the dispatch of an edge
+func WithDispatchGate(f func(Edge) error) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.DispatchGate = f
+	}
+}
+
+// WithResultValidator sets the function validating the results of edges
+func WithResultValidator(f func(Edge, CachedResult) error) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.ResultValidator = f
+	}
+}
+
+// WithResultProcessor registers a processor for the results of vertexes with
+// the type tag typ
+func WithResultProcessor(typ string, p ResultProcessor) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		// the map may be shared with the SchedulerOpt of the caller
+		m := make(map[string]ResultProcessor, len(o.ResultProcessors)+1)
+		for k, v := range o.ResultProcessors {
+			m[k] = v
+		}
+		m[typ] = p
+		o.ResultProcessors = m
+	}
+}
+
+// WithIndexSnapshot pre-warms the merge index from snap. load returns the
+// results recorded in the snapshot so that matching edges complete with them.
+// load can be nil to only restore the keys.
+func WithIndexSnapshot(snap *IndexSnapshot, load func(IndexedEdge) (Result, bool)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.IndexSnapshot = snap
+		o.IndexResultLoader = load
+	}
+}
+
+// WithCancelHandler sets the function receiving the cancellation events of
+// the scheduler
+func WithCancelHandler(f func(CancelEvent)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnCancel = f
+	}
+}
+
+// WithCacheMissHandler sets the function receiving an event for every edge that
+// executes its operation instead of loading a cached result
+func WithCacheMissHandler(f func(CacheMissEvent)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnCacheMiss = f
+	}
+}
+
+// WithWarnUncacheable logs a warning for edges that complete without a cache
+// key
+func WithWarnUncacheable() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.WarnUncacheable = true
+	}
+}
+
+// WithOrphanHandler sets the function called for edges whose outgoing
+// requests are still running after all their incoming requests were closed
+func WithOrphanHandler(f func(Edge)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnOrphaned = f
+	}
+}
+
+// WithEdgeCleanupHandler sets the function called when an edge is released
+func WithEdgeCleanupHandler(f func(Edge)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnEdgeCleanup = f
+	}
+}
+
+// WithEdgeCompletionHandler sets the function called when an edge completes
+func WithEdgeCompletionHandler(f func(context.Context, CompletionEvent)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnEdgeComplete = f
+	}
+}
+
+// WithResultHandler sets the function called with the result of every edge
+// that completes with a result
+func WithResultHandler(f func(Edge, CachedResult)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.OnResult = f
+	}
+}
+
+// WithInputResolver sets the function that can supply the results of inputs
+// without evaluating them
+func WithInputResolver(f func(Edge) (CachedResult, bool)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.InputResolver = f
+	}
+}
+
+// WithFuncRequestTTL fails asynchronous requests whose function doesn't return
+// within d
+func WithFuncRequestTTL(d time.Duration) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.FuncRequestTTL = d
+	}
+}
+
+// WithPreferMergeTarget sets the function deciding which of two matching edges
+// becomes the target of their merge
+func WithPreferMergeTarget(f func(existing, incoming Edge) bool) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.PreferMergeTarget = f
+	}
+}
+
+// WithSpeculativeInputs requests the results of dependencies while the cache
+// check of the edge is still running
+func WithSpeculativeInputs() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.SpeculativeInputs = true
+	}
+}
+
+// WithKeepFinishedWorkOnMerge hands finished operations of merged edges over
+// to the edge they are merged to instead of canceling them
+func WithKeepFinishedWorkOnMerge() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.KeepFinishedWorkOnMerge = true
+	}
+}
+
+// WithSaturationHandler sets the function called for requests that wait for
+// the concurrency limit longer than threshold
+func WithSaturationHandler(threshold time.Duration, f func(SaturationEvent)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.SaturationThreshold = threshold
+		o.OnSaturated = f
+	}
+}
+
+// WithMaxRetainedResults limits the number of results of completed edges held
+// by the scheduler
+func WithMaxRetainedResults(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxRetainedResults = n
+	}
+}
+
+// WithMaxEdgeDepth limits the depth of the build graph
+func WithMaxEdgeDepth(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxEdgeDepth = n
+	}
+}
+
+// WithMaxEdgePipes limits the number of open requests to and from an edge
+func WithMaxEdgePipes(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxEdgePipes = n
+	}
+}
+
+// WithResultSerializer sets the serializer for moving results to another
+// process
+func WithResultSerializer(rs ResultSerializer) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.ResultSerializer = rs
+	}
+}
+
+// WithMaxEdges limits the number of edges loaded at the same time
+func WithMaxEdges(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxEdges = n
+	}
+}
+
+// WithUnsafeCloneFallback makes builds return the shared result of an edge
+// when it can't be cloned instead of failing
+func WithUnsafeCloneFallback() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.UnsafeCloneFallback = true
+	}
+}
+
+// WithResultExtractor sets the function returning the result of a build from
+// the value its request completed with
+func WithResultExtractor(f func(interface{}) (CachedResult, error)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.ResultExtractor = f
+	}
+}
+
+// WithQueuePolicy sets the order queued edges are dispatched in
+func WithQueuePolicy(p QueuePolicy) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.QueuePolicy = p
+	}
+}
+
+// WithIndexKeyPolicy sets which dependency keys edges are indexed under for
+// merging
+func WithIndexKeyPolicy(p IndexKeyPolicy) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.IndexKeyPolicy = p
+	}
+}
+
+// WithTraceDispatches records spans for the queue wait and the dispatch of
+// every edge in the trace of its build
+func WithTraceDispatches() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.TraceDispatches = true
+	}
+}
+
+// WithPriorityAging raises the priority of queued edges by one for every d they
+// wait in the queue
+func WithPriorityAging(d time.Duration) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.PriorityAging = d
+	}
+}
+
+// WithStatsWindow sets the longest window for windowed statistics
+func WithStatsWindow(d time.Duration) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.StatsWindow = d
+	}
+}
+
+// WithConcurrency limits the number of asynchronous requests running at the
+// same time
+func WithConcurrency(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Concurrency = n
+	}
+}
+
+// WithLogger sets the logger for the warnings of the scheduler
+func WithLogger(l logrus.FieldLogger) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Logger = l
+	}
+}
+
+// withManualDispatch creates a scheduler that only dispatches edges when step
+// is called
+func withManualDispatch() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.manualDispatch = true
+	}
+}
+
+// WithClock sets the time source of the scheduler
+func WithClock(c Clock) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Clock = c
+	}
+}
+
+// WithTraceRecorder sets the recorder for the build traces of the scheduler
+func WithTraceRecorder(r *TraceRecorder) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.TraceRecorder = r
+	}
+}
+
+// WithMemoryPressure cancels the builds chosen by selector every time signal
+// fires. The memory retained by the builds is measured with size. A nil
+// selector cancels the build retaining the most memory.
+func WithMemoryPressure(signal <-chan struct{}, size func(Result) int64, selector func([]BuildUsage) []BuildUsage) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MemoryPressure = signal
+		o.ResultSize = size
+		o.MemoryPressureSelector = selector
+	}
+}
+
+// WithReplay makes the scheduler reproduce the dispatch order and cache
+// outcomes of a recorded trace
+func WithReplay(t *BuildTrace) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Replay = t
+	}
+}
+
+// WithMemoryPressureSteps sets the ways of reclaiming memory that are tried in
+// order every time the memory pressure signal fires
+func WithMemoryPressureSteps(steps ...ReclaimStep) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MemoryPressureSteps = steps
+	}
+}
+
+// WithPipeTracer sets the function receiving the requests between the edges
+// selected by filter and the responses for them. A nil filter traces all edges.
+func WithPipeTracer(filter func(Edge) bool, f func(PipeEvent)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.TracePipes = filter
+		o.PipeTracer = f
+	}
+}
+
+// WithDefinitionDigest verifies that edges have matching definition digests
+// before they are merged
+func WithDefinitionDigest(f func(context.Context, Vertex) (digest.Digest, error)) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.DefinitionDigest = f
+	}
+}
+
+// WithMergeSelector sets the function rewriting the dependency selectors of
+// merged edges before they are recorded for exporting the cache. Wrong
+// selectors make builds load wrong results from the cache.
+func WithMergeSelector(f func(target, src Edge, index Index, sel digest.Digest) digest.Digest) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MergeSelector = f
+	}
+}
+
+// WithMergeTimeout abandons merges whose verification takes longer than d
+func WithMergeTimeout(d time.Duration) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MergeTimeout = d
+	}
+}
+
+// WithHoldPendingMerges keeps edges queued for deferred merges from being
+// dispatched until they have been checked for a merge
+func WithHoldPendingMerges() SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.HoldPendingMerges = true
+	}
+}
+
+// WithDeferredMerges merges edges with matching cache keys outside of their
+// dispatch, at most n edges at a time
+func WithDeferredMerges(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.DeferredMerges = n
+	}
+}
+
+// WithVerifyUpdates enables checking that every unpark handles all the updates
+// of the edge
+func WithVerifyUpdates(enabled bool) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.VerifyUpdates = enabled
+	}
+}
+
+// WithName sets the name identifying the scheduler in its metrics
+func WithName(name string) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Name = name
+	}
+}
+
+// WithMaxPendingResults limits the number of asynchronous requests whose
+// results have not been received by their edges
+func WithMaxPendingResults(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.MaxPendingResults = n
+	}
+}
+
+// WithRequestID sets the context key of the client request ID of builds and
+// the name of the log field it is added as
+func WithRequestID(key interface{}, field string) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.RequestIDKey = key
+		o.RequestIDField = field
+	}
+}
+
+// WithCollectErrors sends the internal errors of the scheduler to a channel
+// buffered for n errors instead of panicking
+func WithCollectErrors(n int) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.CollectErrors = n
+	}
+}
+
+// WithTrace enables debug logging of every dispatch
+func WithTrace(enabled bool) SchedulerOption {
+	return func(o *SchedulerOpt) {
+		o.Trace = enabled
+	}
+}
@@ -0,0 +1,193 @@
+package solver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultStatsWindow = 10 * time.Minute
+
+// Stats is a snapshot of the scheduler statistics
+type Stats struct {
+	// CachedEdges is the number of edges that completed by loading their
+	// result from the cache
+	CachedEdges int
+	// ExecutedEdges is the number of edges that completed by executing their
+	// operation
+	ExecutedEdges int
+	// QueueLength is the number of edges waiting for dispatch
+	QueueLength int
+	// LoopWaiting is true if the scheduler loop is idle waiting for edges to
+	// be queued. A loop that is not waiting while the queue is not getting
+	// shorter is not making progress.
+	LoopWaiting bool
+	// Dispatch is the total time spent in each phase of dispatching edges
+	Dispatch DispatchTimings
+	// MergedEdges is the number of edges that were merged to an edge with a
+	// matching cache key
+	MergedEdges int
+	// MergedBuilds is the number of builds whose requested edge was merged to
+	// an edge of another build, see BuildInfo.Merged
+	MergedBuilds int
+	// Utilization is the fraction of SchedulerOpt.Concurrency used by running
+	// asynchronous requests. It is zero if the concurrency is not limited.
+	Utilization float64
+	// FuncRequestsWaiting is the number of asynchronous requests, like
+	// computing cache keys and executing operations, that haven't started yet
+	// because of the concurrency limit, exclusive locks or MaxPendingResults
+	FuncRequestsWaiting int
+	// RunningFuncRequests is the number of asynchronous requests of each kind
+	// that are currently executing. Kinds without running requests are
+	// omitted.
+	RunningFuncRequests map[FuncRequestKind]int
+	// IndexEntries is the number of entries in the index used for merging
+	// edges with matching cache keys. It is only set by Solver.Stats.
+	IndexEntries int
+	// Signals is the number of times the loop was signaled for a newly queued
+	// edge. It should be close to the number of dispatches, a much larger
+	// number means edges are signaled redundantly.
+	Signals int
+	// Wakeups is the number of times the loop woke up from waiting for queued
+	// edges. Fewer signals than dispatches or wakeups without signals point to
+	// lost or spurious wakeups.
+	Wakeups int
+	// UncacheableEdges is the number of edges that completed without a cache
+	// key. It is only counted with SchedulerOpt.WarnUncacheable.
+	UncacheableEdges int
+	// LoadedEdges is the number of edges currently loaded, see
+	// SchedulerOpt.MaxEdges
+	LoadedEdges int
+	// Paused is true if the loop is blocked by Pause. Edges queued while the
+	// scheduler is paused are counted in QueueLength and dispatched after
+	// Resume.
+	Paused bool
+
+	time        time.Time
+	completions []edgeCompletion
+}
+
+// CacheHitRatio returns the ratio of edges completed from the cache to all
+// completed edges in the last window. Completions older than
+// SchedulerOpt.StatsWindow are not tracked. Zero is returned if no edges
+// completed in the window.
+func (st Stats) CacheHitRatio(window time.Duration) float64 {
+	var cached, total int
+	for _, c := range st.completions {
+		if st.time.Sub(c.time) > window {
+			continue
+		}
+		total++
+		if c.cached {
+			cached++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(cached) / float64(total)
+}
+
+// DispatchTimings is the time spent in the phases of dispatching edges
+type DispatchTimings struct {
+	// Dispatches is the number of dispatched edges
+	Dispatches int
+	// Collect is the time spent collecting the pipes of the edges
+	Collect time.Duration
+	// Receive is the time spent receiving the updates of outgoing requests
+	Receive time.Duration
+	// Unpark is the time spent processing the edges
+	Unpark time.Duration
+	// Filter is the time spent dropping the completed pipes of the edges
+	Filter time.Duration
+	// Merge is the time spent merging edges with matching cache keys
+	Merge time.Duration
+}
+
+type edgeCompletion struct {
+	time   time.Time
+	cached bool
+}
+
+// schedulerStats collects the edge completions of the scheduler. Protected by
+// scheduler.mu.
+type schedulerStats struct {
+	window       time.Duration
+	cached       int
+	executed     int
+	merges       int
+	mergedBuilds int
+	uncacheable  int
+	completions  []edgeCompletion
+	dispatch     DispatchTimings
+	signals      int // protected by scheduler.muQ
+	wakeups      int
+}
+
+// lap adds the time since start to d and returns the current time
+func (s *scheduler) lap(d *time.Duration, start time.Time) time.Time {
+	now := s.opt.Clock.Now()
+	*d += now.Sub(start)
+	return now
+}
+
+func (st *schedulerStats) record(cached bool, now time.Time) {
+	if cached {
+		st.cached++
+	} else {
+		st.executed++
+	}
+	st.completions = append(st.completions, edgeCompletion{time: now, cached: cached})
+	st.prune(now)
+}
+
+func (st *schedulerStats) prune(now time.Time) {
+	i := 0
+	for i < len(st.completions) && now.Sub(st.completions[i].time) > st.window {
+		i++
+	}
+	if i > 0 {
+		st.completions = append(st.completions[:0], st.completions[i:]...)
+	}
+}
+
+// Stats returns the current statistics of the scheduler
+func (s *scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentStats()
+}
+
+// currentStats returns the current statistics. Called with s.mu held.
+func (s *scheduler) currentStats() Stats {
+	s.muQ.Lock()
+	queueLength := len(s.waitq)
+	signals := s.stats.signals
+	s.muQ.Unlock()
+
+	var utilization float64
+	if s.sem != nil {
+		utilization = float64(len(s.sem)) / float64(cap(s.sem))
+	}
+
+	now := s.opt.Clock.Now()
+	s.stats.prune(now)
+	return Stats{
+		CachedEdges:         s.stats.cached,
+		ExecutedEdges:       s.stats.executed,
+		QueueLength:         queueLength,
+		LoopWaiting:         s.waiting,
+		Dispatch:            s.stats.dispatch,
+		MergedEdges:         s.stats.merges,
+		MergedBuilds:        s.stats.mergedBuilds,
+		FuncRequestsWaiting: s.funcRequestsWaiting(),
+		RunningFuncRequests: s.runningFuncRequests(),
+		Utilization:         utilization,
+		Signals:             signals,
+		Wakeups:             s.stats.wakeups,
+		Paused:              s.pausedWaiting,
+		LoadedEdges:         int(atomic.LoadInt64(&s.liveEdges)),
+		UncacheableEdges:    s.stats.uncacheable,
+		time:                now,
+		completions:         append([]edgeCompletion(nil), s.stats.completions...),
+	}
+}
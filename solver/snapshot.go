@@ -0,0 +1,74 @@
+package solver
+
+import "sort"
+
+// Snapshot is a consistent view of the scheduler state. All fields are
+// collected under a single acquisition of the scheduler lock, so they describe
+// the same point in time.
+type Snapshot struct {
+	// Stats are the scheduler statistics, see Stats
+	Stats Stats
+	// Builds are the requests of the running builds, see ActiveBuilds
+	Builds []BuildRequest
+	// Edges are the edges with requests to them, ordered by ID
+	Edges []SnapshotEdge
+	// PendingMerges are the edges waiting to be checked for a merge, see
+	// PendingMerges
+	PendingMerges []MergeInfo
+}
+
+// SnapshotEdge describes an edge in a Snapshot. Results and cache keys of the
+// edge are not copied.
+type SnapshotEdge struct {
+	Edge Edge
+	// ID is the ID the scheduler assigned to the edge
+	ID uint64
+	// Complete is true if the edge has completed
+	Complete bool
+	// Blocked is the reason why the edge has not completed yet, see WhyBlocked
+	Blocked string
+	// Requests is the number of requests to the edge
+	Requests int
+	// Inputs are the IDs of the edges the edge has requests to, ordered by ID.
+	// Together with ID they form the graph of the edges.
+	Inputs []uint64
+}
+
+// Snapshot returns a consistent view of the statistics, running builds, edges
+// and pending merges of the scheduler. The lock is held while the snapshot is
+// collected, so only the state needed to describe the edges is copied.
+func (s *scheduler) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &Snapshot{
+		Stats:         s.currentStats(),
+		Builds:        s.activeBuilds(),
+		Edges:         make([]SnapshotEdge, 0, len(s.incoming)),
+		PendingMerges: s.pendingMerges(),
+	}
+	for e, in := range s.incoming {
+		se := SnapshotEdge{
+			Edge:     e.edge,
+			ID:       e.id,
+			Complete: e.isComplete(),
+			Blocked:  s.whyBlocked(e),
+			Requests: len(in),
+		}
+		seen := map[*edge]struct{}{}
+		for _, p := range s.outgoing[e] {
+			if p.Target == nil {
+				continue
+			}
+			if _, ok := seen[p.Target]; ok {
+				continue
+			}
+			seen[p.Target] = struct{}{}
+			se.Inputs = append(se.Inputs, p.Target.id)
+		}
+		sort.Slice(se.Inputs, func(i, j int) bool { return se.Inputs[i] < se.Inputs[j] })
+		snap.Edges = append(snap.Edges, se)
+	}
+	sort.Slice(snap.Edges, func(i, j int) bool { return snap.Edges[i].ID < snap.Edges[j].ID })
+	return snap
+}
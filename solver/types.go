@@ -2,6 +2,7 @@ package solver
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/containerd/containerd/content"
@@ -45,6 +46,19 @@ type Edge struct {
 	Vertex Vertex
 }
 
+// EdgeKey returns the identity of an edge in the solver. Edges with the same
+// key are evaluated as the same edge: the key combines the vertex digest with
+// the output index. Edges with different keys can still share a result if
+// they are merged because of matching cache keys.
+func EdgeKey(e Edge) string {
+	return fmt.Sprintf("%s:%d", e.Vertex.Digest(), e.Index)
+}
+
+// EdgeEqual returns true if a and b are the same edge in the solver
+func EdgeEqual(a, b Edge) bool {
+	return a.Index == b.Index && a.Vertex.Digest() == b.Vertex.Digest()
+}
+
 // VertexOptions define optional metadata for a vertex that doesn't change the
 // definition or equality check of it. These options are not contained in the
 // vertex digest.
@@ -53,9 +67,46 @@ type VertexOptions struct {
 	CacheSources []CacheManager
 	Description  map[string]string // text values with no special meaning for solver
 	ExportCache  *bool
+	// NonShareable disables merging the vertex with other vertexes that have
+	// matching cache keys, so its result is never shared through the cache
+	// key index. Vertexes with the same digest are still shared.
+	NonShareable bool
+	// Cost is the relative cost of evaluating the vertex used by the fair
+	// queuing of the scheduler. Defaults to 1.
+	Cost int
+	// ExclusiveLocks are names of host resources the vertex needs exclusive
+	// access to. Asynchronous work of vertexes that share a lock name, like
+	// computing cache keys and executing operations, never runs at the same
+	// time.
+	ExclusiveLocks []string
+	// Type is a tag for the kind of the vertex. It selects the result
+	// processor of the scheduler that is applied to results of the vertex.
+	Type string
+	// Condition makes evaluating the vertex depend on the result of another
+	// edge
+	Condition *Condition
+	// ResourceLimits are passed to the operation of the vertex when it is
+	// executed, see ResourceLimitsFromContext
+	ResourceLimits *ResourceLimits
+	// ExecTimeout limits the time the operation of the vertex can run. The
+	// context of the operation is canceled when it expires and the edge
+	// fails with ErrExecTimeout. Loading the result from the cache and
+	// computing cache keys are not limited. Zero disables the limit.
+	ExecTimeout time.Duration
 	// WorkerConstraint
 }
 
+// Condition is a control dependency of a vertex. The condition edge is built
+// before anything else is evaluated for the vertex, including its inputs and
+// cache keys. If Check returns false the vertex is skipped: its operation is
+// not run and its edges complete with a skipped result that doesn't hold any
+// data and is not saved to the cache. Skipped results are passed to the
+// dependants like any other input and can be detected with IsSkipped.
+type Condition struct {
+	Edge  Edge
+	Check func(context.Context, Result) (bool, error)
+}
+
 // Result is an abstract return value for a solve
 type Result interface {
 	ID() string